@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
+	"com.jerry/contract/abac/policy"
+	"com.jerry/contract/bridge"
+	"com.jerry/contract/token"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -29,35 +34,41 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	}
 
 	_, args := stub.GetFunctionAndParameters()
-	var A, B string    // Entities
-	var Aval, Bval int // Asset holdings
+	var A, B string       // Entities
+	var Aval, Bval string // Genesis allocations
+	var decimals int      // Token precision
 
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+	if len(args) < 4 || len(args) > 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 to 6")
 	}
 
 	// Initialize the chaincode
-	A = args[0]
-	Aval, err = strconv.Atoi(args[1])
-	if err != nil {
-		return shim.Error("Expecting integer value for asset holding")
+	A, Aval = args[0], args[1]
+	B, Bval = args[2], args[3]
+	if len(args) >= 5 {
+		decimals, err = strconv.Atoi(args[4])
+		if err != nil {
+			return shim.Error("Expecting integer value for decimals")
+		}
 	}
-	B = args[2]
-	Bval, err = strconv.Atoi(args[3])
-	if err != nil {
-		return shim.Error("Expecting integer value for asset holding")
-	}
-	fmt.Printf("Aval = %d, Bval = %d\n", Aval, Bval)
+	fmt.Printf("Aval = %s, Bval = %s\n", Aval, Bval)
 
-	// Write the state to the ledger
-	err = stub.PutState(A, []byte(strconv.Itoa(Aval)))
+	// Write the genesis allocation and total supply to the ledger
+	err = token.Genesis(stub, decimals, token.Allocation{Account: A, Amount: Aval}, token.Allocation{Account: B, Amount: Bval})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	err = stub.PutState(B, []byte(strconv.Itoa(Bval)))
-	if err != nil {
-		return shim.Error(err.Error())
+	// Optional JSON map of function name to required attributes and MSP IDs
+	if len(args) == 6 {
+		reqs, err := policy.ParseRequirements(args[5])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = policy.PutRequirements(stub, reqs)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 	}
 
 	return shim.Success(nil)
@@ -66,6 +77,32 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println("abac Invoke")
 	function, args := stub.GetFunctionAndParameters()
+	if function == "setPolicy" {
+		// Stores the access policy of a function, admins only
+		return t.setPolicy(stub, args)
+	} else if function == "getPolicy" {
+		return t.getPolicy(stub, args)
+	} else if function == "configure" {
+		// Updates the function requirements set at init, admins only
+		return t.configure(stub, args)
+	} else if function == "getRequirements" {
+		return t.getRequirements(stub, args)
+	}
+
+	// Callers lacking a required attribute or MSP ID get a 403
+	if err := policy.Require(stub, function); err != nil {
+		if f, ok := err.(*policy.Forbidden); ok {
+			return f.Response()
+		}
+		return shim.Error(err.Error())
+	}
+
+	// Every other function is checked against its policy on the ledger;
+	// functions without a policy stay open to every caller
+	if err := policy.Evaluate(stub, function, args); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	if function == "invoke" {
 		// Make payment of X units from A to B
 		return t.invoke(stub, args)
@@ -75,61 +112,167 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	} else if function == "query" {
 		// the old "Query" is now implemtned in invoke
 		return t.query(stub, args)
+	} else if function == "mint" || function == "burn" {
+		// Issuers create or destroy tokens
+		return t.supply(stub, function, args)
+	} else if function == "approve" {
+		return t.approve(stub, args)
+	} else if function == "transferFrom" {
+		return t.transferFrom(stub, args)
+	} else if function == "allowance" {
+		return t.allowance(stub, args)
+	} else if function == "totalSupply" {
+		return t.totalSupply(stub, args)
+	} else if function == "decimals" {
+		return t.decimals(stub, args)
+	} else if function == "history" {
+		// Transfers of an account, paged with a bookmark
+		return t.history(stub, args)
+	} else if function == "proposeTransfer" {
+		// Escrow X units from A to B until enough approvers sign off
+		return t.proposeTransfer(stub, args)
+	} else if function == "approveTransfer" {
+		return t.approveTransfer(stub, args)
+	} else if function == "refundTransfer" {
+		return t.refundTransfer(stub, args)
+	} else if function == "getTransfer" {
+		return t.getTransfer(stub, args)
+	} else if function == "setKYC" {
+		// Compliance officers manage account status and limits
+		return t.setKYC(stub, args)
+	} else if function == "freeze" || function == "unfreeze" {
+		return t.freeze(stub, function, args)
+	} else if function == "setTransferLimit" {
+		return t.setTransferLimit(stub, args)
+	} else if function == "setEscrowPolicy" {
+		return t.setEscrowPolicy(stub, args)
+	} else if function == "getAccountStatus" {
+		return t.getAccountStatus(stub, args)
+	} else if function == "getAccountAudit" {
+		return t.getAccountAudit(stub, args)
+	} else if function == "registerBridge" {
+		// Moves funds to and from the peer chaincode atomically
+		return t.registerBridge(stub, args)
+	} else if function == "bridgeOut" {
+		return t.bridgeOut(stub, args)
+	} else if function == bridge.InFunction {
+		return t.bridgeIn(stub, args)
 	}
 
-	return shim.Error("Invalid invoke function name. Expecting \"invoke\" \"delete\" \"query\"")
+	return shim.Error("Invalid invoke function name. Expecting \"invoke\" \"delete\" \"query\" \"mint\" \"burn\" \"approve\" \"transferFrom\" \"allowance\" \"totalSupply\" \"decimals\" \"history\" \"proposeTransfer\" \"approveTransfer\" \"refundTransfer\" \"getTransfer\" \"setKYC\" \"freeze\" \"unfreeze\" \"setTransferLimit\" \"setEscrowPolicy\" \"getAccountStatus\" \"getAccountAudit\" \"registerBridge\" \"bridgeOut\" \"bridgeIn\" \"setPolicy\" \"getPolicy\" \"configure\" \"getRequirements\"")
 }
 
-// Transaction makes payment of X units from A to B
-func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var A, B string    // Entities
-	var Aval, Bval int // Asset holdings
-	var X int          // Transaction value
-	var err error
+// setPolicy stores the JSON access policy of a function,
+// the caller must have the "abac.admin" attribute with a value of true
+func (t *SimpleChaincode) setPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting policy json")
+	}
+	err := cid.AssertAttributeValue(stub, "abac.admin", "true")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+	var p policy.Policy
+	err = json.Unmarshal([]byte(args[0]), &p)
+	if err != nil {
+		return shim.Error("Failed to unmarshal policy: " + err.Error())
+	}
+	if p.Function == "setPolicy" || p.Function == "getPolicy" {
+		return shim.Error("Policy functions are reserved for admins")
+	}
+	err = policy.Put(stub, &p)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	A = args[0]
-	B = args[1]
+	return shim.Success(nil)
+}
+
+// getPolicy returns the access policy of a function, admins only
+func (t *SimpleChaincode) getPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting function name")
+	}
+	err := cid.AssertAttributeValue(stub, "abac.admin", "true")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	// Get the state from the ledger
-	// TODO: will be nice to have a GetAllState call to ledger
-	Avalbytes, err := stub.GetState(A)
+	p, err := policy.Get(stub, args[0])
 	if err != nil {
-		return shim.Error("Failed to get state")
+		return shim.Error(err.Error())
 	}
-	if Avalbytes == nil {
-		return shim.Error("Entity not found")
+	if p == nil {
+		return shim.Error("No policy for " + args[0])
 	}
-	Aval, _ = strconv.Atoi(string(Avalbytes))
+	policyBytes, _ := json.Marshal(p)
+	return shim.Success(policyBytes)
+}
 
-	Bvalbytes, err := stub.GetState(B)
+// configure stores a JSON map of function name to requirement, a null
+// requirement removes it; the caller must have the "abac.admin" attribute with a value of true
+func (t *SimpleChaincode) configure(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting requirements json")
+	}
+	err := cid.AssertAttributeValue(stub, "abac.admin", "true")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	reqs, err := policy.ParseRequirements(args[0])
 	if err != nil {
-		return shim.Error("Failed to get state")
+		return shim.Error(err.Error())
 	}
-	if Bvalbytes == nil {
-		return shim.Error("Entity not found")
+	for function := range reqs {
+		if function == "configure" || function == "getRequirements" || function == "setPolicy" || function == "getPolicy" {
+			return shim.Error("Configuration functions are reserved for admins")
+		}
 	}
-	Bval, _ = strconv.Atoi(string(Bvalbytes))
+	err = policy.PutRequirements(stub, reqs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
 
-	// Perform the execution
-	X, err = strconv.Atoi(args[2])
+// getRequirements returns the function requirements, admins only
+func (t *SimpleChaincode) getRequirements(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	err := cid.AssertAttributeValue(stub, "abac.admin", "true")
 	if err != nil {
-		return shim.Error("Invalid transaction amount, expecting a integer value")
+		return shim.Error(err.Error())
 	}
-	Aval = Aval - X
-	Bval = Bval + X
-	fmt.Printf("Aval = %d, Bval = %d\n", Aval, Bval)
 
-	// Write the state back to the ledger
-	err = stub.PutState(A, []byte(strconv.Itoa(Aval)))
+	reqs, err := policy.GetRequirements(stub)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	reqsBytes, _ := json.Marshal(reqs)
+	return shim.Success(reqsBytes)
+}
+
+// Transaction makes payment of X units from A to B; owner of A only
+func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
 
-	err = stub.PutState(B, []byte(strconv.Itoa(Bval)))
+	// Large payments need the approvals of an escrow
+	err := checkDirect(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Frozen accounts and KYC transfer limits
+	err = checkTransfer(stub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Move X units, failing if A does not hold enough
+	err = token.Move(stub, args[0], args[1], args[2])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -137,18 +280,21 @@ func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string
 	return shim.Success(nil)
 }
 
-// Deletes an entity from state
+// Deletes an entity from state, its balance leaves the total supply; issuers only
 func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	A := args[0]
+	// A frozen account can not be removed while it is under investigation
+	err := checkActive(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	// Delete the key from the state in ledger
-	err := stub.DelState(A)
+	err = token.Remove(stub, args[0])
 	if err != nil {
-		return shim.Error("Failed to delete state")
+		return shim.Error(err.Error())
 	}
 
 	return shim.Success(nil)
@@ -157,7 +303,6 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 // query callback representing the query of a chaincode
 func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var A string // Entities
-	var err error
 
 	if len(args) != 1 {
 		return shim.Error("Incorrect number of arguments. Expecting name of the person to query")
@@ -165,21 +310,158 @@ func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string)
 
 	A = args[0]
 
-	// Get the state from the ledger
-	Avalbytes, err := stub.GetState(A)
+	// Get the balance from the ledger
+	Aval, err := token.BalanceOf(stub, A)
+	if err == token.ErrAccountNotFound {
+		jsonResp := "{\"Error\":\"Nil amount for " + A + "\"}"
+		return shim.Error(jsonResp)
+	}
 	if err != nil {
 		jsonResp := "{\"Error\":\"Failed to get state for " + A + "\"}"
 		return shim.Error(jsonResp)
 	}
-
-	if Avalbytes == nil {
-		jsonResp := "{\"Error\":\"Nil amount for " + A + "\"}"
-		return shim.Error(jsonResp)
+	amount, err := token.Format(stub, Aval)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	jsonResp := "{\"Name\":\"" + A + "\",\"Amount\":\"" + string(Avalbytes) + "\"}"
+	jsonResp := "{\"Name\":\"" + A + "\",\"Amount\":\"" + amount + "\"}"
 	fmt.Printf("Query Response:%s\n", jsonResp)
-	return shim.Success(Avalbytes)
+	return shim.Success([]byte(amount))
+}
+
+// supply mints X units to A or burns X units from A,
+// the caller must have the "token.issuer" attribute with a value of true
+func (t *SimpleChaincode) supply(stub shim.ChaincodeStubInterface, function string, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	var err error
+	if function == "mint" {
+		err = token.Mint(stub, args[0], args[1])
+	} else {
+		err = token.Burn(stub, args[0], args[1])
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// approve lets a spender move up to X units from the caller's account,
+// the caller's account is named by its "token.account" attribute
+func (t *SimpleChaincode) approve(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	err := token.Approve(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// transferFrom moves X units from A to B out of the caller's allowance
+func (t *SimpleChaincode) transferFrom(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	err := checkDirect(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkTransfer(stub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = token.TransferFrom(stub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// allowance returns how much a spender may still move from an owner
+func (t *SimpleChaincode) allowance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting owner and spender")
+	}
+
+	v, err := token.Allowance(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := token.Format(stub, v)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(amount))
+}
+
+// totalSupply returns the number of tokens in circulation
+func (t *SimpleChaincode) totalSupply(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	v, err := token.TotalSupply(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := token.Format(stub, v)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(amount))
+}
+
+// decimals returns the token precision chosen at init
+func (t *SimpleChaincode) decimals(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	decimals, err := token.Decimals(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(strconv.Itoa(decimals)))
+}
+
+// history returns the transfers of an account between two RFC 3339 times,
+// empty times leave the range open; pass the returned bookmark to get the next page
+func (t *SimpleChaincode) history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting account, from, to, pageSize and bookmark")
+	}
+
+	var from, to time.Time
+	var err error
+	if args[1] != "" {
+		from, err = time.Parse(time.RFC3339, args[1])
+		if err != nil {
+			return shim.Error("Expecting RFC 3339 time for from")
+		}
+	}
+	if args[2] != "" {
+		to, err = time.Parse(time.RFC3339, args[2])
+		if err != nil {
+			return shim.Error("Expecting RFC 3339 time for to")
+		}
+	}
+	pageSize, err := strconv.Atoi(args[3])
+	if err != nil {
+		return shim.Error("Expecting integer value for pageSize")
+	}
+
+	page, err := token.History(stub, args[0], from, to, pageSize, args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageBytes, _ := json.Marshal(page)
+	return shim.Success(pageBytes)
 }
 
 func main() {
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
 	"testing"
+	"time"
+
+	"com.jerry/contract/abac/policy"
+	"com.jerry/contract/shimtest"
+	"com.jerry/contract/token"
 )
 
 // Cert with attribute. "abac.init":"true"
@@ -27,6 +34,23 @@ w8Ou1Sh9IjeXj/SDAA==
 -----END CERTIFICATE-----
 `
 
+// newStub returns a stub whose caller is the Fabric CA issued certWithAttrs identity
+func newStub(t *testing.T) *shimtest.Stub {
+	id, err := shimtest.IdentityFromPEM("Org1MSP", certWithAttrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shimtest.NewStub("abac", new(SimpleChaincode)).As(id)
+}
+
+func newIdentity(t *testing.T, mspID string, attrs map[string]string, ous ...string) *shimtest.Identity {
+	id, err := shimtest.NewIdentity(mspID, attrs, ous...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
 func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	res := stub.MockInit("1", args)
 	if res.Status != shim.OK {
@@ -72,8 +96,7 @@ func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
 }
 
 func TestAbac_Init(t *testing.T) {
-	scc := new(SimpleChaincode)
-	stub := shim.NewMockStub("abac", scc)
+	stub := newStub(t).MockStub
 
 	// Init A=123 B=234
 	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("123"), []byte("B"), []byte("234")})
@@ -83,8 +106,7 @@ func TestAbac_Init(t *testing.T) {
 }
 
 func TestAbac_Query(t *testing.T) {
-	scc := new(SimpleChaincode)
-	stub := shim.NewMockStub("abac", scc)
+	stub := newStub(t).MockStub
 
 	// Init A=345 B=456
 	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("345"), []byte("B"), []byte("456")})
@@ -97,21 +119,421 @@ func TestAbac_Query(t *testing.T) {
 }
 
 func TestAbac_Invoke(t *testing.T) {
-	scc := new(SimpleChaincode)
-	stub := shim.NewMockStub("abac", scc)
+	stub := newStub(t).MockStub
 
 	// Init A=567 B=678
 	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("567"), []byte("B"), []byte("678")})
 
-	// Invoke A->B for 123
+	// Invoke A->B for 123 as the owner of A
+	stub.Creator = newIdentity(t, "Org1MSP", map[string]string{token.AccountAttr: "A"}).Creator
 	checkInvoke(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("123")})
 	checkQuery(t, stub, "A", "444")
 	checkQuery(t, stub, "B", "801")
 
-	// Invoke B->A for 234
+	// Invoke B->A for 234 as the owner of B
+	stub.Creator = newIdentity(t, "Org1MSP", map[string]string{token.AccountAttr: "B"}).Creator
 	checkInvoke(t, stub, [][]byte{[]byte("invoke"), []byte("B"), []byte("A"), []byte("234")})
 	checkQuery(t, stub, "A", "678")
 	checkQuery(t, stub, "B", "567")
 	checkQuery(t, stub, "A", "678")
 	checkQuery(t, stub, "B", "567")
 }
+
+func TestAbac_InitRequiresAttribute(t *testing.T) {
+	stub := shimtest.NewStub("abac", new(SimpleChaincode))
+
+	res := stub.Init("A", "1", "B", "2")
+	if res.Status == shim.OK {
+		t.Fatal("Init without a creator should fail")
+	}
+
+	stub.As(newIdentity(t, "Org1MSP", map[string]string{"abac.init": "false"}))
+	res = stub.Init("A", "1", "B", "2")
+	if res.Status == shim.OK {
+		t.Fatal("Init without abac.init=true should fail")
+	}
+}
+
+func TestAbac_Policy(t *testing.T) {
+	stub := newStub(t)
+	checkInit(t, stub.MockStub, [][]byte{[]byte("init"), []byte("A"), []byte("1000"), []byte("B"), []byte("0")})
+
+	admin := newIdentity(t, "Org1MSP", map[string]string{"abac.admin": "true"})
+	teller := newIdentity(t, "Org1MSP", map[string]string{"abac.limit": "100", token.AccountAttr: "A"}, "client")
+	outsider := newIdentity(t, "Org2MSP", map[string]string{"abac.limit": "100", token.AccountAttr: "A"}, "client")
+
+	policy := `{"function":"invoke","args":["from","to","amount"],"rules":[{"mspIds":["Org1MSP"],"ous":["client"],"conditions":["amount <= attr.abac.limit"]}]}`
+	if _, err := stub.As(teller).Call("setPolicy", policy); err == nil {
+		t.Fatal("setPolicy by non admin should fail")
+	}
+	if _, err := stub.As(admin).Call("setPolicy", `{"function":"invoke","rules":[{"conditions":["amount <= 1"]}]}`); err == nil {
+		t.Fatal("policy with an unknown operand should be rejected")
+	}
+	if _, err := stub.As(admin).Call("setPolicy", policy); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := stub.As(admin).Call("getPolicy", "invoke")
+	if err != nil || !json.Valid(stored) {
+		t.Fatal("getPolicy failed", err)
+	}
+
+	if _, err = stub.As(teller).Call("invoke", "A", "B", "100"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stub.As(teller).Call("invoke", "A", "B", "101"); err == nil {
+		t.Fatal("transfer above the limit should be denied")
+	}
+	if _, err = stub.As(outsider).Call("invoke", "A", "B", "1"); err == nil {
+		t.Fatal("transfer by another MSP should be denied")
+	}
+	// functions without a policy stay open
+	checkQuery(t, stub.MockStub, "B", "100")
+}
+
+func TestAbac_Token(t *testing.T) {
+	stub := newStub(t)
+	checkInit(t, stub.MockStub, [][]byte{[]byte("init"), []byte("A"), []byte("10.5"), []byte("B"), []byte("0"), []byte("2")})
+	checkState(t, stub.MockStub, "A", "1050")
+	checkQuery(t, stub.MockStub, "A", "10.50")
+
+	issuer := newIdentity(t, "Org1MSP", map[string]string{token.IssuerAttr: "true"})
+	alice := newIdentity(t, "Org1MSP", map[string]string{token.AccountAttr: "A"})
+	bob := newIdentity(t, "Org1MSP", map[string]string{token.AccountAttr: "B"})
+
+	if _, err := stub.As(alice).Call("mint", "A", "1"); err == nil {
+		t.Fatal("mint by non issuer should fail")
+	}
+	if _, err := stub.As(issuer).Call("mint", "C", "4.5"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.As(issuer).Call("burn", "A", "0.5"); err != nil {
+		t.Fatal(err)
+	}
+	supply, err := stub.Call("totalSupply")
+	if err != nil || string(supply) != "14.50" {
+		t.Fatal("unexpected total supply", string(supply), err)
+	}
+
+	for _, args := range [][]string{{"A", "B", "-1"}, {"A", "B", "10.01"}, {"A", "B", "0.001"}} {
+		if _, err = stub.As(alice).Call("invoke", args...); err == nil {
+			t.Fatal("invalid transfer should fail", args)
+		}
+	}
+	if _, err = stub.As(bob).Call("invoke", "A", "B", "1"); err == nil {
+		t.Fatal("only the owner of A may transfer from it")
+	}
+
+	if _, err = stub.As(alice).Call("approve", "B", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stub.As(bob).Call("transferFrom", "A", "C", "3.01"); err == nil {
+		t.Fatal("transferFrom above the allowance should fail")
+	}
+	if _, err = stub.As(bob).Call("transferFrom", "A", "C", "2"); err != nil {
+		t.Fatal(err)
+	}
+	allowance, err := stub.Call("allowance", "A", "B")
+	if err != nil || string(allowance) != "1.00" {
+		t.Fatal("unexpected allowance", string(allowance), err)
+	}
+	checkQuery(t, stub.MockStub, "A", "8.00")
+	checkQuery(t, stub.MockStub, "C", "6.50")
+}
+
+func TestAbac_Escrow(t *testing.T) {
+	stub := newStub(t)
+	checkInit(t, stub.MockStub, [][]byte{[]byte("init"), []byte("A"), []byte("1000"), []byte("B"), []byte("0")})
+
+	officer := func(id string) *shimtest.Identity {
+		return newIdentity(t, "Org1MSP", map[string]string{approverAttr: id})
+	}
+	compliance := newIdentity(t, "Org1MSP", map[string]string{complianceAttr: "true"})
+	alice := newIdentity(t, "Org1MSP", map[string]string{token.AccountAttr: "A"})
+	deadline := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	if _, err := stub.As(alice).Call("proposeTransfer", "A", "B", "600", deadline); err == nil {
+		t.Fatal("escrow without a policy should fail")
+	}
+	if _, err := stub.As(alice).Call("setEscrowPolicy", `["o1","o2","o3"]`, "2", "500"); err == nil {
+		t.Fatal("policy change without the compliance attribute should fail")
+	}
+	if _, err := stub.As(compliance).Call("setEscrowPolicy", `["o1","o2","o3"]`, "4", "500"); err == nil {
+		t.Fatal("threshold above the number of approvers should fail")
+	}
+	if _, err := stub.As(compliance).Call("setEscrowPolicy", `["o1","o2","o3"]`, "2", "-1"); err == nil {
+		t.Fatal("an invalid escrow amount should fail")
+	}
+	if _, err := stub.As(compliance).Call("setEscrowPolicy", `["o1","o2","o3"]`, "2", "500"); err != nil {
+		t.Fatal(err)
+	}
+	// above 500 a payment must be escrowed
+	if _, err := stub.As(alice).Call("invoke", "A", "B", "600"); err == nil {
+		t.Fatal("a direct transfer above the escrow amount should fail")
+	}
+	checkQuery(t, stub.MockStub, "A", "1000")
+	// level 0 may send 1200 a day
+	if _, err := stub.As(compliance).Call("setTransferLimit", "0", "", "1200"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.Call("proposeTransfer", "A", "B", "600", deadline); err == nil {
+		t.Fatal("escrow by a caller without an account should fail")
+	}
+	if _, err := stub.As(alice).Call("proposeTransfer", "B", "A", "0", deadline); err == nil {
+		t.Fatal("escrow from another account should fail")
+	}
+	if _, err := stub.As(alice).Call("proposeTransfer", "A", "B", "2000", deadline); err == nil {
+		t.Fatal("escrow above the balance should fail")
+	}
+	payload, err := stub.As(alice).Call("proposeTransfer", "A", "B", "600", deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Escrow
+	if err = json.Unmarshal(payload, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Threshold != 2 || len(e.Approvers) != 3 {
+		t.Fatal("escrow should follow the policy", string(payload))
+	}
+	checkQuery(t, stub.MockStub, "A", "400")
+	if _, err = stub.Call("invoke", "A", "B", "500"); err == nil {
+		t.Fatal("escrowed funds must not be spendable")
+	}
+
+	if _, err = stub.As(officer("o9")).Call("approveTransfer", e.Id); err == nil {
+		t.Fatal("approval by a non designated officer should fail")
+	}
+	if _, err = stub.As(officer("o1")).Call("approveTransfer", e.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stub.As(officer("o1")).Call("approveTransfer", e.Id); err == nil {
+		t.Fatal("duplicate approval should fail")
+	}
+	checkQuery(t, stub.MockStub, "B", "0")
+	if _, err = stub.As(officer("o3")).Call("approveTransfer", e.Id); err != nil {
+		t.Fatal(err)
+	}
+	checkQuery(t, stub.MockStub, "B", "600")
+	if _, err = stub.Call("refundTransfer", e.Id); err == nil {
+		t.Fatal("executed escrow should not be refunded")
+	}
+
+	// the refund waits until the deadline has passed
+	deadline = stub.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	payload, err = stub.As(alice).Call("proposeTransfer", "A", "B", "100", deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(payload, &e); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stub.Call("refundTransfer", e.Id); err == nil {
+		t.Fatal("refund before the deadline should fail")
+	}
+	stub.Advance(2 * time.Hour)
+	if _, err = stub.As(officer("o1")).Call("approveTransfer", e.Id); err == nil {
+		t.Fatal("approval after the deadline should fail")
+	}
+	if _, err = stub.Call("refundTransfer", e.Id); err != nil {
+		t.Fatal(err)
+	}
+	checkQuery(t, stub.MockStub, "A", "400")
+	// the refunded 100 leaves room under the daily limit again
+	if _, err = stub.As(alice).Call("invoke", "A", "B", "100"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuery(t, stub.MockStub, "B", "700")
+}
+
+func TestAbac_Compliance(t *testing.T) {
+	stub := newStub(t)
+	checkInit(t, stub.MockStub, [][]byte{[]byte("init"), []byte("A"), []byte("1000"), []byte("B"), []byte("0")})
+	officer := newIdentity(t, "Org1MSP", map[string]string{complianceAttr: "true"})
+	bob := newIdentity(t, "Org1MSP", map[string]string{token.AccountAttr: "B"})
+	user := newIdentity(t, "Org1MSP", map[string]string{token.AccountAttr: "A"}).Creator
+
+	if _, err := stub.Call("freeze", "A", "court order"); err == nil {
+		t.Fatal("freeze without the compliance attribute should fail")
+	}
+	if _, err := stub.As(officer).Call("freeze", "A", ""); err == nil {
+		t.Fatal("status change without a reason should fail")
+	}
+	if _, err := stub.As(officer).Call("freeze", "A", "court order"); err != nil {
+		t.Fatal(err)
+	}
+	stub.Creator = user
+	if _, err := stub.Call("invoke", "A", "B", "10"); err == nil {
+		t.Fatal("transfer from a frozen account should fail")
+	}
+	if _, err := stub.As(bob).Call("invoke", "B", "A", "0"); err == nil {
+		t.Fatal("transfer to a frozen account should fail")
+	}
+	if _, err := stub.As(officer).Call("unfreeze", "A", "order lifted"); err != nil {
+		t.Fatal(err)
+	}
+
+	// level 0 may send 100 at once and 150 a day, level 1 is unrestricted
+	if _, err := stub.Call("setTransferLimit", "0", "100", "150"); err != nil {
+		t.Fatal(err)
+	}
+	stub.Creator = user
+	if _, err := stub.Call("invoke", "A", "B", "101"); err == nil {
+		t.Fatal("transfer above the single limit should fail")
+	}
+	if _, err := stub.Call("invoke", "A", "B", "100"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.Call("invoke", "A", "B", "60"); err == nil {
+		t.Fatal("transfer above the daily limit should fail")
+	}
+	if _, err := stub.Call("invoke", "A", "B", "50"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.As(officer).Call("setKYC", "A", "1", "documents verified"); err != nil {
+		t.Fatal(err)
+	}
+	stub.Creator = user
+	if _, err := stub.Call("invoke", "A", "B", "500"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuery(t, stub.MockStub, "B", "650")
+
+	payload, err := stub.Call("getAccountStatus", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status AccountStatus
+	if err = json.Unmarshal(payload, &status); err != nil || status.KYCLevel != 1 || status.Frozen {
+		t.Fatal("unexpected status", string(payload), err)
+	}
+	if _, err = stub.Call("getAccountAudit", "A"); err == nil {
+		t.Fatal("audit without the compliance attribute should fail")
+	}
+	payload, err = stub.As(officer).Call("getAccountAudit", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audit []*AuditEntry
+	if err = json.Unmarshal(payload, &audit); err != nil || len(audit) != 3 {
+		t.Fatal("expecting 3 audit entries", string(payload), err)
+	}
+	if !audit[0].Current.Frozen || audit[0].Previous.Frozen || audit[2].Current.KYCLevel != 1 {
+		t.Fatal("unexpected audit trail", string(payload))
+	}
+}
+
+// peerChaincode stands in for the example chaincode on the other side of the bridge
+type peerChaincode struct {
+	received [][]string
+}
+
+func (p *peerChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response { return shim.Success(nil) }
+
+func (p *peerChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	if function != "bridgeIn" || args[1] == "closed" {
+		return shim.Error("rejected")
+	}
+	p.received = append(p.received, args)
+	return shim.Success(nil)
+}
+
+func TestAbac_Bridge(t *testing.T) {
+	stub := newStub(t)
+	checkInit(t, stub.MockStub, [][]byte{[]byte("init"), []byte("A"), []byte("1000"), []byte("B"), []byte("0")})
+	alice := newIdentity(t, "Org1MSP", map[string]string{token.AccountAttr: "A"})
+	bob := newIdentity(t, "Org1MSP", map[string]string{token.AccountAttr: "B"})
+	admin := newIdentity(t, "Org1MSP", map[string]string{"abac.admin": "true"})
+	peer := &peerChaincode{}
+	stub.MockPeerChaincode("example", shim.NewMockStub("example", peer))
+
+	// MockStub keeps the writes of failed transactions, so the unregistered
+	// attempt runs on a stub of its own
+	unregistered := newStub(t)
+	checkInit(t, unregistered.MockStub, [][]byte{[]byte("init"), []byte("A"), []byte("1000"), []byte("B"), []byte("0")})
+	if _, err := unregistered.As(alice).Call("bridgeOut", "A", "X", "100"); err == nil {
+		t.Fatal("bridgeOut without a registered peer should fail")
+	}
+	checkQuery(t, unregistered.MockStub, "A", "1000")
+
+	if _, err := stub.Call("registerBridge", "example"); err == nil {
+		t.Fatal("registerBridge by non admin should fail")
+	}
+	if _, err := stub.As(admin).Call("registerBridge", "example"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := stub.As(bob).Call("bridgeOut", "A", "X", "100"); err == nil {
+		t.Fatal("only the owner of A may bridge funds out of it")
+	}
+	if len(peer.received) != 0 {
+		t.Fatal("the peer should not be credited", peer.received)
+	}
+	if _, err := stub.As(alice).Call("bridgeOut", "A", "X", "100"); err != nil {
+		t.Fatal(err)
+	}
+	if len(peer.received) != 1 || peer.received[0][0] != "A" || peer.received[0][1] != "X" || peer.received[0][2] != "100" {
+		t.Fatal("peer should be credited in the same transaction", peer.received)
+	}
+	checkQuery(t, stub.MockStub, "A", "900")
+	if supply, _ := stub.Call("totalSupply"); string(supply) != "900" {
+		t.Fatal("bridged funds should leave the supply", string(supply))
+	}
+	if _, err := stub.Call("bridgeOut", "A", "closed", "100"); err == nil {
+		t.Fatal("bridgeOut must fail when the peer rejects the credit")
+	}
+
+	if _, err := stub.Call("bridgeIn", "X", "B", "50"); err == nil {
+		t.Fatal("bridgeIn called by a client should fail")
+	}
+	if res := stub.InvokeVia("abac", "bridgeIn", "X", "B", "50"); res.Status == shim.OK {
+		t.Fatal("bridgeIn proposed to abac itself should fail")
+	}
+	if res := stub.InvokeVia("example", "bridgeIn", "X", "B", "50"); res.Status != shim.OK {
+		t.Fatal("bridgeIn from the peer failed", res.Message)
+	}
+	checkQuery(t, stub.MockStub, "B", "50")
+}
+
+func TestAbac_Requirements(t *testing.T) {
+	stub := newStub(t)
+	reqs := `{"invoke":{"attributes":{"abac.transfer":"true"},"mspIds":["Org1MSP"]}}`
+	checkInit(t, stub.MockStub, [][]byte{[]byte("init"), []byte("A"), []byte("100"), []byte("B"), []byte("0"), []byte("0"), []byte(reqs)})
+	admin := newIdentity(t, "Org1MSP", map[string]string{"abac.admin": "true"})
+	teller := newIdentity(t, "Org1MSP", map[string]string{"abac.transfer": "true", token.AccountAttr: "A"})
+	outsider := newIdentity(t, "Org2MSP", map[string]string{"abac.transfer": "true", token.AccountAttr: "A"})
+
+	res := stub.Invoke("invoke", "A", "B", "10")
+	if res.Status != 403 {
+		t.Fatal("expecting 403 without the required attribute", res.Status, res.Message)
+	}
+	var f policy.Forbidden
+	if err := json.Unmarshal([]byte(res.Message), &f); err != nil || f.Function != "invoke" || len(f.Missing) != 1 || f.Missing[0] != "abac.transfer=true" {
+		t.Fatal("unexpected 403 message", res.Message, err)
+	}
+	if res = stub.As(outsider).Invoke("invoke", "A", "B", "10"); res.Status != 403 {
+		t.Fatal("expecting 403 for another MSP", res.Status)
+	}
+	if _, err := stub.As(teller).Call("invoke", "A", "B", "10"); err != nil {
+		t.Fatal(err)
+	}
+	// query has no requirement
+	checkQuery(t, stub.MockStub, "B", "10")
+
+	if _, err := stub.As(teller).Call("configure", `{"query":{"attributes":{"abac.audit":""}}}`); err == nil {
+		t.Fatal("configure by non admin should fail")
+	}
+	if _, err := stub.As(admin).Call("configure", `{"query":{"attributes":{"abac.audit":""}},"invoke":null}`); err != nil {
+		t.Fatal(err)
+	}
+	if res = stub.As(teller).Invoke("query", "B"); res.Status != 403 {
+		t.Fatal("expecting 403 for the configured query requirement", res.Status)
+	}
+	if _, err := stub.As(outsider).Call("invoke", "A", "B", "10"); err != nil {
+		t.Fatal("removed requirement should no longer apply", err)
+	}
+	stored, err := stub.As(admin).Call("getRequirements")
+	if err != nil || string(stored) != `{"query":{"attributes":{"abac.audit":""}}}` {
+		t.Fatal("unexpected requirements", string(stored), err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"com.jerry/contract/bridge"
+	"com.jerry/contract/token"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// registerBridge names the peer chaincode that funds are bridged to and
+// accepted from, the caller must have the "abac.admin" attribute with a value of true.
+// Args: peer chaincode name
+func (t *SimpleChaincode) registerBridge(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting peer chaincode name")
+	}
+	err := cid.AssertAttributeValue(stub, "abac.admin", "true")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = bridge.Register(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// bridgeOut debits X units from A here and credits them to B on the peer
+// chaincode in the same transaction; owner of A only. Args: from, to, amount
+func (t *SimpleChaincode) bridgeOut(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting from, to and amount")
+	}
+
+	err := token.AssertOwner(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Nothing is debited unless a peer chaincode can take the credit
+	_, err = bridge.Peer(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Only the local side is subject to our compliance checks
+	err = checkDirect(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkActive(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkLimits(stub, args[0], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = token.Debit(stub, args[0], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = bridge.Send(stub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// bridgeIn credits X units to B, only callable by the registered peer
+// chaincode from its bridgeOut. Args: from, to, amount
+func (t *SimpleChaincode) bridgeIn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting from, to and amount")
+	}
+
+	err := bridge.VerifyCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkActive(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = token.Credit(stub, args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"com.jerry/contract/keytime"
+	"com.jerry/contract/token"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	accountObjectType = "Account"
+	limitObjectType   = "TransferLimit"
+	volumeObjectType  = "DailyVolume"
+	auditObjectType   = "AccountAudit"
+
+	// complianceAttr allows managing account status and transfer limits
+	complianceAttr = "abac.compliance"
+
+	// UTC day used to bucket the daily transfer volume
+	volumeDayFormat = "20060102"
+)
+
+// AccountStatus is the compliance record of an account. Accounts without a
+// record are treated as KYC level 0 and not frozen.
+type AccountStatus struct {
+	ObjectType string    `json:"objectType"`
+	Account    string    `json:"account"`
+	KYCLevel   int       `json:"kycLevel"`
+	Frozen     bool      `json:"frozen"`
+	Reason     string    `json:"reason"`
+	UpdatedBy  string    `json:"updatedBy"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// TransferLimit caps what an account of a KYC level may send, in token
+// units. An empty limit is unlimited; levels without limits are unrestricted.
+type TransferLimit struct {
+	ObjectType string `json:"objectType"`
+	KYCLevel   int    `json:"kycLevel"`
+	Single     string `json:"single"`
+	Daily      string `json:"daily"`
+}
+
+// AuditEntry records one status change of an account
+type AuditEntry struct {
+	TxId     string         `json:"txId"`
+	Operator string         `json:"operator"`
+	Previous *AccountStatus `json:"previous"`
+	Current  *AccountStatus `json:"current"`
+}
+
+// setKYC sets the KYC level of an account. Args: account, level, reason
+func (t *SimpleChaincode) setKYC(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting account, level and reason")
+	}
+	level, err := strconv.Atoi(args[1])
+	if err != nil || level < 0 {
+		return shim.Error("Expecting non-negative integer value for level")
+	}
+	return updateAccountStatus(stub, args[0], args[2], func(s *AccountStatus) {
+		s.KYCLevel = level
+	})
+}
+
+// freeze stops an account from sending or receiving tokens, or lifts the
+// freeze for "unfreeze". Args: account, reason
+func (t *SimpleChaincode) freeze(stub shim.ChaincodeStubInterface, function string, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting account and reason")
+	}
+	return updateAccountStatus(stub, args[0], args[1], func(s *AccountStatus) {
+		s.Frozen = function == "freeze"
+	})
+}
+
+// setTransferLimit sets the limits of a KYC level.
+// Args: level, single limit, daily limit; empty limits are unlimited
+func (t *SimpleChaincode) setTransferLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting level, single and daily limit")
+	}
+	err := cid.AssertAttributeValue(stub, complianceAttr, "true")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	level, err := strconv.Atoi(args[0])
+	if err != nil || level < 0 {
+		return shim.Error("Expecting non-negative integer value for level")
+	}
+	limit := &TransferLimit{ObjectType: limitObjectType, KYCLevel: level, Single: args[1], Daily: args[2]}
+	for _, l := range []string{limit.Single, limit.Daily} {
+		if l == "" {
+			continue
+		}
+		if _, err = parseUnits(stub, l); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	key, err := stub.CreateCompositeKey(limitObjectType, []string{strconv.Itoa(level)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	limitBytes, _ := json.Marshal(limit)
+	err = stub.PutState(key, limitBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(limitBytes)
+}
+
+// getAccountStatus returns the compliance record of an account. Args: account
+func (t *SimpleChaincode) getAccountStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting account")
+	}
+	s, err := getAccountStatus(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	statusBytes, _ := json.Marshal(s)
+	return shim.Success(statusBytes)
+}
+
+// getAccountAudit returns the status changes of an account, oldest first,
+// compliance officers only. Args: account
+func (t *SimpleChaincode) getAccountAudit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting account")
+	}
+	err := cid.AssertAttributeValue(stub, complianceAttr, "true")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	iter, err := stub.GetStateByPartialCompositeKey(auditObjectType, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer iter.Close()
+
+	entries := []*AuditEntry{}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var entry AuditEntry
+		if err = json.Unmarshal(res.Value, &entry); err != nil {
+			return shim.Error("Failed to unmarshal audit entry " + res.Key)
+		}
+		entries = append(entries, &entry)
+	}
+	entriesBytes, _ := json.Marshal(entries)
+	return shim.Success(entriesBytes)
+}
+
+// updateAccountStatus applies change to the record of account and audits it,
+// compliance officers only
+func updateAccountStatus(stub shim.ChaincodeStubInterface, account, reason string, change func(*AccountStatus)) pb.Response {
+	err := cid.AssertAttributeValue(stub, complianceAttr, "true")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if account == "" {
+		return shim.Error("Account must not be empty")
+	}
+	if reason == "" {
+		return shim.Error("A reason is required for status changes")
+	}
+	operator, err := operatorOf(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	previous, err := getAccountStatus(stub, account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	current := *previous
+	change(&current)
+	current.Reason = reason
+	current.UpdatedBy = operator
+	current.UpdatedAt = now
+
+	key, err := stub.CreateCompositeKey(accountObjectType, []string{account})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	statusBytes, _ := json.Marshal(&current)
+	if err = stub.PutState(key, statusBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Audit entries sort by time within an account
+	auditKey, err := stub.CreateCompositeKey(auditObjectType, []string{account, keytime.Format(now), stub.GetTxID()})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	auditBytes, _ := json.Marshal(&AuditEntry{TxId: stub.GetTxID(), Operator: operator, Previous: previous, Current: &current})
+	if err = stub.PutState(auditKey, auditBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(statusBytes)
+}
+
+func getAccountStatus(stub shim.ChaincodeStubInterface, account string) (*AccountStatus, error) {
+	key, err := stub.CreateCompositeKey(accountObjectType, []string{account})
+	if err != nil {
+		return nil, err
+	}
+	statusBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get status of %s", account)
+	}
+	s := &AccountStatus{ObjectType: accountObjectType, Account: account}
+	if statusBytes == nil {
+		return s, nil
+	}
+	if err = json.Unmarshal(statusBytes, s); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal status of %s", account)
+	}
+	return s, nil
+}
+
+// checkActive fails if any of the accounts is frozen
+func checkActive(stub shim.ChaincodeStubInterface, accounts ...string) error {
+	for _, account := range accounts {
+		s, err := getAccountStatus(stub, account)
+		if err != nil {
+			return err
+		}
+		if s.Frozen {
+			return fmt.Errorf("Account %s is frozen", account)
+		}
+	}
+	return nil
+}
+
+// checkTransfer fails if either side is frozen or amount exceeds the
+// sender's limits
+func checkTransfer(stub shim.ChaincodeStubInterface, from, to, amount string) error {
+	if err := checkActive(stub, from, to); err != nil {
+		return err
+	}
+	return checkLimits(stub, from, amount)
+}
+
+// checkLimits fails if amount exceeds the limits of the sender's KYC level,
+// and counts amount towards the sender's daily volume
+func checkLimits(stub shim.ChaincodeStubInterface, from, amount string) error {
+	s, err := getAccountStatus(stub, from)
+	if err != nil {
+		return err
+	}
+	key, err := stub.CreateCompositeKey(limitObjectType, []string{strconv.Itoa(s.KYCLevel)})
+	if err != nil {
+		return err
+	}
+	limitBytes, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to get transfer limit")
+	}
+	if limitBytes == nil {
+		return nil
+	}
+	var limit TransferLimit
+	if err = json.Unmarshal(limitBytes, &limit); err != nil {
+		return fmt.Errorf("Failed to unmarshal transfer limit")
+	}
+
+	v, err := parseUnits(stub, amount)
+	if err != nil {
+		return err
+	}
+	if limit.Single != "" {
+		single, err := parseUnits(stub, limit.Single)
+		if err != nil {
+			return err
+		}
+		if v.Cmp(single) > 0 {
+			return fmt.Errorf("Amount %s exceeds the single transfer limit %s of KYC level %d", amount, limit.Single, s.KYCLevel)
+		}
+	}
+	if limit.Daily == "" {
+		return nil
+	}
+	daily, err := parseUnits(stub, limit.Daily)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	volumeKey, err := stub.CreateCompositeKey(volumeObjectType, []string{from, now.UTC().Format(volumeDayFormat)})
+	if err != nil {
+		return err
+	}
+	volumeBytes, err := stub.GetState(volumeKey)
+	if err != nil {
+		return fmt.Errorf("Failed to get daily volume of %s", from)
+	}
+	volume := new(big.Int)
+	if volumeBytes != nil {
+		if _, ok := volume.SetString(string(volumeBytes), 10); !ok {
+			return fmt.Errorf("Corrupted daily volume of %s", from)
+		}
+	}
+	volume.Add(volume, v)
+	if volume.Cmp(daily) > 0 {
+		return fmt.Errorf("Amount %s exceeds the remaining daily limit of %s", amount, from)
+	}
+	return stub.PutState(volumeKey, []byte(volume.String()))
+}
+
+// refundVolume takes amount off the daily volume that checkLimits counted
+// for from on the day of at, when that transfer did not go through
+func refundVolume(stub shim.ChaincodeStubInterface, from, amount string, at time.Time) error {
+	volumeKey, err := stub.CreateCompositeKey(volumeObjectType, []string{from, at.UTC().Format(volumeDayFormat)})
+	if err != nil {
+		return err
+	}
+	volumeBytes, err := stub.GetState(volumeKey)
+	if err != nil {
+		return fmt.Errorf("Failed to get daily volume of %s", from)
+	}
+	if volumeBytes == nil {
+		// no daily limit applied, nothing was counted
+		return nil
+	}
+	volume, ok := new(big.Int).SetString(string(volumeBytes), 10)
+	if !ok {
+		return fmt.Errorf("Corrupted daily volume of %s", from)
+	}
+	v, err := parseUnits(stub, amount)
+	if err != nil {
+		return err
+	}
+	volume.Sub(volume, v)
+	if volume.Sign() < 0 {
+		volume.SetInt64(0)
+	}
+	return stub.PutState(volumeKey, []byte(volume.String()))
+}
+
+func parseUnits(stub shim.ChaincodeStubInterface, amount string) (*big.Int, error) {
+	decimals, err := token.Decimals(stub)
+	if err != nil {
+		return nil, err
+	}
+	return token.ParseAmount(amount, decimals)
+}
+
+// operatorOf names the caller as mspId/id
+func operatorOf(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "/" + id, nil
+}
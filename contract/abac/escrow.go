@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"com.jerry/contract/token"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	escrowObjectType       = "Escrow"
+	escrowPolicyObjectType = "EscrowPolicy"
+
+	// approverAttr holds the officer ID an approver signs off with
+	approverAttr = "abac.approver"
+
+	escrowPending  = "pending"
+	escrowExecuted = "executed"
+	escrowRefunded = "refunded"
+)
+
+// Escrow is a transfer that waits for Threshold of the Approvers named by the
+// escrow policy when it was proposed.
+// Funds are held from proposal until the transfer executes or, once the
+// Deadline has passed, is refunded to From.
+type Escrow struct {
+	ObjectType string    `json:"objectType"`
+	Id         string    `json:"id"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Amount     string    `json:"amount"`
+	Approvers  []string  `json:"approvers"`
+	Threshold  int       `json:"threshold"`
+	Approvals  []string  `json:"approvals"`
+	Deadline   time.Time `json:"deadline"`
+	ProposedAt time.Time `json:"proposedAt"`
+	Status     string    `json:"status"`
+}
+
+// EscrowPolicy names the approvers of every escrow and how many of them
+// must sign off. Transfers of more than Above units must be escrowed. It is
+// managed by the compliance officers.
+type EscrowPolicy struct {
+	ObjectType string   `json:"objectType"`
+	Approvers  []string `json:"approvers"`
+	Threshold  int      `json:"threshold"`
+	Above      string   `json:"above"`
+}
+
+// errNoEscrowPolicy is returned until setEscrowPolicy has been called
+var errNoEscrowPolicy = errors.New("No escrow policy has been set")
+
+// setEscrowPolicy sets the approvers of new escrows and the amount above
+// which transfers must be escrowed, compliance only.
+// Args: approvers (JSON array of officer IDs), threshold, above
+func (t *SimpleChaincode) setEscrowPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting approvers, threshold and above")
+	}
+	err := cid.AssertAttributeValue(stub, complianceAttr, "true")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	p := &EscrowPolicy{ObjectType: escrowPolicyObjectType}
+	err = json.Unmarshal([]byte(args[0]), &p.Approvers)
+	if err != nil || len(p.Approvers) == 0 {
+		return shim.Error("Expecting a JSON array of approvers")
+	}
+	seen := map[string]bool{}
+	for _, approver := range p.Approvers {
+		if approver == "" || seen[approver] {
+			return shim.Error("Approvers must be distinct and non-empty")
+		}
+		seen[approver] = true
+	}
+	p.Threshold, err = strconv.Atoi(args[1])
+	if err != nil || p.Threshold < 1 || p.Threshold > len(p.Approvers) {
+		return shim.Error("Threshold must be between 1 and the number of approvers")
+	}
+	_, err = parseUnits(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	p.Above = args[2]
+
+	key, err := stub.CreateCompositeKey(escrowPolicyObjectType, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	policyBytes, _ := json.Marshal(p)
+	err = stub.PutState(key, policyBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(policyBytes)
+}
+
+// proposeTransfer locks X units of the caller's account A for B until
+// enough approvers of the escrow policy sign off.
+// Args: from, to, amount, deadline (RFC 3339)
+func (t *SimpleChaincode) proposeTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting from, to, amount and deadline")
+	}
+
+	caller, err := token.CallerAccount(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != args[0] {
+		return shim.Error("Only the owner of " + args[0] + " can propose a transfer from it")
+	}
+	if args[0] == args[1] {
+		return shim.Error("Sender and receiver must differ")
+	}
+	policy, err := getEscrowPolicy(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	e := &Escrow{
+		ObjectType: escrowObjectType,
+		Id:         stub.GetTxID(),
+		From:       args[0],
+		To:         args[1],
+		Amount:     args[2],
+		Approvers:  policy.Approvers,
+		Threshold:  policy.Threshold,
+		Approvals:  []string{},
+		ProposedAt: now,
+		Status:     escrowPending,
+	}
+	e.Deadline, err = time.Parse(time.RFC3339, args[3])
+	if err != nil {
+		return shim.Error("Expecting RFC 3339 time for deadline")
+	}
+	if !e.Deadline.After(now) {
+		return shim.Error("Deadline must be in the future")
+	}
+
+	// Limits are counted when the funds are locked
+	err = checkTransfer(stub, e.From, e.To, e.Amount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Lock the funds until the escrow is settled
+	err = token.Hold(stub, e.From, escrowHold(e.Id), e.Amount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return putEscrow(stub, e)
+}
+
+// approveTransfer records the caller's approval and executes the transfer
+// once the threshold is reached. Args: escrow id
+func (t *SimpleChaincode) approveTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting escrow id")
+	}
+	e, err := getEscrow(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if e.Status != escrowPending {
+		return shim.Error("Escrow " + e.Id + " is already " + e.Status)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.After(e.Deadline) {
+		return shim.Error("Escrow " + e.Id + " has expired")
+	}
+
+	officer, found, err := cid.GetAttributeValue(stub, approverAttr)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found || !contains(e.Approvers, officer) {
+		return shim.Error("Caller is not an approver of escrow " + e.Id)
+	}
+	if contains(e.Approvals, officer) {
+		return shim.Error(officer + " has already approved escrow " + e.Id)
+	}
+	e.Approvals = append(e.Approvals, officer)
+
+	if len(e.Approvals) >= e.Threshold {
+		err = checkActive(stub, e.From, e.To)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = token.Release(stub, escrowHold(e.Id), e.To, e.Amount)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		e.Status = escrowExecuted
+	}
+
+	return putEscrow(stub, e)
+}
+
+// refundTransfer returns the held funds to the sender after the deadline.
+// Args: escrow id
+func (t *SimpleChaincode) refundTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting escrow id")
+	}
+	e, err := getEscrow(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if e.Status != escrowPending {
+		return shim.Error("Escrow " + e.Id + " is already " + e.Status)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !now.After(e.Deadline) {
+		return shim.Error("Escrow " + e.Id + " can not be refunded before its deadline")
+	}
+
+	err = token.Release(stub, escrowHold(e.Id), e.From, e.Amount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// The refunded amount no longer counts towards the sender's daily limit
+	err = refundVolume(stub, e.From, e.Amount, e.ProposedAt)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	e.Status = escrowRefunded
+
+	return putEscrow(stub, e)
+}
+
+// getTransfer returns an escrow. Args: escrow id
+func (t *SimpleChaincode) getTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting escrow id")
+	}
+	e, err := getEscrow(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	escrowBytes, _ := json.Marshal(e)
+	return shim.Success(escrowBytes)
+}
+
+func getEscrowPolicy(stub shim.ChaincodeStubInterface) (*EscrowPolicy, error) {
+	key, err := stub.CreateCompositeKey(escrowPolicyObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	policyBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get escrow policy")
+	}
+	if policyBytes == nil {
+		return nil, errNoEscrowPolicy
+	}
+	var p EscrowPolicy
+	if err = json.Unmarshal(policyBytes, &p); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal escrow policy")
+	}
+	return &p, nil
+}
+
+// checkDirect fails if amount is above what the escrow policy lets through
+// without approvals; such transfers go through proposeTransfer
+func checkDirect(stub shim.ChaincodeStubInterface, amount string) error {
+	p, err := getEscrowPolicy(stub)
+	if err == errNoEscrowPolicy {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	above, err := parseUnits(stub, p.Above)
+	if err != nil {
+		return err
+	}
+	v, err := parseUnits(stub, amount)
+	if err != nil {
+		return err
+	}
+	if v.Cmp(above) > 0 {
+		return fmt.Errorf("Transfers above %s must be escrowed with proposeTransfer", p.Above)
+	}
+	return nil
+}
+
+func getEscrow(stub shim.ChaincodeStubInterface, id string) (*Escrow, error) {
+	key, err := stub.CreateCompositeKey(escrowObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	escrowBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get state for escrow %s", id)
+	}
+	if escrowBytes == nil {
+		return nil, fmt.Errorf("Escrow %s not found", id)
+	}
+	var e Escrow
+	if err = json.Unmarshal(escrowBytes, &e); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal escrow %s", id)
+	}
+	return &e, nil
+}
+
+func putEscrow(stub shim.ChaincodeStubInterface, e *Escrow) pb.Response {
+	key, err := stub.CreateCompositeKey(escrowObjectType, []string{e.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	escrowBytes, _ := json.Marshal(e)
+	err = stub.PutState(key, escrowBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(escrowBytes)
+}
+
+// escrowHold names the token hold that keeps the funds of an escrow
+func escrowHold(id string) string {
+	return "escrow:" + id
+}
+
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return ptypes.Timestamp(ts)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package policy
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+)
+
+var conditionPattern = regexp.MustCompile(`^\s*("[^"]*"|[A-Za-z0-9_.\[\]+-]+)\s*(==|!=|<=|>=|<|>)\s*("[^"]*"|[A-Za-z0-9_.\[\]+-]+)\s*$`)
+
+var argPattern = regexp.MustCompile(`^arg\[(\d+)\]$`)
+
+type operandKind int
+
+const (
+	literal operandKind = iota
+	argument
+	attribute
+	mspID
+)
+
+type operand struct {
+	kind  operandKind
+	value string // literal value or attribute name
+	index int    // argument index
+}
+
+type condition struct {
+	text        string
+	left, right operand
+	op          string
+}
+
+func parseCondition(text string, names []string) (*condition, error) {
+	m := conditionPattern.FindStringSubmatch(text)
+	if m == nil {
+		return nil, fmt.Errorf("invalid condition %q", text)
+	}
+	left, err := parseOperand(m[1], names)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %s", text, err)
+	}
+	right, err := parseOperand(m[3], names)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %s", text, err)
+	}
+	return &condition{text: text, left: left, right: right, op: m[2]}, nil
+}
+
+func parseOperand(token string, names []string) (operand, error) {
+	if strings.HasPrefix(token, `"`) {
+		return operand{kind: literal, value: strings.Trim(token, `"`)}, nil
+	}
+	if _, ok := new(big.Rat).SetString(token); ok {
+		return operand{kind: literal, value: token}, nil
+	}
+	if token == "mspid" {
+		return operand{kind: mspID}, nil
+	}
+	if strings.HasPrefix(token, "attr.") && len(token) > len("attr.") {
+		return operand{kind: attribute, value: strings.TrimPrefix(token, "attr.")}, nil
+	}
+	if m := argPattern.FindStringSubmatch(token); m != nil {
+		index, _ := strconv.Atoi(m[1])
+		return operand{kind: argument, index: index}, nil
+	}
+	for i, name := range names {
+		if name == token {
+			return operand{kind: argument, index: i}, nil
+		}
+	}
+	return operand{}, fmt.Errorf("unknown operand %s", token)
+}
+
+// caller caches the parts of the client identity that rules refer to
+type caller struct {
+	id    cid.ClientIdentity
+	mspID string
+	ous   map[string]bool
+}
+
+func newCaller(id cid.ClientIdentity) (*caller, error) {
+	mspID, err := id.GetMSPID()
+	if err != nil {
+		return nil, err
+	}
+	c := &caller{id: id, mspID: mspID, ous: map[string]bool{}}
+	cert, err := id.GetX509Certificate()
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		for _, ou := range cert.Subject.OrganizationalUnit {
+			c.ous[ou] = true
+		}
+	}
+	return c, nil
+}
+
+// match returns an empty string if the rule matches, otherwise the reason it
+// did not.
+func (c *caller) match(rule *Rule, names, args []string) (string, error) {
+	if len(rule.MSPIDs) > 0 && !contains(rule.MSPIDs, c.mspID) {
+		return fmt.Sprintf("mspId %s not allowed", c.mspID), nil
+	}
+	if len(rule.OUs) > 0 {
+		found := false
+		for _, ou := range rule.OUs {
+			found = found || c.ous[ou]
+		}
+		if !found {
+			return fmt.Sprintf("none of the OUs %v", rule.OUs), nil
+		}
+	}
+	for name, want := range rule.Attributes {
+		value, ok, err := c.id.GetAttributeValue(name)
+		if err != nil {
+			return "", err
+		}
+		if !ok || value != want {
+			return fmt.Sprintf("attribute %s is not %s", name, want), nil
+		}
+	}
+	for _, text := range rule.Conditions {
+		cond, err := parseCondition(text, names)
+		if err != nil {
+			return "", err
+		}
+		ok, err := c.holds(cond, args)
+		if err != nil {
+			return err.Error(), nil
+		}
+		if !ok {
+			return fmt.Sprintf("condition %q does not hold", text), nil
+		}
+	}
+	return "", nil
+}
+
+func (c *caller) resolve(o operand, args []string) (string, error) {
+	switch o.kind {
+	case argument:
+		if o.index >= len(args) {
+			return "", fmt.Errorf("argument %d is missing", o.index)
+		}
+		return args[o.index], nil
+	case attribute:
+		value, ok, err := c.id.GetAttributeValue(o.value)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("attribute %s is missing", o.value)
+		}
+		return value, nil
+	case mspID:
+		return c.mspID, nil
+	}
+	return o.value, nil
+}
+
+// holds compares numerically when both sides are numbers, otherwise only
+// equality operators are allowed.
+func (c *caller) holds(cond *condition, args []string) (bool, error) {
+	left, err := c.resolve(cond.left, args)
+	if err != nil {
+		return false, err
+	}
+	right, err := c.resolve(cond.right, args)
+	if err != nil {
+		return false, err
+	}
+
+	l, lok := new(big.Rat).SetString(left)
+	r, rok := new(big.Rat).SetString(right)
+	if lok && rok {
+		cmp := l.Cmp(r)
+		switch cond.op {
+		case "==":
+			return cmp == 0, nil
+		case "!=":
+			return cmp != 0, nil
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		case ">=":
+			return cmp >= 0, nil
+		}
+	}
+	switch cond.op {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	}
+	return false, fmt.Errorf("condition %q compares non numeric values", cond.text)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+// Package policy evaluates access control policies that are stored on the
+// ledger as JSON. A policy maps a chaincode function to a list of rules over
+// the caller's MSP ID, organizational units, certificate attributes and the
+// function arguments.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+)
+
+// objectType is the composite key namespace under which policies are stored
+const objectType = "Policy"
+
+// Policy controls who may call Function. The caller is allowed when any of
+// the rules matches. Args optionally names the positional arguments so that
+// conditions can refer to them, e.g. ["from", "to", "amount"].
+type Policy struct {
+	Function string   `json:"function"`
+	Args     []string `json:"args,omitempty"`
+	Rules    []*Rule  `json:"rules"`
+}
+
+// Rule matches when every populated field is satisfied:
+// the caller's MSP ID is one of MSPIDs, the certificate carries at least one
+// of OUs, every attribute in Attributes has the given value and every
+// condition holds. Conditions have the form "<operand> <op> <operand>" where
+// op is one of == != < <= > >= and an operand is a named argument, arg[N],
+// attr.NAME, mspid, a number or a double quoted string, e.g.
+// "amount <= attr.limit".
+type Rule struct {
+	MSPIDs     []string          `json:"mspIds,omitempty"`
+	OUs        []string          `json:"ous,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Conditions []string          `json:"conditions,omitempty"`
+}
+
+// Validate checks that the policy is well formed and that all of its
+// conditions parse.
+func (p *Policy) Validate() error {
+	if p.Function == "" {
+		return fmt.Errorf("policy function is required")
+	}
+	if len(p.Rules) == 0 {
+		return fmt.Errorf("policy for %s must have at least one rule", p.Function)
+	}
+	for i, rule := range p.Rules {
+		if rule == nil {
+			return fmt.Errorf("policy for %s has an empty rule %d", p.Function, i)
+		}
+		for _, c := range rule.Conditions {
+			if _, err := parseCondition(c, p.Args); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check returns nil if the identity may call the function with args.
+func (p *Policy) Check(id cid.ClientIdentity, args []string) error {
+	caller, err := newCaller(id)
+	if err != nil {
+		return err
+	}
+	var reasons []string
+	for _, rule := range p.Rules {
+		reason, err := caller.match(rule, p.Args, args)
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			return nil
+		}
+		reasons = append(reasons, reason)
+	}
+	return fmt.Errorf("access denied to %s: %v", p.Function, reasons)
+}
+
+// Key returns the ledger key of the policy for function.
+func Key(stub shim.ChaincodeStubInterface, function string) (string, error) {
+	return stub.CreateCompositeKey(objectType, []string{function})
+}
+
+// Get loads the policy for function. It returns nil if none is stored.
+func Get(stub shim.ChaincodeStubInterface, function string) (*Policy, error) {
+	key, err := Key(stub, function)
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get policy for %s: %s", function, err)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	var p Policy
+	if err = json.Unmarshal(value, &p); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal policy for %s: %s", function, err)
+	}
+	return &p, nil
+}
+
+// Put validates and stores the policy.
+func Put(stub shim.ChaincodeStubInterface, p *Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	key, err := Key(stub, p.Function)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, value)
+}
+
+// Evaluate checks the caller of the current transaction against the stored
+// policy for function. Functions without a policy are allowed.
+func Evaluate(stub shim.ChaincodeStubInterface, function string, args []string) error {
+	p, err := Get(stub, function)
+	if err != nil || p == nil {
+		return err
+	}
+	id, err := cid.New(stub)
+	if err != nil {
+		return err
+	}
+	return p.Check(id, args)
+}
@@ -0,0 +1,130 @@
+package policy
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"testing"
+)
+
+type fakeIdentity struct {
+	mspID string
+	ous   []string
+	attrs map[string]string
+}
+
+func (f *fakeIdentity) GetID() (string, error)    { return "fake", nil }
+func (f *fakeIdentity) GetMSPID() (string, error) { return f.mspID, nil }
+
+func (f *fakeIdentity) GetAttributeValue(name string) (string, bool, error) {
+	value, ok := f.attrs[name]
+	return value, ok, nil
+}
+
+func (f *fakeIdentity) AssertAttributeValue(name, value string) error {
+	if v, ok := f.attrs[name]; !ok || v != value {
+		return fmt.Errorf("attribute %s is not %s", name, value)
+	}
+	return nil
+}
+
+func (f *fakeIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return &x509.Certificate{Subject: pkix.Name{OrganizationalUnit: f.ous}}, nil
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		policy *Policy
+		valid  bool
+	}{
+		{&Policy{Function: "invoke", Rules: []*Rule{{MSPIDs: []string{"Org1MSP"}}}}, true},
+		{&Policy{Function: "invoke", Args: []string{"from", "to", "amount"}, Rules: []*Rule{{Conditions: []string{"amount <= attr.limit"}}}}, true},
+		{&Policy{Function: "invoke", Rules: []*Rule{{Conditions: []string{`arg[0] != "A"`, "mspid == \"Org1MSP\""}}}}, true},
+		{&Policy{Function: "invoke", Rules: []*Rule{{Conditions: []string{"amount <= attr.limit"}}}}, false},
+		{&Policy{Function: "invoke", Rules: []*Rule{{Conditions: []string{"arg[0] =~ 1"}}}}, false},
+		{&Policy{Function: "invoke"}, false},
+		{&Policy{Rules: []*Rule{{}}}, false},
+	}
+	for i, test := range tests {
+		if err := test.policy.Validate(); (err == nil) != test.valid {
+			t.Errorf("policy %d: expected valid=%v, got %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestPolicy_Check(t *testing.T) {
+	p := &Policy{
+		Function: "invoke",
+		Args:     []string{"from", "to", "amount"},
+		Rules: []*Rule{
+			{
+				MSPIDs:     []string{"Org1MSP"},
+				OUs:        []string{"client"},
+				Attributes: map[string]string{"abac.role": "teller"},
+				Conditions: []string{"amount <= attr.abac.limit", "amount > 0"},
+			},
+			{
+				MSPIDs:     []string{"Org2MSP"},
+				Conditions: []string{`from == "B"`},
+			},
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	teller := &fakeIdentity{mspID: "Org1MSP", ous: []string{"client"}, attrs: map[string]string{"abac.role": "teller", "abac.limit": "100.5"}}
+	tests := []struct {
+		name    string
+		id      *fakeIdentity
+		args    []string
+		allowed bool
+	}{
+		{"within limit", teller, []string{"A", "B", "100.5"}, true},
+		{"over limit", teller, []string{"A", "B", "101"}, false},
+		{"non positive", teller, []string{"A", "B", "0"}, false},
+		{"non numeric amount", teller, []string{"A", "B", "ten"}, false},
+		{"missing argument", teller, []string{"A", "B"}, false},
+		{"wrong OU", &fakeIdentity{mspID: "Org1MSP", ous: []string{"peer"}, attrs: teller.attrs}, []string{"A", "B", "1"}, false},
+		{"missing limit", &fakeIdentity{mspID: "Org1MSP", ous: []string{"client"}, attrs: map[string]string{"abac.role": "teller"}}, []string{"A", "B", "1"}, false},
+		{"second rule", &fakeIdentity{mspID: "Org2MSP"}, []string{"B", "A", "1000"}, true},
+		{"second rule wrong sender", &fakeIdentity{mspID: "Org2MSP"}, []string{"A", "B", "1"}, false},
+		{"unknown msp", &fakeIdentity{mspID: "Org3MSP", ous: []string{"client"}, attrs: teller.attrs}, []string{"A", "B", "1"}, false},
+	}
+	for _, test := range tests {
+		if err := p.Check(test.id, test.args); (err == nil) != test.allowed {
+			t.Errorf("%s: expected allowed=%v, got %v", test.name, test.allowed, err)
+		}
+	}
+}
+
+func TestRequirement_Check(t *testing.T) {
+	req := &Requirement{
+		Attributes: map[string]string{"abac.role": "teller", "abac.branch": ""},
+		MSPIDs:     []string{"Org1MSP"},
+	}
+	tests := []struct {
+		id      *fakeIdentity
+		missing []string
+		mspID   string
+	}{
+		{&fakeIdentity{mspID: "Org1MSP", attrs: map[string]string{"abac.role": "teller", "abac.branch": "north"}}, nil, ""},
+		{&fakeIdentity{mspID: "Org1MSP", attrs: map[string]string{"abac.role": "auditor"}}, []string{"abac.branch", "abac.role=teller"}, ""},
+		{&fakeIdentity{mspID: "Org2MSP", attrs: map[string]string{"abac.role": "teller", "abac.branch": "north"}}, nil, "Org2MSP"},
+	}
+	for i, test := range tests {
+		f, err := req.Check(test.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.missing == nil && test.mspID == "" {
+			if f != nil {
+				t.Errorf("identity %d should be allowed: %v", i, f)
+			}
+			continue
+		}
+		if f == nil || f.Status != 403 || f.MSPID != test.mspID || fmt.Sprint(f.Missing) != fmt.Sprint(test.missing) {
+			t.Errorf("identity %d: unexpected %v", i, f)
+		}
+	}
+}
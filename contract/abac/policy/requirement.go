@@ -0,0 +1,189 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// requirementType is the composite key namespace of function requirements
+const requirementType = "Requirement"
+
+// Requirement lists what a caller needs to call a function: every attribute
+// in Attributes, with the given value or any value if it is empty, and, if
+// MSPIDs is not empty, membership of one of them. Requirements are a plain
+// allow list configured at Init; policies add conditions on top of them.
+type Requirement struct {
+	Attributes map[string]string `json:"attributes,omitempty"`
+	MSPIDs     []string          `json:"mspIds,omitempty"`
+}
+
+// Requirements maps function names to their requirement. A nil requirement
+// removes the stored one when passed to PutRequirements.
+type Requirements map[string]*Requirement
+
+// Forbidden is the structured error returned when a requirement is not met.
+type Forbidden struct {
+	Status   int32    `json:"status"`
+	Message  string   `json:"error"`
+	Function string   `json:"function"`
+	Missing  []string `json:"missing,omitempty"`
+	MSPID    string   `json:"mspId,omitempty"`
+	MSPIDs   []string `json:"allowedMspIds,omitempty"`
+}
+
+func (f *Forbidden) Error() string {
+	message, _ := json.Marshal(f)
+	return string(message)
+}
+
+// Response renders the error as a 403 chaincode response whose message is
+// the JSON encoded Forbidden.
+func (f *Forbidden) Response() pb.Response {
+	message, _ := json.Marshal(f)
+	return pb.Response{Status: f.Status, Message: string(message)}
+}
+
+// ParseRequirements decodes a JSON object of function name to requirement.
+func ParseRequirements(s string) (Requirements, error) {
+	var reqs Requirements
+	if err := json.Unmarshal([]byte(s), &reqs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal requirements: %s", err)
+	}
+	for function, req := range reqs {
+		if function == "" {
+			return nil, fmt.Errorf("requirement function is required")
+		}
+		if req == nil {
+			continue
+		}
+		for name := range req.Attributes {
+			if name == "" {
+				return nil, fmt.Errorf("requirement for %s has an empty attribute name", function)
+			}
+		}
+	}
+	return reqs, nil
+}
+
+// PutRequirements stores or, for nil entries, removes the requirements.
+func PutRequirements(stub shim.ChaincodeStubInterface, reqs Requirements) error {
+	for function, req := range reqs {
+		key, err := stub.CreateCompositeKey(requirementType, []string{function})
+		if err != nil {
+			return err
+		}
+		if req == nil {
+			if err = stub.DelState(key); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		if err = stub.PutState(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRequirements returns all stored requirements.
+func GetRequirements(stub shim.ChaincodeStubInterface) (Requirements, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(requirementType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	reqs := Requirements{}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attrs, err := stub.SplitCompositeKey(res.Key)
+		if err != nil || len(attrs) != 1 {
+			continue
+		}
+		var req Requirement
+		if err = json.Unmarshal(res.Value, &req); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal requirement for %s: %s", attrs[0], err)
+		}
+		reqs[attrs[0]] = &req
+	}
+	return reqs, nil
+}
+
+// Require checks the caller of the current transaction against the stored
+// requirement for function. It returns a *Forbidden if the caller lacks
+// anything; functions without a requirement are allowed.
+func Require(stub shim.ChaincodeStubInterface, function string) error {
+	key, err := stub.CreateCompositeKey(requirementType, []string{function})
+	if err != nil {
+		return err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to get requirement for %s: %s", function, err)
+	}
+	if value == nil {
+		return nil
+	}
+	var req Requirement
+	if err = json.Unmarshal(value, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal requirement for %s: %s", function, err)
+	}
+	id, err := cid.New(stub)
+	if err != nil {
+		return err
+	}
+	f, err := req.Check(id)
+	if f != nil {
+		f.Function = function
+		return f
+	}
+	return err
+}
+
+// Check returns a *Forbidden listing what the identity lacks, or nil.
+func (r *Requirement) Check(id cid.ClientIdentity) (*Forbidden, error) {
+	mspID, err := id.GetMSPID()
+	if err != nil {
+		return nil, err
+	}
+	f := &Forbidden{Status: http.StatusForbidden, Message: http.StatusText(http.StatusForbidden)}
+	if len(r.MSPIDs) > 0 && !contains(r.MSPIDs, mspID) {
+		f.MSPID, f.MSPIDs = mspID, r.MSPIDs
+	}
+
+	names := make([]string, 0, len(r.Attributes))
+	for name := range r.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, found, err := id.GetAttributeValue(name)
+		if err != nil {
+			return nil, err
+		}
+		if want := r.Attributes[name]; !found || (want != "" && value != want) {
+			if want != "" {
+				name += "=" + want
+			}
+			f.Missing = append(f.Missing, name)
+		}
+	}
+
+	if f.MSPID == "" && len(f.Missing) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
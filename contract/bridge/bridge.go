@@ -0,0 +1,119 @@
+// Package bridge moves value between two chaincodes on the same channel in
+// one transaction. The sending chaincode debits its ledger and invokes the
+// receiving chaincode with stub.InvokeChaincode, which credits its own; both
+// write sets commit or fail together. Each side registers the name of its
+// peer chaincode and only accepts inbound calls whose transaction proposal
+// was sent to that chaincode.
+package bridge
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/common"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	peerKey = "Bridge"
+
+	// InFunction is the function a peer chaincode invokes to credit funds
+	InFunction = "bridgeIn"
+)
+
+// ErrNotRegistered is returned when no peer chaincode has been registered
+var ErrNotRegistered = errors.New("No bridge peer chaincode registered")
+
+// Register records the name of the peer chaincode, replacing any previous one.
+func Register(stub shim.ChaincodeStubInterface, peer string) error {
+	if peer == "" {
+		return errors.New("Peer chaincode name must not be empty")
+	}
+	key, err := stub.CreateCompositeKey(peerKey, []string{"peer"})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte(peer))
+}
+
+// Peer returns the registered peer chaincode name.
+func Peer(stub shim.ChaincodeStubInterface) (string, error) {
+	key, err := stub.CreateCompositeKey(peerKey, []string{"peer"})
+	if err != nil {
+		return "", err
+	}
+	peer, err := stub.GetState(key)
+	if err != nil {
+		return "", errors.New("Failed to get state")
+	}
+	if peer == nil {
+		return "", ErrNotRegistered
+	}
+	return string(peer), nil
+}
+
+// Send invokes InFunction on the peer chaincode with from, to and amount.
+// A failure of the peer is returned as an error, so that the caller fails
+// the whole transaction and no debit commits without its credit.
+func Send(stub shim.ChaincodeStubInterface, from, to, amount string) error {
+	peer, err := Peer(stub)
+	if err != nil {
+		return err
+	}
+	args := [][]byte{[]byte(InFunction), []byte(from), []byte(to), []byte(amount)}
+	res := stub.InvokeChaincode(peer, args, "")
+	if res.Status != shim.OK {
+		return fmt.Errorf("%s rejected the transfer: %s", peer, res.Message)
+	}
+	return nil
+}
+
+// VerifyCaller fails unless the transaction was proposed to the registered
+// peer chaincode. A chaincode invoked by another one sees the signed
+// proposal of the outer invocation, so a client calling InFunction directly
+// is rejected as well.
+func VerifyCaller(stub shim.ChaincodeStubInterface) error {
+	peer, err := Peer(stub)
+	if err != nil {
+		return err
+	}
+	caller, err := Caller(stub)
+	if err != nil {
+		return err
+	}
+	if caller != peer {
+		return fmt.Errorf("Bridge calls are only accepted from %s, not %q", peer, caller)
+	}
+	return nil
+}
+
+// Caller returns the name of the chaincode the transaction proposal was
+// addressed to.
+func Caller(stub shim.ChaincodeStubInterface) (string, error) {
+	sp, err := stub.GetSignedProposal()
+	if err != nil {
+		return "", err
+	}
+	if sp == nil {
+		return "", errors.New("No signed proposal")
+	}
+	prop := &pb.Proposal{}
+	if err = proto.Unmarshal(sp.ProposalBytes, prop); err != nil {
+		return "", fmt.Errorf("Failed to unmarshal proposal: %s", err)
+	}
+	hdr := &common.Header{}
+	if err = proto.Unmarshal(prop.Header, hdr); err != nil {
+		return "", fmt.Errorf("Failed to unmarshal proposal header: %s", err)
+	}
+	chdr := &common.ChannelHeader{}
+	if err = proto.Unmarshal(hdr.ChannelHeader, chdr); err != nil {
+		return "", fmt.Errorf("Failed to unmarshal channel header: %s", err)
+	}
+	ext := &pb.ChaincodeHeaderExtension{}
+	if err = proto.Unmarshal(chdr.Extension, ext); err != nil {
+		return "", fmt.Errorf("Failed to unmarshal chaincode header extension: %s", err)
+	}
+	return ext.GetChaincodeId().GetName(), nil
+}
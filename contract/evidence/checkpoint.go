@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"com.jerry/contract/keytime"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	CHECKPOINT     = "Checkpoint"
+	DIGEST         = "EvidenceDigest"
+	PENDING_DIGEST = "EvidencePending"
+
+	checkpointSeqKey = "CheckpointSeq" //已生成的检查点数量
+)
+
+/**
+  存证摘要登记时不读取共享计数器，以交易时间和交易ID为键写入待编号区：EvidencePending_时间_txId，
+  并发的set之间不会产生MVCC读写冲突。检查点生成时按键序为待编号摘要分配序号，
+  移入EvidenceDigest_序号并删除待编号键
+*/
+type DigestEntry struct {
+	ObjectType   string    `json:"objectType"`
+	Seq          int64     `json:"seq"` //检查点生成前为0
+	Domain       string    `json:"domain"`
+	Application  string    `json:"application"`
+	EvidenceCode string    `json:"evidenceCode"`
+	Digest       string    `json:"digest"` //sha256(存证json)，hex编码
+	TxId         string    `json:"txId"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+//Merkle检查点，覆盖[From, To]区间内的存证摘要
+type Checkpoint struct {
+	ObjectType string    `json:"objectType"`
+	Index      int64     `json:"index"`
+	From       int64     `json:"from"`
+	To         int64     `json:"to"`
+	Root       string    `json:"root"`
+	TxId       string    `json:"txId"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+//审计路径上的一个节点，Position表示兄弟节点在左侧还是右侧
+type ProofNode struct {
+	Hash     string `json:"hash"`
+	Position string `json:"position"`
+}
+
+//存证包含证明
+type InclusionProof struct {
+	Domain       string       `json:"domain"`
+	Application  string       `json:"application"`
+	EvidenceCode string       `json:"evidenceCode"`
+	Digest       string       `json:"digest"`
+	LeafIndex    int64        `json:"leafIndex"`
+	TreeSize     int64        `json:"treeSize"`
+	Path         []*ProofNode `json:"path"`
+	Checkpoint   *Checkpoint  `json:"checkpoint"`
+
+	Disputes []*DisputeStatus `json:"disputes,omitempty"` //存证的争议状态
+}
+
+//生成检查点：为上一个检查点之后登记的存证摘要编号，构建Merkle树并保存树根，需要管理员身份
+func (v *EvidenceCC) checkpoint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+	if err := assertAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	height, err := getCounter(stub, checkpointSeqKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var from int64 = 1
+	if height > 0 {
+		last, err := getCheckpoint(stub, height)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		from = last.To + 1
+	}
+
+	pendingKeys, entries, err := getPendingDigests(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(entries) == 0 {
+		return shim.Error(fmt.Sprint("No new evidence since the last checkpoint!"))
+	}
+	for i, entry := range entries {
+		if err = assignSeq(stub, pendingKeys[i], entry, from+int64(i)); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	leaves, err := leafHashes(entries)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(fmt.Sprint("Failed to get transaction timestamp!"))
+	}
+	txTime, _ := ptypes.Timestamp(ts)
+
+	cp := &Checkpoint{
+		ObjectType: CHECKPOINT,
+		Index:      height + 1,
+		From:       from,
+		To:         from + int64(len(entries)) - 1,
+		Root:       hex.EncodeToString(merkleRoot(leaves)),
+		TxId:       stub.GetTxID(),
+		Timestamp:  txTime,
+	}
+	cpJson, _ := json.Marshal(cp)
+	err = stub.PutState(checkpointKey(cp.Index), cpJson)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to set checkpoint: %d", cp.Index))
+	}
+	err = stub.PutState(checkpointSeqKey, []byte(strconv.FormatInt(cp.Index, 10)))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("checkpoint：", string(cpJson))
+
+	return shim.Success(cpJson)
+}
+
+//获取某个存证相对于其所在检查点树根的审计路径，参数：领域、应用、存证码
+func (v *EvidenceCC) getInclusionProof(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	domain, application, evidenceCode := args[0], args[1], args[2]
+	if _, err := assertTenantMember(stub, domain, application); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	indexKey, err := tenantKey(stub, DIGEST, domain, application, evidenceCode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	seqByte, err := stub.GetState(indexKey)
+	if err != nil || seqByte == nil {
+		return shim.Error(fmt.Sprintf("There is no digest of that Evidence %s!", evidenceCode))
+	}
+	//尚未编号的摘要，索引中是待编号键
+	seq, err := strconv.ParseInt(string(seqByte), 10, 64)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Evidence %s is not covered by any checkpoint yet!", evidenceCode))
+	}
+
+	height, err := getCounter(stub, checkpointSeqKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var cp *Checkpoint
+	for i := height; i > 0; i-- {
+		c, err := getCheckpoint(stub, i)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if c.From <= seq && seq <= c.To {
+			cp = c
+			break
+		}
+		if c.To < seq {
+			break
+		}
+	}
+	if cp == nil {
+		return shim.Error(fmt.Sprintf("Evidence %s is not covered by any checkpoint yet!", evidenceCode))
+	}
+
+	entries, err := getDigestRange(stub, cp.From, cp.To)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	leaves, err := leafHashes(entries)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	index := seq - cp.From
+	proof := &InclusionProof{
+		Domain:       domain,
+		Application:  application,
+		EvidenceCode: evidenceCode,
+		Digest:       entries[index].Digest,
+		LeafIndex:    index,
+		TreeSize:     int64(len(leaves)),
+		Path:         auditPath(int(index), leaves),
+		Checkpoint:   cp,
+	}
+	proof.Disputes, err = disputeStatuses(stub, domain, application, evidenceCode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	proofJson, _ := json.Marshal(proof)
+	return shim.Success(proofJson)
+}
+
+//登记存证摘要，set时调用，序号在生成检查点时分配
+func recordDigest(stub shim.ChaincodeStubInterface, header *Header, evidenceJson []byte) error {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("Failed to get transaction timestamp!")
+	}
+	txTime, _ := ptypes.Timestamp(ts)
+
+	sum := sha256.Sum256(evidenceJson)
+	entry := &DigestEntry{
+		ObjectType:   DIGEST,
+		Domain:       header.Domain,
+		Application:  header.Application,
+		EvidenceCode: header.EvidenceCode,
+		Digest:       hex.EncodeToString(sum[:]),
+		TxId:         stub.GetTxID(),
+		Timestamp:    txTime,
+	}
+	entryJson, _ := json.Marshal(entry)
+	pendingKey := pendingDigestKey(txTime, entry.TxId)
+	if err = stub.PutState(pendingKey, entryJson); err != nil {
+		return err
+	}
+	indexKey, err := tenantKey(stub, DIGEST, header.Domain, header.Application, header.EvidenceCode)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte(pendingKey))
+}
+
+//按交易时间和交易ID的顺序返回全部待编号摘要及其键
+func getPendingDigests(stub shim.ChaincodeStubInterface) ([]string, []*DigestEntry, error) {
+	//时间只含数字，"~"排在其后
+	iter, err := stub.GetStateByRange(PENDING_DIGEST+"_", PENDING_DIGEST+"_~")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iter.Close()
+
+	var keys []string
+	var entries []*DigestEntry
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		var entry DigestEntry
+		if err = json.Unmarshal(res.Value, &entry); err != nil {
+			return nil, nil, fmt.Errorf("Failed to Unmarshal digest %s", res.Key)
+		}
+		keys = append(keys, res.Key)
+		entries = append(entries, &entry)
+	}
+	return keys, entries, nil
+}
+
+//为待编号摘要分配序号，存证索引仍指向该摘要时一并更新
+func assignSeq(stub shim.ChaincodeStubInterface, pendingKey string, entry *DigestEntry, seq int64) error {
+	entry.Seq = seq
+	entryJson, _ := json.Marshal(entry)
+	if err := stub.PutState(digestKey(seq), entryJson); err != nil {
+		return err
+	}
+	if err := stub.DelState(pendingKey); err != nil {
+		return err
+	}
+	indexKey, err := tenantKey(stub, DIGEST, entry.Domain, entry.Application, entry.EvidenceCode)
+	if err != nil {
+		return err
+	}
+	index, err := stub.GetState(indexKey)
+	if err != nil {
+		return fmt.Errorf("Failed to get state %s", indexKey)
+	}
+	//存证之后又被覆盖时，索引指向更新的摘要
+	if string(index) != pendingKey {
+		return nil
+	}
+	return stub.PutState(indexKey, []byte(strconv.FormatInt(seq, 10)))
+}
+
+func getCounter(stub shim.ChaincodeStubInterface, key string) (int64, error) {
+	value, err := stub.GetState(key)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get state %s", key)
+	}
+	if value == nil {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid counter value %s", key)
+	}
+	return n, nil
+}
+
+func getCheckpoint(stub shim.ChaincodeStubInterface, index int64) (*Checkpoint, error) {
+	value, err := stub.GetState(checkpointKey(index))
+	if err != nil || value == nil {
+		return nil, fmt.Errorf("There is no record of that Checkpoint %d!", index)
+	}
+	var cp Checkpoint
+	if err = json.Unmarshal(value, &cp); err != nil {
+		return nil, fmt.Errorf("Failed to Unmarshal Checkpoint %d", index)
+	}
+	return &cp, nil
+}
+
+func getDigestRange(stub shim.ChaincodeStubInterface, from, to int64) ([]*DigestEntry, error) {
+	iter, err := stub.GetStateByRange(digestKey(from), digestKey(to+1))
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var entries []*DigestEntry
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var entry DigestEntry
+		if err = json.Unmarshal(res.Value, &entry); err != nil {
+			return nil, fmt.Errorf("Failed to Unmarshal digest %s", res.Key)
+		}
+		entries = append(entries, &entry)
+	}
+	if int64(len(entries)) != to-from+1 {
+		return nil, fmt.Errorf("Digest range %d-%d is incomplete", from, to)
+	}
+	return entries, nil
+}
+
+func digestKey(seq int64) string {
+	return fmt.Sprintf("%s_%020d", DIGEST, seq)
+}
+
+func pendingDigestKey(txTime time.Time, txId string) string {
+	return fmt.Sprintf("%s_%s_%s", PENDING_DIGEST, keytime.Format(txTime), txId)
+}
+
+func checkpointKey(index int64) string {
+	return fmt.Sprintf("%s_%020d", CHECKPOINT, index)
+}
+
+/**
+  Merkle树构造参照RFC 6962：叶子 = sha256(0x00 || digest)，内部节点 = sha256(0x01 || left || right)，
+  非满二叉树按不超过n的最大2的幂划分左右子树
+*/
+func leafHashes(entries []*DigestEntry) ([][]byte, error) {
+	leaves := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		digest, err := hex.DecodeString(entry.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid digest of Evidence %s", entry.EvidenceCode)
+		}
+		leaves = append(leaves, hashLeaf(digest))
+	}
+	return leaves, nil
+}
+
+func hashLeaf(digest []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(digest)
+	return h.Sum(nil)
+}
+
+func hashNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return hashNode(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+//审计路径按自底向上的顺序返回
+func auditPath(m int, leaves [][]byte) []*ProofNode {
+	if len(leaves) <= 1 {
+		return []*ProofNode{}
+	}
+	k := splitPoint(len(leaves))
+	if m < k {
+		return append(auditPath(m, leaves[:k]), &ProofNode{
+			Hash:     hex.EncodeToString(merkleRoot(leaves[k:])),
+			Position: "right",
+		})
+	}
+	return append(auditPath(m-k, leaves[k:]), &ProofNode{
+		Hash:     hex.EncodeToString(merkleRoot(leaves[:k])),
+		Position: "left",
+	})
+}
+
+//根据审计路径重新计算树根并与检查点比对
+func verifyInclusion(digest []byte, path []*ProofNode, root []byte) bool {
+	h := hashLeaf(digest)
+	for _, node := range path {
+		sibling, err := hex.DecodeString(node.Hash)
+		if err != nil {
+			return false
+		}
+		if node.Position == "left" {
+			h = hashNode(sibling, h)
+		} else {
+			h = hashNode(h, sibling)
+		}
+	}
+	return bytes.Equal(h, root)
+}
@@ -0,0 +1,334 @@
+// Package client 是EvidenceCC存证链码的Go客户端，负责拼装链码参数并解析返回结果
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+//Client绑定一个租户(领域+应用)，存证相关操作都在该租户下进行
+type Client struct {
+	transport   Transport
+	domain      string
+	application string
+}
+
+func New(transport Transport, domain, application string) *Client {
+	return &Client{transport: transport, domain: domain, application: application}
+}
+
+//返回绑定到另一个租户的Client，共用同一个Transport
+func (c *Client) ForTenant(domain, application string) *Client {
+	return New(c.transport, domain, application)
+}
+
+//存证上链，timestampToken为TSA签发的RFC 3161令牌(base64)，可为空。
+//Header中未填写领域和应用时使用Client绑定的租户
+func (c *Client) Set(evidence *Evidence, timestampToken string) (*Evidence, error) {
+	if evidence == nil || evidence.Header == nil || evidence.Header.EvidenceCode == "" {
+		return nil, errors.New("evidence code is required")
+	}
+	if evidence.Header.Domain == "" && evidence.Header.Application == "" {
+		header := *evidence.Header
+		header.Domain, header.Application = c.domain, c.application
+		copied := *evidence
+		copied.Header = &header
+		evidence = &copied
+	}
+	data, err := json.Marshal(evidence)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{string(data)}
+	if timestampToken != "" {
+		args = append(args, timestampToken)
+	}
+	payload, err := c.transport.Submit("set", args...)
+	if err != nil {
+		return nil, err
+	}
+	var saved Evidence
+	if err = decode(payload, &saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+//get会写操作日志，因此通过Submit提交
+func (c *Client) Get(evidenceCode string) (*Evidence, error) {
+	payload, err := c.transport.Submit("get", c.domain, c.application, evidenceCode)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("evidence %s not found", evidenceCode)
+	}
+	var evidence Evidence
+	if err = decode(payload, &evidence); err != nil {
+		return nil, err
+	}
+	return &evidence, nil
+}
+
+func (c *Client) Grant(grant *Grant) (*Grant, error) {
+	if grant == nil {
+		return nil, errors.New("grant is required")
+	}
+	if grant.Domain == "" && grant.Application == "" {
+		copied := *grant
+		copied.Domain, copied.Application = c.domain, c.application
+		grant = &copied
+	}
+	data, err := json.Marshal(grant)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := c.transport.Submit("grant", string(data))
+	if err != nil {
+		return nil, err
+	}
+	var saved Grant
+	if err = decode(payload, &saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+//查证，signature为SignToken生成的hex签名
+func (c *Client) SearchEvidence(evidenceCode, token, signature string) (*Evidence, error) {
+	payload, err := c.transport.Submit("searchEvidence", c.domain, c.application, evidenceCode, token, signature)
+	if err != nil {
+		return nil, err
+	}
+	var evidence Evidence
+	if err = decode(payload, &evidence); err != nil {
+		return nil, err
+	}
+	return &evidence, nil
+}
+
+func (c *Client) QueryLog(evidenceCode string) ([]*OperateLog, error) {
+	payload, err := c.transport.Evaluate("queryLog", c.domain, c.application, evidenceCode)
+	if err != nil {
+		return nil, err
+	}
+	var logs []*OperateLog
+	if err = decode(payload, &logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+func (c *Client) Checkpoint() (*Checkpoint, error) {
+	payload, err := c.transport.Submit("checkpoint")
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err = decode(payload, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+func (c *Client) GetInclusionProof(evidenceCode string) (*InclusionProof, error) {
+	payload, err := c.transport.Evaluate("getInclusionProof", c.domain, c.application, evidenceCode)
+	if err != nil {
+		return nil, err
+	}
+	var proof InclusionProof
+	if err = decode(payload, &proof); err != nil {
+		return nil, err
+	}
+	return &proof, nil
+}
+
+func (c *Client) RegisterTSA(certPEM string) (*TSACertificate, error) {
+	payload, err := c.transport.Submit("registerTSA", certPEM)
+	if err != nil {
+		return nil, err
+	}
+	var tsa TSACertificate
+	if err = decode(payload, &tsa); err != nil {
+		return nil, err
+	}
+	return &tsa, nil
+}
+
+func (c *Client) RemoveTSA(fingerprint string) error {
+	_, err := c.transport.Submit("removeTSA", fingerprint)
+	return err
+}
+
+//新增或修改租户，需要管理员身份
+func (c *Client) SetTenant(tenant *Tenant) (*Tenant, error) {
+	data, err := json.Marshal(tenant)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := c.transport.Submit("setTenant", string(data))
+	if err != nil {
+		return nil, err
+	}
+	var saved Tenant
+	if err = decode(payload, &saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+//查询Client绑定租户的信息及用量
+func (c *Client) GetTenant() (*TenantUsage, error) {
+	payload, err := c.transport.Evaluate("getTenant", c.domain, c.application)
+	if err != nil {
+		return nil, err
+	}
+	var usage TenantUsage
+	if err = decode(payload, &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+//统计查询，metric为notarized或read，period为空、YYYY-MM或YYYY-MM-DD，需要管理员身份
+func (c *Client) Stats(metric, period string) (*Stats, error) {
+	args := []string{metric}
+	if period != "" {
+		args = append(args, period)
+	}
+	payload, err := c.transport.Evaluate("stats", args...)
+	if err != nil {
+		return nil, err
+	}
+	var stats Stats
+	if err = decode(payload, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+//查询hours小时内到期的授权，需要管理员身份
+func (c *Client) ExpiringGrants(hours int) ([]*ExpiringGrant, error) {
+	payload, err := c.transport.Evaluate("expiringGrants", strconv.Itoa(hours))
+	if err != nil {
+		return nil, err
+	}
+	var grants []*ExpiringGrant
+	if err = decode(payload, &grants); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+//校验下载的分片，index从0开始，hash为分片sha256(hex)
+func (c *Client) VerifyChunk(evidenceCode string, index int, hash string) (bool, error) {
+	payload, err := c.transport.Evaluate("verifyChunk", c.domain, c.application, evidenceCode, strconv.Itoa(index), hash)
+	if err != nil {
+		return false, err
+	}
+	var result ChunkVerification
+	if err = decode(payload, &result); err != nil {
+		return false, err
+	}
+	return result.Valid, nil
+}
+
+//增加存证(objectType为Evidence)或授权(Grant)键的背书组织，需要管理员身份
+func (c *Client) AddEndorsingOrgs(ke *KeyEndorsement) (*KeyEndorsement, error) {
+	return c.endorsingOrgs("addEndorsingOrgs", ke)
+}
+
+//移除键的背书组织，需要管理员身份
+func (c *Client) RemoveEndorsingOrgs(ke *KeyEndorsement) (*KeyEndorsement, error) {
+	return c.endorsingOrgs("removeEndorsingOrgs", ke)
+}
+
+//查询键当前的背书组织
+func (c *Client) GetEndorsingOrgs(ke *KeyEndorsement) (*KeyEndorsement, error) {
+	return c.endorsingOrgs("getEndorsingOrgs", ke)
+}
+
+func (c *Client) endorsingOrgs(fn string, ke *KeyEndorsement) (*KeyEndorsement, error) {
+	if ke == nil {
+		return nil, errors.New("key endorsement is required")
+	}
+	if ke.Domain == "" && ke.Application == "" {
+		copied := *ke
+		copied.Domain, copied.Application = c.domain, c.application
+		ke = &copied
+	}
+	data, err := json.Marshal(ke)
+	if err != nil {
+		return nil, err
+	}
+	var payload []byte
+	if fn == "getEndorsingOrgs" {
+		payload, err = c.transport.Evaluate(fn, string(data))
+	} else {
+		payload, err = c.transport.Submit(fn, string(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved KeyEndorsement
+	if err = decode(payload, &saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+//对存证发起争议，supporting为同一租户下的佐证存证码
+func (c *Client) OpenDispute(evidenceCode, reason string, supporting []string) (*Dispute, error) {
+	args := []string{c.domain, c.application, evidenceCode, reason}
+	if len(supporting) > 0 {
+		data, err := json.Marshal(supporting)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(data))
+	}
+	return c.submitDispute("openDispute", args...)
+}
+
+//存证所属租户答复争议
+func (c *Client) RespondDispute(evidenceCode, disputeId, content string) (*Dispute, error) {
+	return c.submitDispute("respondDispute", c.domain, c.application, evidenceCode, disputeId, content)
+}
+
+//仲裁方裁决争议，decision为upheld或dismissed
+func (c *Client) ResolveDispute(evidenceCode, disputeId, decision, remark string) (*Dispute, error) {
+	return c.submitDispute("resolveDispute", c.domain, c.application, evidenceCode, disputeId, decision, remark)
+}
+
+func (c *Client) GetDisputes(evidenceCode string) ([]*Dispute, error) {
+	payload, err := c.transport.Evaluate("getDisputes", c.domain, c.application, evidenceCode)
+	if err != nil {
+		return nil, err
+	}
+	var disputes []*Dispute
+	if err = decode(payload, &disputes); err != nil {
+		return nil, err
+	}
+	return disputes, nil
+}
+
+func (c *Client) submitDispute(fn string, args ...string) (*Dispute, error) {
+	payload, err := c.transport.Submit(fn, args...)
+	if err != nil {
+		return nil, err
+	}
+	var dispute Dispute
+	if err = decode(payload, &dispute); err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
+func decode(payload []byte, v interface{}) error {
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("failed to decode chaincode response: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+//按chunkSize分片读取文件并生成清单，RootHash与链码的计算方式一致
+func BuildManifest(r io.Reader, fileName, mimeType string, chunkSize int64) (*FileManifest, error) {
+	if chunkSize <= 0 {
+		return nil, errors.New("chunk size must be positive")
+	}
+	manifest := &FileManifest{FileName: fileName, MimeType: mimeType, ChunkSize: chunkSize}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			manifest.Chunks = append(manifest.Chunks, ChunkHash(buf[:n]))
+			manifest.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Size == 0 {
+		return nil, errors.New("file is empty")
+	}
+	root, err := ManifestRoot(manifest.Chunks)
+	if err != nil {
+		return nil, err
+	}
+	manifest.RootHash = root
+	return manifest, nil
+}
+
+//分片sha256，hex编码
+func ChunkHash(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return hex.EncodeToString(sum[:])
+}
+
+//以分片哈希为叶子按RFC 6962规则计算Merkle树根
+func ManifestRoot(chunks []string) (string, error) {
+	if len(chunks) == 0 {
+		return "", errors.New("manifest has no chunks")
+	}
+	leaves := make([][]byte, 0, len(chunks))
+	for _, chunk := range chunks {
+		digest, err := hex.DecodeString(chunk)
+		if err != nil {
+			return "", errors.New("invalid chunk hash")
+		}
+		leaves = append(leaves, hashWithPrefix(0x00, digest))
+	}
+	return hex.EncodeToString(treeHash(leaves)), nil
+}
+
+func treeHash(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := 1
+	for k<<1 < len(leaves) {
+		k <<= 1
+	}
+	return hashWithPrefix(0x01, treeHash(leaves[:k]), treeHash(leaves[k:]))
+}
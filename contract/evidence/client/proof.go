@@ -0,0 +1,49 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+//在客户端按RFC 6962规则重算树根，校验存证是否包含在检查点中
+func VerifyInclusionProof(proof *InclusionProof) error {
+	if proof == nil || proof.Checkpoint == nil {
+		return errors.New("proof has no checkpoint")
+	}
+	digest, err := hex.DecodeString(proof.Digest)
+	if err != nil {
+		return errors.New("invalid digest")
+	}
+	root, err := hex.DecodeString(proof.Checkpoint.Root)
+	if err != nil {
+		return errors.New("invalid checkpoint root")
+	}
+
+	h := hashWithPrefix(0x00, digest)
+	for _, node := range proof.Path {
+		sibling, err := hex.DecodeString(node.Hash)
+		if err != nil {
+			return errors.New("invalid audit path")
+		}
+		if node.Position == "left" {
+			h = hashWithPrefix(0x01, sibling, h)
+		} else {
+			h = hashWithPrefix(0x01, h, sibling)
+		}
+	}
+	if !bytes.Equal(h, root) {
+		return errors.New("inclusion proof does not match checkpoint root")
+	}
+	return nil
+}
+
+func hashWithPrefix(prefix byte, parts ...[]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{prefix})
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
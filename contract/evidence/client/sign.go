@@ -0,0 +1,51 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+)
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+/**
+  对查证令牌签名，返回searchEvidence所需的hex编码签名：
+  ECDSA为sha256(token)的ASN.1签名，RSA为sha256(token)的PSS签名
+*/
+func SignToken(key crypto.Signer, token string) (string, error) {
+	digest := sha256.Sum256([]byte(token))
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		sig, err := asn1.Marshal(ecdsaSignature{R: r, S: s})
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(sig), nil
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest[:], nil)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(sig), nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+//存证内容哈希sha256(body)，用于向TSA申请时间戳，与账本上的存证摘要不同
+func BodyHash(body string) []byte {
+	digest := sha256.Sum256([]byte(body))
+	return digest[:]
+}
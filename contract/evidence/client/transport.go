@@ -0,0 +1,52 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//链码调用通道，Submit提交交易，Evaluate只做查询
+type Transport interface {
+	Submit(fn string, args ...string) ([]byte, error)
+	Evaluate(fn string, args ...string) ([]byte, error)
+}
+
+//基于shim.MockStub的进程内实现，用于单元测试
+type MockTransport struct {
+	Stub *shim.MockStub
+
+	mu   sync.Mutex
+	txId int
+}
+
+func NewMockTransport(stub *shim.MockStub) *MockTransport {
+	return &MockTransport{Stub: stub}
+}
+
+func (m *MockTransport) Submit(fn string, args ...string) ([]byte, error) {
+	return m.invoke(fn, args)
+}
+
+func (m *MockTransport) Evaluate(fn string, args ...string) ([]byte, error) {
+	return m.invoke(fn, args)
+}
+
+func (m *MockTransport) invoke(fn string, args []string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.txId++
+	input := make([][]byte, 0, len(args)+1)
+	input = append(input, []byte(fn))
+	for _, arg := range args {
+		input = append(input, []byte(arg))
+	}
+	res := m.Stub.MockInvoke(strconv.Itoa(m.txId), input)
+	if res.Status != shim.OK {
+		return nil, fmt.Errorf("%s failed: %s", fn, res.Message)
+	}
+	return res.Payload, nil
+}
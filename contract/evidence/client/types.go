@@ -0,0 +1,204 @@
+package client
+
+import "time"
+
+//存证对象，与链码中的Evidence结构一致
+type Evidence struct {
+	ObjectType string     `json:"objectType,omitempty"`
+	Header     *Header    `json:"header"`
+	Body       string     `json:"body"`
+	Signature  *Signature `json:"signature,omitempty"`
+	Submitter  string     `json:"submitter,omitempty"` //提交者mspId/证书ID，由链码记录
+
+	TrustedTimestamp *TrustedTimestamp `json:"trustedTimestamp,omitempty"`
+	Manifest         *FileManifest     `json:"manifest,omitempty"`
+	Disputes         []*DisputeStatus  `json:"disputes,omitempty"`
+}
+
+type Header struct {
+	EvidenceObjectCode string `json:"evidenceObjectCode"` //存证对象码
+	Domain             string `json:"domain"`             //领域
+	Application        string `json:"application"`        //应用
+	DocumentType       string `json:"documentType"`       //单据类型
+	TransactionType    string `json:"transactionType"`    //交易类型
+	BizId              string `json:"bizId"`              //业务数据id
+	EvidenceCode       string `json:"evidenceCode"`       //存证码
+}
+
+type Signature struct {
+	Sign      string    `json:"sign"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+//可信时间戳
+type TrustedTimestamp struct {
+	GenTime        time.Time `json:"genTime"`
+	TSA            string    `json:"tsa"`
+	TSAFingerprint string    `json:"tsaFingerprint"`
+	SerialNumber   string    `json:"serialNumber"`
+	Policy         string    `json:"policy"`
+	MessageImprint string    `json:"messageImprint"`
+	Token          string    `json:"token"`
+}
+
+//授权对象
+type Grant struct {
+	ObjectType            string `json:"objectType,omitempty"`
+	Domain                string `json:"domain"`                //领域
+	Application           string `json:"application"`           //应用
+	EvidenceCode          string `json:"evidenceCode"`          //存证码
+	AuthorizedCertificate string `json:"authorizedCertificate"` //证书，PEM编码
+	AuthorizedToken       string `json:"authorizedToken"`       //身份
+	BeginTime             int64  `json:"beginTime"`             //开始时间，毫秒
+	EndTime               int64  `json:"endTime"`               //结束时间，毫秒
+	ReadTimes             int    `json:"readTimes"`             //取证次数
+}
+
+//操作日志
+type OperateLog struct {
+	ObjectType   string `json:"objectType"`
+	Domain       string `json:"domain"`
+	Application  string `json:"application"`
+	EvidenceCode string `json:"evidenceCode"`
+	OperateType  string `json:"operateType"`
+	Operator     string `json:"operator"`
+	Detail       string `json:"detail"`
+}
+
+//Merkle检查点
+type Checkpoint struct {
+	ObjectType string    `json:"objectType"`
+	Index      int64     `json:"index"`
+	From       int64     `json:"from"`
+	To         int64     `json:"to"`
+	Root       string    `json:"root"`
+	TxId       string    `json:"txId"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+type ProofNode struct {
+	Hash     string `json:"hash"`
+	Position string `json:"position"` //兄弟节点位置：left或right
+}
+
+//存证包含证明
+type InclusionProof struct {
+	Domain       string       `json:"domain"`
+	Application  string       `json:"application"`
+	EvidenceCode string       `json:"evidenceCode"`
+	Digest       string       `json:"digest"`
+	LeafIndex    int64        `json:"leafIndex"`
+	TreeSize     int64        `json:"treeSize"`
+	Path         []*ProofNode `json:"path"`
+	Checkpoint   *Checkpoint  `json:"checkpoint"`
+
+	Disputes []*DisputeStatus `json:"disputes,omitempty"`
+}
+
+//TSA证书登记结果
+type TSACertificate struct {
+	ObjectType  string `json:"objectType"`
+	Fingerprint string `json:"fingerprint"`
+	Subject     string `json:"subject"`
+	Certificate string `json:"certificate"`
+}
+
+//租户成员规则
+type TenantMember struct {
+	MSPID     string `json:"mspId,omitempty"`
+	Attribute string `json:"attribute,omitempty"`
+	Value     string `json:"value,omitempty"`
+}
+
+//租户
+type Tenant struct {
+	ObjectType  string          `json:"objectType,omitempty"`
+	Domain      string          `json:"domain"`
+	Application string          `json:"application"`
+	Members     []*TenantMember `json:"members"`
+	MaxRecords  int64           `json:"maxRecords"`
+	MaxBodySize int             `json:"maxBodySize"`
+}
+
+//租户信息及用量
+type TenantUsage struct {
+	Tenant  *Tenant `json:"tenant"`
+	Records int64   `json:"records"`
+}
+
+//统计结果
+type Stats struct {
+	Metric         string           `json:"metric"`
+	Period         string           `json:"period"`
+	Total          int64            `json:"total"`
+	ByDomain       map[string]int64 `json:"byDomain"`
+	ByApplication  map[string]int64 `json:"byApplication"`
+	ByDocumentType map[string]int64 `json:"byDocumentType"`
+	ByDay          map[string]int64 `json:"byDay"`
+}
+
+//即将到期的授权
+type ExpiringGrant struct {
+	Domain          string    `json:"domain"`
+	Application     string    `json:"application"`
+	EvidenceCode    string    `json:"evidenceCode"`
+	AuthorizedToken string    `json:"authorizedToken"`
+	EndTime         time.Time `json:"endTime"`
+	ReadTimes       int       `json:"readTimes"`
+}
+
+//大文件清单，可由BuildManifest生成
+type FileManifest struct {
+	FileName  string   `json:"fileName"`
+	Size      int64    `json:"size"`
+	MimeType  string   `json:"mimeType"`
+	ChunkSize int64    `json:"chunkSize"`
+	Chunks    []string `json:"chunks"`
+	RootHash  string   `json:"rootHash"`
+}
+
+//分片校验结果
+type ChunkVerification struct {
+	EvidenceCode string `json:"evidenceCode"`
+	Index        int    `json:"index"`
+	Valid        bool   `json:"valid"`
+}
+
+//存证或授权键的背书组织
+type KeyEndorsement struct {
+	ObjectType      string   `json:"objectType"`
+	Domain          string   `json:"domain"`
+	Application     string   `json:"application"`
+	EvidenceCode    string   `json:"evidenceCode"`
+	AuthorizedToken string   `json:"authorizedToken,omitempty"`
+	Orgs            []string `json:"orgs"`
+}
+
+type DisputeEntry struct {
+	Operator  string    `json:"operator"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+//存证争议，Status为open、responded或resolved，Decision为upheld或dismissed
+type Dispute struct {
+	ObjectType         string          `json:"objectType"`
+	Id                 string          `json:"id"`
+	Domain             string          `json:"domain"`
+	Application        string          `json:"application"`
+	EvidenceCode       string          `json:"evidenceCode"`
+	Status             string          `json:"status"`
+	SupportingEvidence []string        `json:"supportingEvidence"`
+	Claim              *DisputeEntry   `json:"claim"`
+	Responses          []*DisputeEntry `json:"responses"`
+	Decision           string          `json:"decision,omitempty"`
+	Resolution         *DisputeEntry   `json:"resolution,omitempty"`
+}
+
+//随存证返回的争议概况
+type DisputeStatus struct {
+	Id       string    `json:"id"`
+	Status   string    `json:"status"`
+	Decision string    `json:"decision,omitempty"`
+	OpenedAt time.Time `json:"openedAt"`
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	DISPUTE     = "Dispute"
+	arbiterAttr = "evidence.arbiter"
+
+	disputeOpen      = "open"
+	disputeResponded = "responded"
+	disputeResolved  = "resolved"
+
+	decisionUpheld    = "upheld"    //争议成立
+	decisionDismissed = "dismissed" //争议驳回
+)
+
+//争议中的一次陈述：发起、答复或裁决
+type DisputeEntry struct {
+	Operator  string    `json:"operator"` //mspId/证书ID
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+//对已存证数据的争议，以发起交易的ID作为争议编号
+type Dispute struct {
+	ObjectType         string          `json:"objectType"`
+	Id                 string          `json:"id"`
+	Domain             string          `json:"domain"`
+	Application        string          `json:"application"`
+	EvidenceCode       string          `json:"evidenceCode"`
+	Status             string          `json:"status"`
+	SupportingEvidence []string        `json:"supportingEvidence"` //同一租户下的佐证存证码
+	Claim              *DisputeEntry   `json:"claim"`
+	Responses          []*DisputeEntry `json:"responses"`
+	Decision           string          `json:"decision,omitempty"`
+	Resolution         *DisputeEntry   `json:"resolution,omitempty"`
+}
+
+//随存证一起返回的争议概况
+type DisputeStatus struct {
+	Id       string    `json:"id"`
+	Status   string    `json:"status"`
+	Decision string    `json:"decision,omitempty"`
+	OpenedAt time.Time `json:"openedAt"`
+}
+
+//发起争议，参数：领域、应用、存证码、争议理由、佐证存证码(json数组，可选)
+//发起方须为租户成员，或持有该存证未过期授权的证书
+func (v *EvidenceCC) openDispute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 && len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 or 5")
+	}
+	domain, application, evidenceCode, reason := args[0], args[1], args[2], args[3]
+	if reason == "" {
+		return shim.Error("Dispute reason is required")
+	}
+	if err := assertEvidenceExists(stub, domain, application, evidenceCode); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := assertDisputant(stub, domain, application, evidenceCode); err != nil {
+		return shim.Error(err.Error())
+	}
+	supporting := []string{}
+	if len(args) == 5 && args[4] != "" {
+		if err := json.Unmarshal([]byte(args[4]), &supporting); err != nil {
+			return shim.Error(fmt.Sprint("Failed to Unmarshal supporting evidence codes"))
+		}
+		for _, code := range supporting {
+			if err := assertEvidenceExists(stub, domain, application, code); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+
+	disputes, err := findDisputes(stub, domain, application, evidenceCode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, d := range disputes {
+		if d.Status != disputeResolved {
+			return shim.Error(fmt.Sprintf("Evidence %s already has an unresolved dispute %s!", evidenceCode, d.Id))
+		}
+	}
+
+	claim, err := newDisputeEntry(stub, reason)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dispute := &Dispute{
+		ObjectType:         DISPUTE,
+		Id:                 stub.GetTxID(),
+		Domain:             domain,
+		Application:        application,
+		EvidenceCode:       evidenceCode,
+		Status:             disputeOpen,
+		SupportingEvidence: supporting,
+		Claim:              claim,
+		Responses:          []*DisputeEntry{},
+	}
+	return saveDispute(stub, dispute, "openDispute", "发起争议："+dispute.Id)
+}
+
+//存证的提交者答复争议，参数：领域、应用、存证码、争议编号、答复内容
+func (v *EvidenceCC) respondDispute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+	domain, application, evidenceCode, id, content := args[0], args[1], args[2], args[3], args[4]
+	if content == "" {
+		return shim.Error("Dispute response is required")
+	}
+	if _, err := assertTenantMember(stub, domain, application); err != nil {
+		return shim.Error(err.Error())
+	}
+	evidence, err := getEvidence(stub, domain, application, evidenceCode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	operator, err := operatorName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	//未记录提交者的旧存证由租户成员答复
+	if evidence.Submitter != "" && evidence.Submitter != operator {
+		return shim.Error(fmt.Sprintf("Only the submitter of evidence %s can respond to its disputes!", evidenceCode))
+	}
+	dispute, err := getDispute(stub, domain, application, evidenceCode, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if dispute.Status == disputeResolved {
+		return shim.Error(fmt.Sprintf("Dispute %s is already resolved!", id))
+	}
+
+	entry, err := newDisputeEntry(stub, content)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dispute.Responses = append(dispute.Responses, entry)
+	dispute.Status = disputeResponded
+	return saveDispute(stub, dispute, "respondDispute", "答复争议："+id)
+}
+
+//仲裁方裁决争议，参数：领域、应用、存证码、争议编号、裁决结果(upheld/dismissed)、裁决说明
+func (v *EvidenceCC) resolveDispute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 6")
+	}
+	domain, application, evidenceCode, id, decision, remark := args[0], args[1], args[2], args[3], args[4], args[5]
+	if err := cid.AssertAttributeValue(stub, arbiterAttr, "true"); err != nil {
+		return shim.Error(err.Error())
+	}
+	if decision != decisionUpheld && decision != decisionDismissed {
+		return shim.Error(fmt.Sprintf("Unknown decision %s, expecting upheld or dismissed", decision))
+	}
+	dispute, err := getDispute(stub, domain, application, evidenceCode, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if dispute.Status == disputeResolved {
+		return shim.Error(fmt.Sprintf("Dispute %s is already resolved!", id))
+	}
+
+	entry, err := newDisputeEntry(stub, remark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dispute.Status = disputeResolved
+	dispute.Decision = decision
+	dispute.Resolution = entry
+	return saveDispute(stub, dispute, "resolveDispute", "裁决争议："+id+" "+decision)
+}
+
+//查询存证的全部争议，参数：领域、应用、存证码，租户成员或仲裁方可调用
+func (v *EvidenceCC) getDisputes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	domain, application, evidenceCode := args[0], args[1], args[2]
+	if cid.AssertAttributeValue(stub, arbiterAttr, "true") != nil {
+		if _, err := assertTenantMember(stub, domain, application); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	disputes, err := findDisputes(stub, domain, application, evidenceCode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	disputesJson, _ := json.Marshal(disputes)
+	return shim.Success(disputesJson)
+}
+
+func saveDispute(stub shim.ChaincodeStubInterface, dispute *Dispute, operateType, detail string) pb.Response {
+	key, err := tenantKey(stub, DISPUTE, dispute.Domain, dispute.Application, dispute.EvidenceCode, dispute.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	disputeJson, _ := json.Marshal(dispute)
+	err = stub.PutState(key, disputeJson)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to set dispute: %s", dispute.Id))
+	}
+	fmt.Println("saveDispute：", string(disputeJson))
+
+	creator, _ := stub.GetCreator()
+	log := &OperateLog{
+		ObjectType:   LOG,
+		Domain:       dispute.Domain,
+		Application:  dispute.Application,
+		EvidenceCode: dispute.EvidenceCode,
+		OperateType:  operateType,
+		Operator:     string(creator),
+		Detail:       detail,
+	}
+	err = writeLog(stub, log)
+	if err != nil {
+		return shim.Error(fmt.Sprint("Log write failure!"))
+	}
+	return shim.Success(disputeJson)
+}
+
+func newDisputeEntry(stub shim.ChaincodeStubInterface, content string) (*DisputeEntry, error) {
+	operator, err := operatorName(stub)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get transaction timestamp!")
+	}
+	txTime, _ := ptypes.Timestamp(ts)
+	return &DisputeEntry{Operator: operator, Content: content, Timestamp: txTime}, nil
+}
+
+//调用者的mspId/证书ID
+func operatorName(stub shim.ChaincodeStubInterface) (string, error) {
+	client, err := cid.New(stub)
+	if err != nil {
+		return "", err
+	}
+	mspID, err := client.GetMSPID()
+	if err != nil {
+		return "", err
+	}
+	id, err := client.GetID()
+	if err != nil {
+		return "", err
+	}
+	return mspID + "/" + id, nil
+}
+
+//校验调用者是租户成员，或是该存证某个未过期授权的被授权证书
+func assertDisputant(stub shim.ChaincodeStubInterface, domain, application, evidenceCode string) error {
+	if _, err := assertTenantMember(stub, domain, application); err == nil {
+		return nil
+	}
+	caller, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return err
+	}
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("Failed to get transaction timestamp!")
+	}
+	txTime, _ := ptypes.Timestamp(ts)
+
+	iter, err := stub.GetStateByPartialCompositeKey(GRANT, []string{domain, application, evidenceCode})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		var grant Grant
+		if json.Unmarshal(res.Value, &grant) != nil || time.Unix(grant.EndTime/1000, 0).Before(txTime) {
+			continue
+		}
+		cert, err := byteToCert([]byte(grant.AuthorizedCertificate))
+		if err == nil && bytes.Equal(cert.Raw, caller.Raw) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Caller is neither a member of tenant %s/%s nor granted evidence %s!", domain, application, evidenceCode)
+}
+
+func assertEvidenceExists(stub shim.ChaincodeStubInterface, domain, application, evidenceCode string) error {
+	_, err := getEvidence(stub, domain, application, evidenceCode)
+	return err
+}
+
+func getEvidence(stub shim.ChaincodeStubInterface, domain, application, evidenceCode string) (*Evidence, error) {
+	key, err := tenantKey(stub, EVIDENCE, domain, application, evidenceCode)
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return nil, fmt.Errorf("There is no record of that Evidence %s!", evidenceCode)
+	}
+	var evidence Evidence
+	if err = json.Unmarshal(value, &evidence); err != nil {
+		return nil, fmt.Errorf("Failed to Unmarshal Evidence %s", evidenceCode)
+	}
+	return &evidence, nil
+}
+
+func getDispute(stub shim.ChaincodeStubInterface, domain, application, evidenceCode, id string) (*Dispute, error) {
+	key, err := tenantKey(stub, DISPUTE, domain, application, evidenceCode, id)
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return nil, fmt.Errorf("There is no record of that Dispute %s!", id)
+	}
+	var dispute Dispute
+	if err = json.Unmarshal(value, &dispute); err != nil {
+		return nil, fmt.Errorf("Failed to Unmarshal Dispute %s", id)
+	}
+	return &dispute, nil
+}
+
+//按发起时间排序返回存证的全部争议
+func findDisputes(stub shim.ChaincodeStubInterface, domain, application, evidenceCode string) ([]*Dispute, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(DISPUTE, []string{domain, application, evidenceCode})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	disputes := []*Dispute{}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var dispute Dispute
+		if err = json.Unmarshal(res.Value, &dispute); err != nil {
+			return nil, fmt.Errorf("Failed to Unmarshal Dispute %s", res.Key)
+		}
+		disputes = append(disputes, &dispute)
+	}
+	sort.SliceStable(disputes, func(i, j int) bool {
+		return disputes[i].Claim.Timestamp.Before(disputes[j].Claim.Timestamp)
+	})
+	return disputes, nil
+}
+
+func disputeStatuses(stub shim.ChaincodeStubInterface, domain, application, evidenceCode string) ([]*DisputeStatus, error) {
+	disputes, err := findDisputes(stub, domain, application, evidenceCode)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []*DisputeStatus
+	for _, d := range disputes {
+		statuses = append(statuses, &DisputeStatus{Id: d.Id, Status: d.Status, Decision: d.Decision, OpenedAt: d.Claim.Timestamp})
+	}
+	return statuses, nil
+}
+
+//在返回的存证中附上争议状态
+func withDisputes(stub shim.ChaincodeStubInterface, domain, application string, value []byte) ([]byte, error) {
+	var evidence Evidence
+	if err := json.Unmarshal(value, &evidence); err != nil || evidence.Header == nil {
+		return nil, fmt.Errorf("Failed to Unmarshal Evidence")
+	}
+	statuses, err := disputeStatuses(stub, domain, application, evidence.Header.EvidenceCode)
+	if err != nil {
+		return nil, err
+	}
+	if len(statuses) == 0 {
+		return value, nil
+	}
+	evidence.Disputes = statuses
+	return json.Marshal(evidence)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+/**
+  键级背书策略：存证和授权键首次写入时把创建者所在组织设为该键的背书组织，
+  之后修改该键(包括取证扣减授权次数)都必须由这些组织的peer背书，不再只受通道级策略约束。
+  调整背书组织本身也需要满足该键当前的策略
+*/
+type KeyEndorsement struct {
+	ObjectType      string   `json:"objectType"` //Evidence或Grant
+	Domain          string   `json:"domain"`
+	Application     string   `json:"application"`
+	EvidenceCode    string   `json:"evidenceCode"`
+	AuthorizedToken string   `json:"authorizedToken,omitempty"` //ObjectType为Grant时必填
+	Orgs            []string `json:"orgs"`
+}
+
+//新键写入时设置背书策略，已有策略的键保持不变
+func ownKey(stub shim.ChaincodeStubInterface, key string) error {
+	ep, err := stub.GetStateValidationParameter(key)
+	if err != nil {
+		return err
+	}
+	if ep != nil {
+		return nil
+	}
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return err
+	}
+	policy, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return err
+	}
+	if err = policy.AddOrgs(statebased.RoleTypePeer, mspID); err != nil {
+		return err
+	}
+	ep, err = policy.Policy()
+	if err != nil {
+		return err
+	}
+	return stub.SetStateValidationParameter(key, ep)
+}
+
+//增加键的背书组织，仅管理员可调用
+func (v *EvidenceCC) addEndorsingOrgs(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return v.changeEndorsingOrgs(stub, args, func(policy statebased.KeyEndorsementPolicy, orgs []string) error {
+		return policy.AddOrgs(statebased.RoleTypePeer, orgs...)
+	})
+}
+
+//移除键的背书组织，仅管理员可调用，至少保留一个组织
+func (v *EvidenceCC) removeEndorsingOrgs(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return v.changeEndorsingOrgs(stub, args, func(policy statebased.KeyEndorsementPolicy, orgs []string) error {
+		policy.DelOrgs(orgs...)
+		if len(policy.ListOrgs()) == 0 {
+			return errors.New("Key must keep at least one endorsing org")
+		}
+		return nil
+	})
+}
+
+func (v *EvidenceCC) changeEndorsingOrgs(stub shim.ChaincodeStubInterface, args []string, change func(statebased.KeyEndorsementPolicy, []string) error) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if err := assertAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	var ke KeyEndorsement
+	if err := json.Unmarshal([]byte(args[0]), &ke); err != nil {
+		return shim.Error(fmt.Sprint("Failed to Unmarshal KeyEndorsement jsonData"))
+	}
+	if len(ke.Orgs) == 0 {
+		return shim.Error("KeyEndorsement orgs are required")
+	}
+	for _, org := range ke.Orgs {
+		if org == "" {
+			return shim.Error("KeyEndorsement org must not be empty")
+		}
+	}
+
+	key, policy, err := keyPolicy(stub, &ke)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = change(policy, ke.Orgs); err != nil {
+		return shim.Error(err.Error())
+	}
+	ep, err := policy.Policy()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetStateValidationParameter(key, ep); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to set endorsement policy of %s %s", ke.ObjectType, ke.EvidenceCode))
+	}
+
+	ke.Orgs = policy.ListOrgs()
+	keJson, _ := json.Marshal(ke)
+	fmt.Println("saveKeyEndorsement：", string(keJson))
+	return shim.Success(keJson)
+}
+
+//查询键的背书组织，管理员或租户成员可调用
+func (v *EvidenceCC) getEndorsingOrgs(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	var ke KeyEndorsement
+	if err := json.Unmarshal([]byte(args[0]), &ke); err != nil {
+		return shim.Error(fmt.Sprint("Failed to Unmarshal KeyEndorsement jsonData"))
+	}
+	if assertAdmin(stub) != nil {
+		if _, err := assertTenantMember(stub, ke.Domain, ke.Application); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	_, policy, err := keyPolicy(stub, &ke)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ke.Orgs = policy.ListOrgs()
+	keJson, _ := json.Marshal(ke)
+	return shim.Success(keJson)
+}
+
+//定位存证或授权键并读取其当前背书策略
+func keyPolicy(stub shim.ChaincodeStubInterface, ke *KeyEndorsement) (string, statebased.KeyEndorsementPolicy, error) {
+	var key string
+	var err error
+	switch ke.ObjectType {
+	case EVIDENCE:
+		key, err = tenantKey(stub, EVIDENCE, ke.Domain, ke.Application, ke.EvidenceCode)
+	case GRANT:
+		key, err = tenantKey(stub, GRANT, ke.Domain, ke.Application, ke.EvidenceCode, ke.AuthorizedToken)
+	default:
+		return "", nil, fmt.Errorf("Unknown objectType %s, expecting %s or %s", ke.ObjectType, EVIDENCE, GRANT)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return "", nil, fmt.Errorf("There is no record of that %s %s!", ke.ObjectType, ke.EvidenceCode)
+	}
+	ep, err := stub.GetStateValidationParameter(key)
+	if err != nil {
+		return "", nil, err
+	}
+	policy, err := statebased.NewStateEP(ep)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, policy, nil
+}
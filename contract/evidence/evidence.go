@@ -31,11 +31,18 @@ type Evidence struct {
 	Header     *Header    `json:"header"`
 	Body       string     `json:"body"`
 	Signature  *Signature `json:"signature"`
+	Submitter  string     `json:"submitter,omitempty"` //提交者mspId/证书ID，答复争议时校验
+
+	TrustedTimestamp *TrustedTimestamp `json:"trustedTimestamp,omitempty"` //TSA可信时间戳
+	Manifest         *FileManifest     `json:"manifest,omitempty"`         //大文件清单
+	Disputes         []*DisputeStatus  `json:"disputes,omitempty"`         //争议状态，仅在查询结果中返回
 }
 
 //授权对象
 type Grant struct {
 	ObjectType            string `json:"objectType"`
+	Domain                string `json:"domain"`                //领域
+	Application           string `json:"application"`           //应用
 	EvidenceCode          string `json:"evidenceCode"`          //"存证码"
 	AuthorizedCertificate string `json:"authorizedCertificate"` //"证书"
 	AuthorizedToken       string `json:"authorizedToken"`       //身份
@@ -47,6 +54,8 @@ type Grant struct {
 //操作日志
 type OperateLog struct {
 	ObjectType   string `json:"objectType"`
+	Domain       string `json:"domain"`
+	Application  string `json:"application"`
 	EvidenceCode string `json:"evidenceCode"`
 	OperateType  string `json:"operateType"`
 	Operator     string `json:"operator"`
@@ -94,12 +103,48 @@ func (v *EvidenceCC) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return v.searchEvidence(stub, args)
 	} else if fn == "queryLog" {
 		return v.queryLog(stub, args)
+	} else if fn == "checkpoint" {
+		return v.checkpoint(stub, args)
+	} else if fn == "getInclusionProof" {
+		return v.getInclusionProof(stub, args)
+	} else if fn == "registerTSA" {
+		return v.registerTSA(stub, args)
+	} else if fn == "removeTSA" {
+		return v.removeTSA(stub, args)
+	} else if fn == "setTenant" {
+		return v.setTenant(stub, args)
+	} else if fn == "getTenant" {
+		return v.getTenant(stub, args)
+	} else if fn == "stats" {
+		return v.stats(stub, args)
+	} else if fn == "expiringGrants" {
+		return v.expiringGrants(stub, args)
+	} else if fn == "verifyChunk" {
+		return v.verifyChunk(stub, args)
+	} else if fn == "addEndorsingOrgs" {
+		return v.addEndorsingOrgs(stub, args)
+	} else if fn == "removeEndorsingOrgs" {
+		return v.removeEndorsingOrgs(stub, args)
+	} else if fn == "getEndorsingOrgs" {
+		return v.getEndorsingOrgs(stub, args)
+	} else if fn == "openDispute" {
+		return v.openDispute(stub, args)
+	} else if fn == "respondDispute" {
+		return v.respondDispute(stub, args)
+	} else if fn == "resolveDispute" {
+		return v.resolveDispute(stub, args)
+	} else if fn == "getDisputes" {
+		return v.getDisputes(stub, args)
 	}
 
 	return shim.Error("No this method:" + fn)
 }
 
+//存证上链，可选的第二个参数为TSA对sha256(body)签发的RFC 3161时间戳令牌(base64)
 func (v *EvidenceCC) set(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
 	jsonData := args[0]
 	var evidence Evidence
 
@@ -108,12 +153,65 @@ func (v *EvidenceCC) set(stub shim.ChaincodeStubInterface, args []string) pb.Res
 		return shim.Error(fmt.Sprint("Failed to Unmarshal Evidence jsonData"))
 	}
 
+	header := evidence.Header
+	if header == nil || header.EvidenceCode == "" {
+		return shim.Error("Evidence header and evidenceCode are required")
+	}
+	tenant, err := assertTenantMember(stub, header.Domain, header.Application)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if tenant.MaxBodySize > 0 && len(evidence.Body) > tenant.MaxBodySize {
+		return shim.Error(fmt.Sprintf("Evidence body exceeds %d bytes allowed for tenant %s/%s!", tenant.MaxBodySize, tenant.Domain, tenant.Application))
+	}
+	if evidence.Manifest != nil {
+		if err = validateManifest(evidence.Manifest); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	evidenceKey, err := tenantKey(stub, EVIDENCE, header.Domain, header.Application, header.EvidenceCode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	existing, err := stub.GetState(evidenceKey)
+	if err != nil {
+		return shim.Error("Failed to get state")
+	}
+	if existing == nil {
+		if err = useRecordQuota(stub, tenant); err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		disputes, err := findDisputes(stub, header.Domain, header.Application, header.EvidenceCode)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, d := range disputes {
+			if d.Status != disputeResolved {
+				return shim.Error(fmt.Sprintf("Evidence %s is under dispute %s!", header.EvidenceCode, d.Id))
+			}
+		}
+	}
+
 	evidence.ObjectType = EVIDENCE
+	evidence.Submitter, err = operatorName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	evidence.TrustedTimestamp = nil
+	evidence.Disputes = nil
+	if len(args) == 2 {
+		ts, err := verifyTimestampToken(stub, args[1], sha256Hash(evidence.Body))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		evidence.TrustedTimestamp = ts
+	}
 
 	signp, _ := stub.GetSignedProposal()
 	sign := hex.EncodeToString(signp.GetSignature())
 
-	evidenceKey := evidence.Header.EvidenceCode
 	evidence.Signature = &Signature{
 		Sign:      sign,
 		Timestamp: time.Now(),
@@ -125,14 +223,28 @@ func (v *EvidenceCC) set(stub shim.ChaincodeStubInterface, args []string) pb.Res
 	if err != nil {
 		return shim.Error(fmt.Sprintf("Failed to set evidence: %s", args[0]))
 	}
+	if err = ownKey(stub, evidenceKey); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to set endorsement policy of evidence: %s", header.EvidenceCode))
+	}
 
 	fmt.Println("save：", string(evidenceJson))
 
+	err = recordDigest(stub, header, evidenceJson)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to record digest of evidence: %s", header.EvidenceCode))
+	}
+	err = incrStat(stub, metricNotarized, header)
+	if err != nil {
+		return shim.Error(fmt.Sprint("Failed to update statistics!"))
+	}
+
 	fmt.Println("写日志")
 	creator, _ := stub.GetCreator()
 	log := &OperateLog{
 		ObjectType:   LOG,
-		EvidenceCode: evidenceKey,
+		Domain:       header.Domain,
+		Application:  header.Application,
+		EvidenceCode: header.EvidenceCode,
 		OperateType:  "put",
 		Operator:     string(creator),
 		Detail:       "存证上链",
@@ -145,16 +257,34 @@ func (v *EvidenceCC) set(stub shim.ChaincodeStubInterface, args []string) pb.Res
 	return shim.Success(evidenceJson)
 }
 
+//根据存证码获取存证，参数：领域、应用、存证码
 func (v *EvidenceCC) get(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	evidenceCode := args[0]
-	value, err := stub.GetState(evidenceCode)
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	domain, application, evidenceCode := args[0], args[1], args[2]
+	if _, err := assertTenantMember(stub, domain, application); err != nil {
+		return shim.Error(err.Error())
+	}
+	evidenceKey, err := tenantKey(stub, EVIDENCE, domain, application, evidenceCode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	value, err := stub.GetState(evidenceKey)
 	if err != nil {
 		return shim.Error(fmt.Sprintf("There is no record of that Evidence %s!", evidenceCode))
 	}
+	if value != nil {
+		if value, err = withDisputes(stub, domain, application, value); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	fmt.Println("写日志")
 	creator, _ := stub.GetCreator()
 	log := &OperateLog{
 		ObjectType:   LOG,
+		Domain:       domain,
+		Application:  application,
 		EvidenceCode: evidenceCode,
 		OperateType:  "get",
 		Operator:     string(creator),
@@ -169,8 +299,18 @@ func (v *EvidenceCC) get(stub shim.ChaincodeStubInterface, args []string) pb.Res
 
 //查看某个存证信息的历史日志
 func (v *EvidenceCC) queryLog(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	evidenceCode := args[0]
-	iter, err := stub.GetHistoryForKey(LOG + "_" + evidenceCode)
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	domain, application, evidenceCode := args[0], args[1], args[2]
+	if _, err := assertTenantMember(stub, domain, application); err != nil {
+		return shim.Error(err.Error())
+	}
+	logKey, err := tenantKey(stub, LOG, domain, application, evidenceCode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	iter, err := stub.GetHistoryForKey(logKey)
 	if err != nil {
 		return shim.Error(fmt.Sprintf("Failed obtain %s Log!", evidenceCode))
 	}
@@ -197,8 +337,15 @@ func (v *EvidenceCC) grant(stub shim.ChaincodeStubInterface, args []string) pb.R
 	if err != nil {
 		return shim.Error(fmt.Sprint("Failed to Unmarshal Grant jsonData"))
 	}
+	if _, err = assertTenantMember(stub, grant.Domain, grant.Application); err != nil {
+		return shim.Error(err.Error())
+	}
+	grant.ObjectType = GRANT
 
-	grantKey := fmt.Sprintf("%s_%s_%s", GRANT, grant.EvidenceCode, grant.AuthorizedToken)
+	grantKey, err := tenantKey(stub, GRANT, grant.Domain, grant.Application, grant.EvidenceCode, grant.AuthorizedToken)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	grantJson, _ := json.Marshal(grant)
 
@@ -206,12 +353,17 @@ func (v *EvidenceCC) grant(stub shim.ChaincodeStubInterface, args []string) pb.R
 	if err != nil {
 		return shim.Error(fmt.Sprintf("Failed to set grant: %s", args[0]))
 	}
+	if err = ownKey(stub, grantKey); err != nil {
+		return shim.Error(fmt.Sprintf("Failed to set endorsement policy of grant: %s", grant.EvidenceCode))
+	}
 	fmt.Println("saveGrant：", string(grantJson))
 
 	fmt.Println("写日志")
 	creator, _ := stub.GetCreator()
 	log := &OperateLog{
 		ObjectType:   LOG,
+		Domain:       grant.Domain,
+		Application:  grant.Application,
 		EvidenceCode: grant.EvidenceCode,
 		OperateType:  "grant",
 		Operator:     string(creator),
@@ -225,21 +377,29 @@ func (v *EvidenceCC) grant(stub shim.ChaincodeStubInterface, args []string) pb.R
 	return shim.Success(grantJson)
 }
 
-//查证
+//查证，参数：领域、应用、存证码、授权令牌、签名
 func (v *EvidenceCC) searchEvidence(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
 	}
 
-	evidenceKey := args[0]
-	token := args[1]
+	domain, application := args[0], args[1]
+	evidenceCode := args[2]
+	token := args[3]
 	digest := sha256Hash(token)
 
-	grantKey := fmt.Sprintf("%s_%s_%s", GRANT, evidenceKey, token)
+	evidenceKey, err := tenantKey(stub, EVIDENCE, domain, application, evidenceCode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	grantKey, err := tenantKey(stub, GRANT, domain, application, evidenceCode, token)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	grantByte, err := stub.GetState(grantKey)
 	if err != nil {
-		return shim.Error(fmt.Sprintf("There is no record of that Grant %s!", grantKey))
+		return shim.Error(fmt.Sprintf("There is no record of that Grant %s!", token))
 	}
 
 	var grant Grant
@@ -253,15 +413,15 @@ func (v *EvidenceCC) searchEvidence(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error(err.Error())
 	}
 
-	signature := args[2]
-	rint, sint, err := getECDSASignatureRS(signature)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
+	signature := args[4]
 
 	var flag bool
 	switch cert.PublicKey.(type) {
 	case *ecdsa.PublicKey:
+		rint, sint, err := getECDSASignatureRS(signature)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 		pub := cert.PublicKey.(*ecdsa.PublicKey)
 		flag = ecdsa.Verify(pub, digest, rint, sint)
 	case *rsa.PublicKey:
@@ -296,7 +456,17 @@ func (v *EvidenceCC) searchEvidence(stub shim.ChaincodeStubInterface, args []str
 		//所有验证通过，获取存证
 		evidence, err := stub.GetState(evidenceKey)
 		if err != nil {
-			return shim.Error(fmt.Sprintf("There is no record of that Evidence %s!", evidenceKey))
+			return shim.Error(fmt.Sprintf("There is no record of that Evidence %s!", evidenceCode))
+		}
+
+		readHeader := &Header{Domain: domain, Application: application, EvidenceCode: evidenceCode}
+		var stored Evidence
+		if json.Unmarshal(evidence, &stored) == nil && stored.Header != nil {
+			readHeader.DocumentType = stored.Header.DocumentType
+		}
+		err = incrStat(stub, metricRead, readHeader)
+		if err != nil {
+			return shim.Error(fmt.Sprint("Failed to update statistics!"))
 		}
 
 		fmt.Printf("授权次数-1")
@@ -311,7 +481,9 @@ func (v *EvidenceCC) searchEvidence(stub shim.ChaincodeStubInterface, args []str
 		creator, _ := stub.GetCreator()
 		log := &OperateLog{
 			ObjectType:   LOG,
-			EvidenceCode: grant.EvidenceCode,
+			Domain:       domain,
+			Application:  application,
+			EvidenceCode: evidenceCode,
 			OperateType:  "searchEvidence",
 			Operator:     string(creator),
 			Detail:       "取证",
@@ -321,6 +493,11 @@ func (v *EvidenceCC) searchEvidence(stub shim.ChaincodeStubInterface, args []str
 			return shim.Error(fmt.Sprint("Log write failure!"))
 		}
 
+		if evidence != nil {
+			if evidence, err = withDisputes(stub, domain, application, evidence); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
 		return shim.Success(evidence)
 	}
 }
@@ -335,7 +512,10 @@ func getECDSASignatureRS(signature string) (rint, sint *big.Int, err error) {
 
 func writeLog(stub shim.ChaincodeStubInterface, log *OperateLog) (err error) {
 	logByte, err := json.Marshal(log)
-	logKey := log.ObjectType + "_" + log.EvidenceCode
+	logKey, err := tenantKey(stub, log.ObjectType, log.Domain, log.Application, log.EvidenceCode)
+	if err != nil {
+		return
+	}
 	err = stub.PutState(logKey, logByte)
 	return
 }
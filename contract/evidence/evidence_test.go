@@ -1,9 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"com.jerry/contract/evidence/client"
+	"com.jerry/contract/shimtest"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"math/big"
 	"testing"
+	"time"
 )
 
 func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
@@ -20,14 +37,38 @@ func TestEvidenceCC_Init(t *testing.T) {
 	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("123"), []byte("B"), []byte("234")})
 }
 
+const (
+	testDomain      = "e-contract"
+	testApplication = "contract"
+)
+
+//登记测试租户，调用者同时具有管理员属性和租户成员身份
+func setupTenant(t *testing.T, stub *shim.MockStub) {
+	stub.Creator = creatorWithAttrs(t, "Org1MSP", map[string]string{"evidence.admin": "true"})
+	tenant := `{"domain":"` + testDomain + `","application":"` + testApplication + `","members":[{"mspId":"Org1MSP"}]}`
+	res := stub.MockInvoke("0", [][]byte{[]byte("setTenant"), []byte(tenant)})
+	if res.Status != shim.OK {
+		t.Fatal("setTenant failed", res.Message)
+	}
+}
+
+func evidenceKey(t *testing.T, stub *shim.MockStub, code string) string {
+	key, err := stub.CreateCompositeKey(EVIDENCE, []string{testDomain, testApplication, code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
 func TestEvidenceCC_Invoke(t *testing.T) {
 	scc := new(EvidenceCC)
 	stub := shim.NewMockStub("evidence", scc)
+	setupTenant(t, stub)
 	var value = `{
   "header": {
     "evidenceObjectCode": "e-contract",
-    "domain": "",
-    "application": "",
+    "domain": "e-contract",
+    "application": "contract",
     "documentType": "",
     "transactionType": "",
     "bizId": "65e4195245804e2183f26b32c495d026",
@@ -38,10 +79,12 @@ func TestEvidenceCC_Invoke(t *testing.T) {
 	res := stub.MockInvoke("1", [][]byte{[]byte("set"), []byte(value)})
 	fmt.Println("上链结果" + res.String())
 
-	res = stub.MockInvoke("1", [][]byte{[]byte("get"), []byte("1326069383327514624")})
+	res = stub.MockInvoke("1", [][]byte{[]byte("get"), []byte(testDomain), []byte(testApplication), []byte("1326069383327514624")})
 	fmt.Println("查询结果" + res.String())
 
 	var grant = `{
+  "domain": "e-contract",
+  "application": "contract",
   "authorizedToken": "123",
   "authorizedCertificate": "-----BEGIN CERTIFICATE-----\nMIICLDCCAdKgAwIBAgIQOjPdh27dOxJSRR0DqAeIbzAKBggqhkjOPQQDAjBsMQsw\nCQYDVQQGEwJVUzETMBEGA1UECBMKQ2FsaWZvcm5pYTEWMBQGA1UEBxMNU2FuIEZy\nYW5jaXNjbzEUMBIGA1UEChMLZXhhbXBsZS5jb20xGjAYBgNVBAMTEXRsc2NhLmV4\nYW1wbGUuY29tMB4XDTIwMTEwMzA4MzkwMFoXDTMwMTEwMTA4MzkwMFowVjELMAkG\nA1UEBhMCVVMxEzARBgNVBAgTCkNhbGlmb3JuaWExFjAUBgNVBAcTDVNhbiBGcmFu\nY2lzY28xGjAYBgNVBAMMEUFkbWluQGV4YW1wbGUuY29tMFkwEwYHKoZIzj0CAQYI\nKoZIzj0DAQcDQgAEXpMfJac3o6DtjMBqNEYCK1wqTI1Kt4Ep4Wx6HCbijaJ9LDBV\nMPCtxGQjCXOdewylqNoz64bJN2h2nzBO9nKJHKNsMGowDgYDVR0PAQH/BAQDAgWg\nMB0GA1UdJQQWMBQGCCsGAQUFBwMBBggrBgEFBQcDAjAMBgNVHRMBAf8EAjAAMCsG\nA1UdIwQkMCKAIPg5q7ZlNPOhtfm+hhkUBfcSGJgiL7lON2BasbRxR8KBMAoGCCqG\nSM49BAMCA0gAMEUCIQD/5H/OO2zQyHvGBQurZbKbKf+XNgvWgSwG/nV+iVp+QwIg\nS+d0oEJPBC1asVe78VDdPNghGteU65h7/HUYhZdupUY=\n-----END CERTIFICATE-----",
   "evidenceCode": "1326069383327514624",
@@ -52,9 +95,703 @@ func TestEvidenceCC_Invoke(t *testing.T) {
 	res = stub.MockInvoke("1", [][]byte{[]byte("grant"), []byte(grant)})
 	fmt.Println("授权结果" + res.String())
 
-	res = stub.MockInvoke("1", [][]byte{[]byte("searchEvidence"), []byte("1326069383327514624"), []byte("123"), []byte("3046022100f1a0342dae9f8feb5902f5ae9cf5101958a439c59117dba41fd3dcab653fa807022100af3abffd83f604c031d40ed635c4ea826b927758041ac0a174d046154863a1cc")})
+	res = stub.MockInvoke("1", [][]byte{[]byte("searchEvidence"), []byte(testDomain), []byte(testApplication), []byte("1326069383327514624"), []byte("123"), []byte("3046022100f1a0342dae9f8feb5902f5ae9cf5101958a439c59117dba41fd3dcab653fa807022100af3abffd83f604c031d40ed635c4ea826b927758041ac0a174d046154863a1cc")})
 	fmt.Println("查证结果" + res.String())
 
-	res = stub.MockInvoke("1", [][]byte{[]byte("searchEvidence"), []byte("1326069383327514624"), []byte("123"), []byte("3046022100f1a0342dae9f8feb5902f5ae9cf5101958a439c59117dba41fd3dcab653fa807022100af3abffd83f604c031d40ed635c4ea826b927758041ac0a174d046154863a1cc")})
+	res = stub.MockInvoke("1", [][]byte{[]byte("searchEvidence"), []byte(testDomain), []byte(testApplication), []byte("1326069383327514624"), []byte("123"), []byte("3046022100f1a0342dae9f8feb5902f5ae9cf5101958a439c59117dba41fd3dcab653fa807022100af3abffd83f604c031d40ed635c4ea826b927758041ac0a174d046154863a1cc")})
 	fmt.Println("查证结果" + res.String())
 }
+
+func evidenceJson(code string) []byte {
+	return []byte(`{"header":{"evidenceObjectCode":"e-contract","domain":"` + testDomain + `","application":"` + testApplication + `","bizId":"` + code + `","evidenceCode":"` + code + `"},"body":"` + code + `"}`)
+}
+
+func TestEvidenceCC_Checkpoint(t *testing.T) {
+	scc := new(EvidenceCC)
+	stub := shim.NewMockStub("evidence", scc)
+	setupTenant(t, stub)
+
+	res := stub.MockInvoke("1", [][]byte{[]byte("checkpoint")})
+	if res.Status == shim.OK {
+		t.Fatal("checkpoint without evidence should fail")
+	}
+
+	//E1覆盖一次，索引指向较新的摘要
+	codes := []string{"E1", "E2", "E3", "E4", "E5"}
+	for _, code := range []string{"E1", "E2", "E3", "E1"} {
+		res = stub.MockInvoke("1", [][]byte{[]byte("set"), evidenceJson(code)})
+		if res.Status != shim.OK {
+			t.Fatal("set failed", res.Message)
+		}
+	}
+	if _, ok := stub.State["EvidenceDigestSeq"]; ok {
+		t.Fatal("set should not keep a shared digest counter")
+	}
+	admin := stub.Creator
+	stub.Creator = creatorWithAttrs(t, "Org1MSP", map[string]string{})
+	res = stub.MockInvoke("2", [][]byte{[]byte("checkpoint")})
+	if res.Status == shim.OK {
+		t.Fatal("checkpoint by non admin should fail")
+	}
+	stub.Creator = admin
+	res = stub.MockInvoke("2", [][]byte{[]byte("checkpoint")})
+	if res.Status != shim.OK {
+		t.Fatal("checkpoint failed", res.Message)
+	}
+	var first Checkpoint
+	if err := json.Unmarshal(res.Payload, &first); err != nil || first.From != 1 || first.To != 4 {
+		t.Fatal("first checkpoint should cover 4 digests", string(res.Payload), err)
+	}
+
+	res = stub.MockInvoke("3", [][]byte{[]byte("getInclusionProof"), []byte(testDomain), []byte(testApplication), []byte("E4")})
+	if res.Status == shim.OK {
+		t.Fatal("proof for unknown evidence should fail")
+	}
+
+	for _, code := range codes[3:] {
+		res = stub.MockInvoke("4", [][]byte{[]byte("set"), evidenceJson(code)})
+		if res.Status != shim.OK {
+			t.Fatal("set failed", res.Message)
+		}
+	}
+	res = stub.MockInvoke("5", [][]byte{[]byte("getInclusionProof"), []byte(testDomain), []byte(testApplication), []byte("E5")})
+	if res.Status == shim.OK {
+		t.Fatal("proof for evidence after the last checkpoint should fail")
+	}
+	res = stub.MockInvoke("6", [][]byte{[]byte("checkpoint")})
+	if res.Status != shim.OK {
+		t.Fatal("checkpoint failed", res.Message)
+	}
+
+	for i, code := range codes {
+		res = stub.MockInvoke("7", [][]byte{[]byte("getInclusionProof"), []byte(testDomain), []byte(testApplication), []byte(code)})
+		if res.Status != shim.OK {
+			t.Fatal("getInclusionProof failed", res.Message)
+		}
+		var proof InclusionProof
+		if err := json.Unmarshal(res.Payload, &proof); err != nil {
+			t.Fatal(err)
+		}
+		wantIndex := int64(1)
+		if i >= 3 {
+			wantIndex = 2
+		}
+		if proof.Checkpoint.Index != wantIndex {
+			t.Fatalf("%s: checkpoint %d, expected %d", code, proof.Checkpoint.Index, wantIndex)
+		}
+		if code == "E1" && proof.LeafIndex != 3 {
+			t.Fatalf("E1: proof should cover its latest digest, got leaf %d", proof.LeafIndex)
+		}
+		digest, _ := hex.DecodeString(proof.Digest)
+		root, _ := hex.DecodeString(proof.Checkpoint.Root)
+		if !verifyInclusion(digest, proof.Path, root) {
+			t.Fatalf("%s: inclusion proof does not verify", code)
+		}
+		if verifyInclusion(sha256Hash("forged"), proof.Path, root) {
+			t.Fatalf("%s: forged digest verified", code)
+		}
+	}
+}
+
+//生成带Fabric属性的证书，序列化为调用者身份
+func creatorWithAttrs(t *testing.T, mspID string, attrs map[string]string) []byte {
+	id, err := shimtest.NewIdentity(mspID, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id.Creator
+}
+
+type testTSA struct {
+	key     *ecdsa.PrivateKey
+	cert    *x509.Certificate
+	certPEM string
+}
+
+func newTestTSA(t *testing.T, name string) *testTSA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testTSA{
+		key:     key,
+		cert:    cert,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+}
+
+//按RFC 3161签发时间戳令牌，返回base64编码
+func (tsa *testTSA) stamp(t *testing.T, digest []byte, genTime time.Time) string {
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	info, err := asn1.Marshal(tstInfo{
+		Version:        1,
+		Policy:         asn1.ObjectIdentifier{1, 2, 3, 4},
+		MessageImprint: messageImprint{HashAlgorithm: sha256Alg, HashedMessage: digest},
+		SerialNumber:   big.NewInt(42),
+		GenTime:        genTime,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct, _ := asn1.Marshal(oidTSTInfo)
+	md, _ := asn1.Marshal(sha256Hash(string(info)))
+	var attrs []byte
+	for _, a := range []attribute{
+		{Type: oidContentType, Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: ct}},
+		{Type: oidMessageDigest, Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: md}},
+	} {
+		b, err := asn1.Marshal(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs = append(attrs, b...)
+	}
+	signedAttrs := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs}
+	toSign, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	sig, err := ecdsa.SignASN1(rand.Reader, tsa.key, sha256Hash(string(toSign)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sid, _ := asn1.Marshal(issuerAndSerialNumber{
+		Issuer:       asn1.RawValue{FullBytes: tsa.cert.RawIssuer},
+		SerialNumber: tsa.cert.SerialNumber,
+	})
+	sd, err := asn1.Marshal(signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Alg},
+		EncapContentInfo: encapsulatedContentInfo{EContentType: oidTSTInfo, EContent: info},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:    sha256Alg,
+			SignedAttrs:        signedAttrs,
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{oidSignedData, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(token)
+}
+
+func TestEvidenceCC_TrustedTimestamp(t *testing.T) {
+	scc := new(EvidenceCC)
+	stub := shim.NewMockStub("evidence", scc)
+	tsa := newTestTSA(t, "tsa.example.com")
+	rogue := newTestTSA(t, "rogue.example.com")
+
+	stub.Creator = creatorWithAttrs(t, "Org1MSP", map[string]string{})
+	res := stub.MockInvoke("1", [][]byte{[]byte("registerTSA"), []byte(tsa.certPEM)})
+	if res.Status == shim.OK {
+		t.Fatal("registerTSA by non admin should fail")
+	}
+	setupTenant(t, stub)
+	res = stub.MockInvoke("1", [][]byte{[]byte("registerTSA"), []byte(tsa.certPEM)})
+	if res.Status != shim.OK {
+		t.Fatal("registerTSA failed", res.Message)
+	}
+
+	genTime := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	digest := sha256Hash("E1")
+	res = stub.MockInvoke("2", [][]byte{[]byte("set"), evidenceJson("E1"), []byte(tsa.stamp(t, digest, genTime))})
+	if res.Status != shim.OK {
+		t.Fatal("set with timestamp failed", res.Message)
+	}
+	var evidence Evidence
+	_ = json.Unmarshal(stub.State[evidenceKey(t, stub, "E1")], &evidence)
+	if evidence.TrustedTimestamp == nil || !evidence.TrustedTimestamp.GenTime.Equal(genTime) {
+		t.Fatal("genTime was not stored", string(stub.State[evidenceKey(t, stub, "E1")]))
+	}
+	if evidence.TrustedTimestamp.TSA != "CN=tsa.example.com" || evidence.TrustedTimestamp.TSAFingerprint != certFingerprint(tsa.cert) {
+		t.Fatal("TSA identity was not stored", evidence.TrustedTimestamp.TSA)
+	}
+
+	res = stub.MockInvoke("3", [][]byte{[]byte("set"), evidenceJson("E2"), []byte(tsa.stamp(t, digest, genTime))})
+	if res.Status == shim.OK {
+		t.Fatal("timestamp over another digest should fail")
+	}
+	res = stub.MockInvoke("4", [][]byte{[]byte("set"), evidenceJson("E2"), []byte(rogue.stamp(t, sha256Hash("E2"), genTime))})
+	if res.Status == shim.OK {
+		t.Fatal("timestamp from unregistered TSA should fail")
+	}
+	res = stub.MockInvoke("5", [][]byte{[]byte("set"), evidenceJson("E2"), []byte(tsa.stamp(t, sha256Hash("E2"), genTime.Add(2*time.Hour)))})
+	if res.Status == shim.OK {
+		t.Fatal("timestamp outside TSA certificate validity should fail")
+	}
+
+	res = stub.MockInvoke("6", [][]byte{[]byte("removeTSA"), []byte(certFingerprint(tsa.cert))})
+	if res.Status != shim.OK {
+		t.Fatal("removeTSA failed", res.Message)
+	}
+	res = stub.MockInvoke("7", [][]byte{[]byte("set"), evidenceJson("E2"), []byte(tsa.stamp(t, sha256Hash("E2"), genTime))})
+	if res.Status == shim.OK {
+		t.Fatal("timestamp from removed TSA should fail")
+	}
+}
+
+func selfSignedPEM(t *testing.T, key crypto.Signer) string {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "reader"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestEvidenceCC_Client(t *testing.T) {
+	stub := shim.NewMockStub("evidence", new(EvidenceCC))
+	setupTenant(t, stub)
+	cli := client.New(client.NewMockTransport(stub), testDomain, testApplication)
+
+	saved, err := cli.Set(&client.Evidence{
+		Header: &client.Header{EvidenceObjectCode: "e-contract", EvidenceCode: "C1"},
+		Body:   "contract body",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.ObjectType != EVIDENCE || saved.Signature == nil {
+		t.Fatal("unexpected set result", saved)
+	}
+	got, err := cli.Get("C1")
+	if err != nil || got.Body != "contract body" {
+		t.Fatal("get failed", err)
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	end := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	for _, reader := range []struct {
+		token string
+		key   crypto.Signer
+	}{{"ec-reader", ecKey}, {"rsa-reader", rsaKey}} {
+		_, err = cli.Grant(&client.Grant{
+			EvidenceCode:          "C1",
+			AuthorizedCertificate: selfSignedPEM(t, reader.key),
+			AuthorizedToken:       reader.token,
+			EndTime:               end,
+			ReadTimes:             1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sig, err := client.SignToken(reader.key, reader.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := cli.SearchEvidence("C1", reader.token, sig)
+		if err != nil {
+			t.Fatal(reader.token, err)
+		}
+		if found.Header.EvidenceCode != "C1" {
+			t.Fatal("unexpected evidence", found.Header.EvidenceCode)
+		}
+		if _, err = cli.SearchEvidence("C1", reader.token, sig); err == nil {
+			t.Fatal(reader.token, "read times should be exhausted")
+		}
+	}
+
+	if _, err = cli.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	proof, err := cli.GetInclusionProof("C1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.VerifyInclusionProof(proof); err != nil {
+		t.Fatal(err)
+	}
+	proof.Digest = hex.EncodeToString(client.BodyHash("forged"))
+	if err = client.VerifyInclusionProof(proof); err == nil {
+		t.Fatal("forged proof verified")
+	}
+}
+
+func TestEvidenceCC_Tenant(t *testing.T) {
+	stub := shim.NewMockStub("evidence", new(EvidenceCC))
+	transport := client.NewMockTransport(stub)
+	admin := creatorWithAttrs(t, "Org1MSP", map[string]string{"evidence.admin": "true"})
+	appA := creatorWithAttrs(t, "Org1MSP", map[string]string{"evidence.app": "a"})
+	appB := creatorWithAttrs(t, "Org2MSP", map[string]string{})
+	cliA := client.New(transport, "finance", "a")
+	cliB := cliA.ForTenant("finance", "b")
+
+	stub.Creator = appA
+	if _, err := cliA.SetTenant(&client.Tenant{Domain: "finance", Application: "a"}); err == nil {
+		t.Fatal("setTenant by non admin should fail")
+	}
+	stub.Creator = admin
+	if _, err := cliA.SetTenant(&client.Tenant{
+		Domain:      "finance",
+		Application: "a",
+		Members:     []*client.TenantMember{{MSPID: "Org1MSP", Attribute: "evidence.app", Value: "a"}},
+		MaxRecords:  2,
+		MaxBodySize: 8,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cliB.SetTenant(&client.Tenant{
+		Domain:      "finance",
+		Application: "b",
+		Members:     []*client.TenantMember{{MSPID: "Org2MSP"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	evidence := func(code, body string) *client.Evidence {
+		return &client.Evidence{Header: &client.Header{EvidenceCode: code}, Body: body}
+	}
+
+	//管理员不属于租户a
+	if _, err := cliA.Set(evidence("X1", "a"), ""); err == nil {
+		t.Fatal("set by non member should fail")
+	}
+	stub.Creator = appA
+	if _, err := cliA.Set(evidence("X1", "a"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cliA.Set(evidence("X2", "too long body"), ""); err == nil {
+		t.Fatal("body larger than quota should be rejected")
+	}
+	if _, err := cliA.Set(evidence("X1", "a2"), ""); err != nil {
+		t.Fatal("overwriting own record should not use quota", err)
+	}
+	if _, err := cliA.Set(evidence("X2", "b"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cliA.Set(evidence("X3", "c"), ""); err == nil {
+		t.Fatal("record quota should be exceeded")
+	}
+	usage, err := cliA.GetTenant()
+	if err != nil || usage.Records != 2 {
+		t.Fatal("unexpected usage", usage, err)
+	}
+
+	//租户b使用相同的存证码，既不能读取也不能覆盖租户a的存证
+	stub.Creator = appB
+	if _, err = cliA.Get("X1"); err == nil {
+		t.Fatal("tenant b should not read tenant a records")
+	}
+	if _, err = cliA.Set(evidence("X1", "evil"), ""); err == nil {
+		t.Fatal("tenant b should not overwrite tenant a records")
+	}
+	if _, err = cliB.Set(evidence("X1", "b"), ""); err != nil {
+		t.Fatal(err)
+	}
+	stub.Creator = appA
+	got, err := cliA.Get("X1")
+	if err != nil || got.Body != "a2" {
+		t.Fatal("tenant a record was changed", got, err)
+	}
+}
+
+func TestEvidenceCC_Stats(t *testing.T) {
+	stub := shim.NewMockStub("evidence", new(EvidenceCC))
+	setupTenant(t, stub)
+	cli := client.New(client.NewMockTransport(stub), testDomain, testApplication)
+
+	for i, docType := range []string{"contract", "contract", "invoice"} {
+		_, err := cli.Set(&client.Evidence{
+			Header: &client.Header{EvidenceCode: fmt.Sprintf("S%d", i), DocumentType: docType},
+			Body:   "body",
+		}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	now := time.Now()
+	for _, g := range []struct {
+		token string
+		end   time.Time
+	}{{"soon", now.Add(2 * time.Hour)}, {"later", now.Add(72 * time.Hour)}} {
+		_, err := cli.Grant(&client.Grant{
+			EvidenceCode:          "S0",
+			AuthorizedCertificate: selfSignedPEM(t, key),
+			AuthorizedToken:       g.token,
+			EndTime:               g.end.UnixNano() / int64(time.Millisecond),
+			ReadTimes:             2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig, _ := client.SignToken(key, "soon")
+	if _, err := cli.SearchEvidence("S0", "soon", sig); err != nil {
+		t.Fatal(err)
+	}
+
+	today := now.UTC().Format("2006-01-02")
+	notarized, err := cli.Stats("notarized", today[:7])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notarized.Total != 3 || notarized.ByDocumentType["contract"] != 2 || notarized.ByDocumentType["invoice"] != 1 {
+		t.Fatal("unexpected notarized stats", notarized)
+	}
+	if notarized.ByDomain[testDomain] != 3 || notarized.ByApplication[testDomain+"/"+testApplication] != 3 || notarized.ByDay[today] != 3 {
+		t.Fatal("unexpected notarized stats", notarized)
+	}
+	read, err := cli.Stats("read", today)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Total != 1 || read.ByDocumentType["contract"] != 1 {
+		t.Fatal("unexpected read stats", read)
+	}
+	if _, err = cli.Stats("read", "2020"); err == nil {
+		t.Fatal("invalid period should fail")
+	}
+
+	grants, err := cli.ExpiringGrants(24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 1 || grants[0].AuthorizedToken != "soon" || grants[0].ReadTimes != 1 {
+		t.Fatal("unexpected expiring grants", grants)
+	}
+
+	stub.Creator = creatorWithAttrs(t, "Org1MSP", map[string]string{})
+	if _, err = cli.Stats("notarized", ""); err == nil {
+		t.Fatal("stats by non admin should fail")
+	}
+}
+
+func TestEvidenceCC_Manifest(t *testing.T) {
+	stub := shim.NewMockStub("evidence", new(EvidenceCC))
+	setupTenant(t, stub)
+	cli := client.New(client.NewMockTransport(stub), testDomain, testApplication)
+
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	manifest, err := client.BuildManifest(bytes.NewReader(data), "report.pdf", "application/pdf", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Chunks) != 16 || manifest.Size != 1000 {
+		t.Fatal("unexpected manifest", manifest)
+	}
+
+	bad := *manifest
+	bad.Chunks = append([]string{}, manifest.Chunks[:15]...)
+	if _, err = cli.Set(&client.Evidence{Header: &client.Header{EvidenceCode: "F0"}, Manifest: &bad}, ""); err == nil {
+		t.Fatal("manifest with missing chunk should fail")
+	}
+	bad = *manifest
+	bad.RootHash = client.ChunkHash([]byte("other"))
+	if _, err = cli.Set(&client.Evidence{Header: &client.Header{EvidenceCode: "F0"}, Manifest: &bad}, ""); err == nil {
+		t.Fatal("manifest with wrong root hash should fail")
+	}
+
+	if _, err = cli.Set(&client.Evidence{Header: &client.Header{EvidenceCode: "F1"}, Manifest: manifest}, ""); err != nil {
+		t.Fatal(err)
+	}
+	valid, err := cli.VerifyChunk("F1", 15, client.ChunkHash(data[960:]))
+	if err != nil || !valid {
+		t.Fatal("last chunk should verify", err)
+	}
+	valid, err = cli.VerifyChunk("F1", 0, client.ChunkHash(data[64:128]))
+	if err != nil || valid {
+		t.Fatal("tampered chunk should not verify", err)
+	}
+	if _, err = cli.VerifyChunk("F1", 16, manifest.Chunks[0]); err == nil {
+		t.Fatal("chunk index out of range should fail")
+	}
+}
+
+func TestEvidenceCC_KeyEndorsement(t *testing.T) {
+	stub := shim.NewMockStub("evidence", new(EvidenceCC))
+	setupTenant(t, stub)
+	cli := client.New(client.NewMockTransport(stub), testDomain, testApplication)
+
+	if _, err := cli.Set(&client.Evidence{Header: &client.Header{EvidenceCode: "K1"}, Body: "body"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, err := cli.Grant(&client.Grant{
+		EvidenceCode:          "K1",
+		AuthorizedCertificate: selfSignedPEM(t, key),
+		AuthorizedToken:       "token",
+		EndTime:               time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond),
+		ReadTimes:             1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evidenceEP := &client.KeyEndorsement{ObjectType: EVIDENCE, EvidenceCode: "K1"}
+	grantEP := &client.KeyEndorsement{ObjectType: GRANT, EvidenceCode: "K1", AuthorizedToken: "token"}
+	for _, ke := range []*client.KeyEndorsement{evidenceEP, grantEP} {
+		got, err := cli.GetEndorsingOrgs(ke)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Orgs) != 1 || got.Orgs[0] != "Org1MSP" {
+			t.Fatal("key should be owned by Org1MSP", got.Orgs)
+		}
+	}
+
+	evidenceEP.Orgs = []string{"Org2MSP"}
+	got, err := cli.AddEndorsingOrgs(evidenceEP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Orgs) != 2 {
+		t.Fatal("expecting two endorsing orgs", got.Orgs)
+	}
+	evidenceEP.Orgs = []string{"Org1MSP"}
+	if got, err = cli.RemoveEndorsingOrgs(evidenceEP); err != nil || len(got.Orgs) != 1 || got.Orgs[0] != "Org2MSP" {
+		t.Fatal("expecting only Org2MSP", got, err)
+	}
+	evidenceEP.Orgs = []string{"Org2MSP"}
+	if _, err = cli.RemoveEndorsingOrgs(evidenceEP); err == nil {
+		t.Fatal("removing the last endorsing org should fail")
+	}
+
+	//覆盖已有存证不会重置背书策略
+	if _, err = cli.Set(&client.Evidence{Header: &client.Header{EvidenceCode: "K1"}, Body: "body2"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = cli.GetEndorsingOrgs(evidenceEP); err != nil || len(got.Orgs) != 1 || got.Orgs[0] != "Org2MSP" {
+		t.Fatal("existing policy should be kept", got, err)
+	}
+
+	stub.Creator = creatorWithAttrs(t, "Org1MSP", map[string]string{})
+	grantEP.Orgs = []string{"Org3MSP"}
+	if _, err = cli.AddEndorsingOrgs(grantEP); err == nil {
+		t.Fatal("changing endorsing orgs by non admin should fail")
+	}
+}
+
+func TestEvidenceCC_Dispute(t *testing.T) {
+	stub := shim.NewMockStub("evidence", new(EvidenceCC))
+	setupTenant(t, stub)
+	owner := stub.Creator
+	cli := client.New(client.NewMockTransport(stub), testDomain, testApplication)
+
+	for _, code := range []string{"D1", "D2"} {
+		if _, err := cli.Set(&client.Evidence{Header: &client.Header{EvidenceCode: code}, Body: "body"}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//对方机构不是租户成员，持有存证的授权后可以发起争议
+	counterparty, err := shimtest.NewIdentity("Org2MSP", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.Creator = counterparty.Creator
+	if _, err = cli.OpenDispute("D1", "amount mismatch", nil); err == nil {
+		t.Fatal("dispute by a caller without a grant should fail")
+	}
+	stub.Creator = owner
+	_, err = cli.Grant(&client.Grant{
+		EvidenceCode:          "D1",
+		AuthorizedCertificate: string(counterparty.PEM),
+		AuthorizedToken:       "counterparty",
+		EndTime:               time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond),
+		ReadTimes:             1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.Creator = counterparty.Creator
+	if _, err = cli.OpenDispute("D2", "amount mismatch", nil); err == nil {
+		t.Fatal("grant of D1 should not allow disputing D2")
+	}
+	if _, err = cli.OpenDispute("D1", "amount mismatch", []string{"missing"}); err == nil {
+		t.Fatal("unknown supporting evidence should fail")
+	}
+	dispute, err := cli.OpenDispute("D1", "amount mismatch", []string{"D2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dispute.Status != "open" || dispute.Claim.Content != "amount mismatch" || len(dispute.SupportingEvidence) != 1 {
+		t.Fatal("unexpected dispute", dispute)
+	}
+	if _, err = cli.OpenDispute("D1", "again", nil); err == nil {
+		t.Fatal("second unresolved dispute should fail")
+	}
+	if _, err = cli.RespondDispute("D1", dispute.Id, "not the owner"); err == nil {
+		t.Fatal("response by non member should fail")
+	}
+
+	//同一租户的其他成员不是提交者
+	stub.Creator = creatorWithAttrs(t, "Org1MSP", map[string]string{})
+	if _, err = cli.RespondDispute("D1", dispute.Id, "not the submitter"); err == nil {
+		t.Fatal("response by another tenant member should fail")
+	}
+
+	stub.Creator = owner
+	if _, err = cli.Set(&client.Evidence{Header: &client.Header{EvidenceCode: "D1"}, Body: "changed"}, ""); err == nil {
+		t.Fatal("disputed evidence should not be overwritten")
+	}
+	if dispute, err = cli.RespondDispute("D1", dispute.Id, "see attachment"); err != nil || dispute.Status != "responded" {
+		t.Fatal("respond failed", err)
+	}
+	evidence, err := cli.Get("D1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evidence.Disputes) != 1 || evidence.Disputes[0].Status != "responded" {
+		t.Fatal("get should surface dispute status", evidence.Disputes)
+	}
+	if _, err = cli.ResolveDispute("D1", dispute.Id, "dismissed", "owner is right"); err == nil {
+		t.Fatal("resolve by non arbiter should fail")
+	}
+
+	stub.Creator = creatorWithAttrs(t, "Org3MSP", map[string]string{"evidence.arbiter": "true"})
+	if _, err = cli.ResolveDispute("D1", dispute.Id, "maybe", ""); err == nil {
+		t.Fatal("unknown decision should fail")
+	}
+	if dispute, err = cli.ResolveDispute("D1", dispute.Id, "dismissed", "owner is right"); err != nil {
+		t.Fatal(err)
+	}
+	if dispute.Status != "resolved" || dispute.Decision != "dismissed" || dispute.Resolution == nil {
+		t.Fatal("unexpected resolution", dispute)
+	}
+	if _, err = cli.ResolveDispute("D1", dispute.Id, "upheld", ""); err == nil {
+		t.Fatal("resolved dispute should not be resolved again")
+	}
+	disputes, err := cli.GetDisputes("D1")
+	if err != nil || len(disputes) != 1 || len(disputes[0].Responses) != 1 {
+		t.Fatal("unexpected disputes", disputes, err)
+	}
+
+	stub.Creator = owner
+	if _, err = cli.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	proof, err := cli.GetInclusionProof("D1")
+	if err != nil || len(proof.Disputes) != 1 || proof.Disputes[0].Decision != "dismissed" {
+		t.Fatal("proof should surface dispute status", err)
+	}
+	if _, err = cli.Set(&client.Evidence{Header: &client.Header{EvidenceCode: "D1"}, Body: "changed"}, ""); err != nil {
+		t.Fatal(err)
+	}
+}
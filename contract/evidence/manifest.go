@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const maxManifestChunks = 10000 //单个清单最多的分片数
+
+/**
+  大文件清单：文件本身不上链，只登记分片哈希。
+  RootHash为以各分片sha256为叶子、按RFC 6962规则构建的Merkle树根，hex编码
+*/
+type FileManifest struct {
+	FileName  string   `json:"fileName"`
+	Size      int64    `json:"size"` //文件字节数
+	MimeType  string   `json:"mimeType"`
+	ChunkSize int64    `json:"chunkSize"` //分片字节数，最后一片可以更小
+	Chunks    []string `json:"chunks"`    //各分片sha256，hex编码
+	RootHash  string   `json:"rootHash"`
+}
+
+//分片校验结果
+type ChunkVerification struct {
+	EvidenceCode string `json:"evidenceCode"`
+	Index        int    `json:"index"`
+	Valid        bool   `json:"valid"`
+}
+
+//校验清单各字段与分片哈希、树根是否一致
+func validateManifest(m *FileManifest) error {
+	if strings.TrimSpace(m.FileName) == "" {
+		return errors.New("Manifest fileName is required")
+	}
+	if m.Size <= 0 || m.ChunkSize <= 0 {
+		return errors.New("Manifest size and chunkSize must be positive")
+	}
+	if _, _, err := mime.ParseMediaType(m.MimeType); err != nil {
+		return fmt.Errorf("Manifest mimeType %q is invalid", m.MimeType)
+	}
+
+	expected := (m.Size + m.ChunkSize - 1) / m.ChunkSize
+	if expected > maxManifestChunks {
+		return fmt.Errorf("Manifest must not have more than %d chunks", maxManifestChunks)
+	}
+	if int64(len(m.Chunks)) != expected {
+		return fmt.Errorf("Manifest has %d chunks, expecting %d for size %d and chunkSize %d", len(m.Chunks), expected, m.Size, m.ChunkSize)
+	}
+
+	entries := make([]*DigestEntry, 0, len(m.Chunks))
+	for i, chunk := range m.Chunks {
+		digest, err := hex.DecodeString(chunk)
+		if err != nil || len(digest) != 32 {
+			return fmt.Errorf("Manifest chunk %d is not a hex encoded sha256", i)
+		}
+		m.Chunks[i] = hex.EncodeToString(digest)
+		entries = append(entries, &DigestEntry{Digest: m.Chunks[i]})
+	}
+	leaves, err := leafHashes(entries)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(hex.EncodeToString(merkleRoot(leaves)), m.RootHash) {
+		return errors.New("Manifest rootHash does not match chunk hashes")
+	}
+	m.RootHash = strings.ToLower(m.RootHash)
+	return nil
+}
+
+//校验下载的某个分片，参数：领域、应用、存证码、分片序号(从0开始)、分片sha256
+func (v *EvidenceCC) verifyChunk(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+	domain, application, evidenceCode := args[0], args[1], args[2]
+	if _, err := assertTenantMember(stub, domain, application); err != nil {
+		return shim.Error(err.Error())
+	}
+	index, err := strconv.Atoi(args[3])
+	if err != nil {
+		return shim.Error("Expecting integer value for chunk index")
+	}
+
+	evidenceKey, err := tenantKey(stub, EVIDENCE, domain, application, evidenceCode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	value, err := stub.GetState(evidenceKey)
+	if err != nil || value == nil {
+		return shim.Error(fmt.Sprintf("There is no record of that Evidence %s!", evidenceCode))
+	}
+	var evidence Evidence
+	if err = json.Unmarshal(value, &evidence); err != nil {
+		return shim.Error(fmt.Sprint("Failed to Unmarshal Evidence"))
+	}
+	if evidence.Manifest == nil {
+		return shim.Error(fmt.Sprintf("Evidence %s has no file manifest!", evidenceCode))
+	}
+	if index < 0 || index >= len(evidence.Manifest.Chunks) {
+		return shim.Error(fmt.Sprintf("Chunk index %d out of range, manifest has %d chunks", index, len(evidence.Manifest.Chunks)))
+	}
+
+	result := &ChunkVerification{
+		EvidenceCode: evidenceCode,
+		Index:        index,
+		Valid:        strings.EqualFold(evidence.Manifest.Chunks[index], args[4]),
+	}
+	resultJson, _ := json.Marshal(result)
+	return shim.Success(resultJson)
+}
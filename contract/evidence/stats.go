@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	STAT = "Stat"
+
+	metricNotarized = "notarized" //存证上链次数
+	metricRead      = "read"      //取证次数
+)
+
+//统计结果
+type Stats struct {
+	Metric         string           `json:"metric"`
+	Period         string           `json:"period"`
+	Total          int64            `json:"total"`
+	ByDomain       map[string]int64 `json:"byDomain"`
+	ByApplication  map[string]int64 `json:"byApplication"` //键为domain/application
+	ByDocumentType map[string]int64 `json:"byDocumentType"`
+	ByDay          map[string]int64 `json:"byDay"`
+}
+
+//即将到期的授权
+type ExpiringGrant struct {
+	Domain          string    `json:"domain"`
+	Application     string    `json:"application"`
+	EvidenceCode    string    `json:"evidenceCode"`
+	AuthorizedToken string    `json:"authorizedToken"`
+	EndTime         time.Time `json:"endTime"`
+	ReadTimes       int       `json:"readTimes"`
+}
+
+/**
+  计数采用增量记录：每笔交易写入一条以交易ID结尾的独立键，不读取共享计数器，
+  并发的set/searchEvidence之间不会产生MVCC读写冲突，查询时再汇总
+  键结构：Stat~metric~月份~日~domain~application~documentType~txId
+*/
+func incrStat(stub shim.ChaincodeStubInterface, metric string, header *Header) error {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	txTime, _ := ptypes.Timestamp(ts)
+	key, err := stub.CreateCompositeKey(STAT, []string{
+		metric,
+		txTime.Format("2006-01"),
+		txTime.Format("02"),
+		header.Domain,
+		header.Application,
+		header.DocumentType,
+		stub.GetTxID(),
+	})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte("1"))
+}
+
+//统计查询，参数：指标(notarized/read)、统计周期(空表示全部，YYYY-MM或YYYY-MM-DD)，仅管理员可调用
+func (v *EvidenceCC) stats(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	if err := assertAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	metric := args[0]
+	if metric != metricNotarized && metric != metricRead {
+		return shim.Error(fmt.Sprintf("Unknown metric %s, expecting notarized or read", metric))
+	}
+	period := ""
+	if len(args) == 2 {
+		period = args[1]
+	}
+
+	keys := []string{metric}
+	switch len(period) {
+	case 0:
+	case len("2006-01"):
+		if _, err := time.Parse("2006-01", period); err != nil {
+			return shim.Error("Invalid period, expecting YYYY-MM or YYYY-MM-DD")
+		}
+		keys = append(keys, period)
+	case len("2006-01-02"):
+		if _, err := time.Parse("2006-01-02", period); err != nil {
+			return shim.Error("Invalid period, expecting YYYY-MM or YYYY-MM-DD")
+		}
+		keys = append(keys, period[:7], period[8:])
+	default:
+		return shim.Error("Invalid period, expecting YYYY-MM or YYYY-MM-DD")
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(STAT, keys)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer iter.Close()
+
+	stats := &Stats{
+		Metric:         metric,
+		Period:         period,
+		ByDomain:       map[string]int64{},
+		ByApplication:  map[string]int64{},
+		ByDocumentType: map[string]int64{},
+		ByDay:          map[string]int64{},
+	}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, attrs, err := stub.SplitCompositeKey(res.Key)
+		if err != nil || len(attrs) != 7 {
+			continue
+		}
+		n, err := strconv.ParseInt(string(res.Value), 10, 64)
+		if err != nil {
+			continue
+		}
+		month, day, domain, application, documentType := attrs[1], attrs[2], attrs[3], attrs[4], attrs[5]
+		stats.Total += n
+		stats.ByDomain[domain] += n
+		stats.ByApplication[domain+"/"+application] += n
+		stats.ByDocumentType[documentType] += n
+		stats.ByDay[month+"-"+day] += n
+	}
+
+	statsJson, _ := json.Marshal(stats)
+	return shim.Success(statsJson)
+}
+
+//查询在指定小时数内到期且仍有剩余次数的授权，仅管理员可调用
+func (v *EvidenceCC) expiringGrants(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if err := assertAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	hours, err := strconv.Atoi(args[0])
+	if err != nil || hours <= 0 {
+		return shim.Error("Expecting positive integer value for hours")
+	}
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(fmt.Sprint("Failed to get transaction timestamp!"))
+	}
+	now, _ := ptypes.Timestamp(ts)
+	deadline := now.Add(time.Duration(hours) * time.Hour)
+
+	iter, err := stub.GetStateByPartialCompositeKey(GRANT, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer iter.Close()
+
+	grants := []*ExpiringGrant{}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var grant Grant
+		if err = json.Unmarshal(res.Value, &grant); err != nil {
+			continue
+		}
+		endTime := time.Unix(grant.EndTime/1000, 0).UTC()
+		if grant.ReadTimes < 1 || endTime.Before(now) || endTime.After(deadline) {
+			continue
+		}
+		grants = append(grants, &ExpiringGrant{
+			Domain:          grant.Domain,
+			Application:     grant.Application,
+			EvidenceCode:    grant.EvidenceCode,
+			AuthorizedToken: grant.AuthorizedToken,
+			EndTime:         endTime,
+			ReadTimes:       grant.ReadTimes,
+		})
+	}
+	sort.SliceStable(grants, func(i, j int) bool {
+		return grants[i].EndTime.Before(grants[j].EndTime)
+	})
+
+	grantsJson, _ := json.Marshal(grants)
+	return shim.Success(grantsJson)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	TENANT       = "Tenant"
+	TENANT_USAGE = "TenantUsage"
+)
+
+//租户成员规则：MSPID和证书属性至少填写一项，填写的条件须同时满足
+type TenantMember struct {
+	MSPID     string `json:"mspId,omitempty"`
+	Attribute string `json:"attribute,omitempty"`
+	Value     string `json:"value,omitempty"`
+}
+
+//租户，由Header中的Domain和Application确定
+type Tenant struct {
+	ObjectType  string          `json:"objectType"`
+	Domain      string          `json:"domain"`
+	Application string          `json:"application"`
+	Members     []*TenantMember `json:"members"`
+	MaxRecords  int64           `json:"maxRecords"`  //存证数量上限，0表示不限
+	MaxBodySize int             `json:"maxBodySize"` //单条存证body字节数上限，0表示不限
+}
+
+//租户信息及用量
+type TenantUsage struct {
+	Tenant  *Tenant `json:"tenant"`
+	Records int64   `json:"records"`
+}
+
+//新增或修改租户，仅管理员可调用
+func (v *EvidenceCC) setTenant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if err := assertAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var tenant Tenant
+	err := json.Unmarshal([]byte(args[0]), &tenant)
+	if err != nil {
+		return shim.Error(fmt.Sprint("Failed to Unmarshal Tenant jsonData"))
+	}
+	if tenant.Domain == "" || tenant.Application == "" {
+		return shim.Error("Tenant domain and application are required")
+	}
+	if tenant.MaxRecords < 0 || tenant.MaxBodySize < 0 {
+		return shim.Error("Tenant quota must not be negative")
+	}
+	if len(tenant.Members) == 0 {
+		return shim.Error("Tenant must have at least one member")
+	}
+	for _, member := range tenant.Members {
+		if member == nil || (member.MSPID == "" && member.Attribute == "") {
+			return shim.Error("Tenant member must specify mspId or attribute")
+		}
+	}
+	tenant.ObjectType = TENANT
+
+	key, err := tenantKey(stub, TENANT, tenant.Domain, tenant.Application)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tenantJson, _ := json.Marshal(tenant)
+	err = stub.PutState(key, tenantJson)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to set tenant: %s", args[0]))
+	}
+	fmt.Println("saveTenant：", string(tenantJson))
+
+	return shim.Success(tenantJson)
+}
+
+//查询租户及其用量，管理员或租户成员可调用
+func (v *EvidenceCC) getTenant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	var tenant *Tenant
+	var err error
+	if assertAdmin(stub) == nil {
+		tenant, err = findTenant(stub, args[0], args[1])
+	} else {
+		tenant, err = assertTenantMember(stub, args[0], args[1])
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	usageKey, err := tenantKey(stub, TENANT_USAGE, tenant.Domain, tenant.Application)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	records, err := getCounter(stub, usageKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	usageJson, _ := json.Marshal(&TenantUsage{Tenant: tenant, Records: records})
+	return shim.Success(usageJson)
+}
+
+func findTenant(stub shim.ChaincodeStubInterface, domain, application string) (*Tenant, error) {
+	key, err := tenantKey(stub, TENANT, domain, application)
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return nil, fmt.Errorf("Tenant %s/%s is not registered!", domain, application)
+	}
+	var tenant Tenant
+	if err = json.Unmarshal(value, &tenant); err != nil {
+		return nil, fmt.Errorf("Failed to Unmarshal Tenant %s/%s", domain, application)
+	}
+	return &tenant, nil
+}
+
+//校验调用者是否属于该租户
+func assertTenantMember(stub shim.ChaincodeStubInterface, domain, application string) (*Tenant, error) {
+	tenant, err := findTenant(stub, domain, application)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := cid.New(stub)
+	if err != nil {
+		return nil, err
+	}
+	mspID, err := client.GetMSPID()
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range tenant.Members {
+		if member.MSPID != "" && member.MSPID != mspID {
+			continue
+		}
+		if member.Attribute != "" {
+			value, found, err := client.GetAttributeValue(member.Attribute)
+			if err != nil || !found || value != member.Value {
+				continue
+			}
+		}
+		return tenant, nil
+	}
+	return nil, fmt.Errorf("Caller is not a member of tenant %s/%s!", domain, application)
+}
+
+//新增存证时占用租户配额
+func useRecordQuota(stub shim.ChaincodeStubInterface, tenant *Tenant) error {
+	usageKey, err := tenantKey(stub, TENANT_USAGE, tenant.Domain, tenant.Application)
+	if err != nil {
+		return err
+	}
+	records, err := getCounter(stub, usageKey)
+	if err != nil {
+		return err
+	}
+	if tenant.MaxRecords > 0 && records >= tenant.MaxRecords {
+		return errors.New("Tenant record quota exceeded!")
+	}
+	return stub.PutState(usageKey, []byte(strconv.FormatInt(records+1, 10)))
+}
+
+//按租户划分的联合主键：objectType~domain~application~attrs
+func tenantKey(stub shim.ChaincodeStubInterface, objectType, domain, application string, attrs ...string) (string, error) {
+	return stub.CreateCompositeKey(objectType, append([]string{domain, application}, attrs...))
+}
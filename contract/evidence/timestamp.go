@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	TSA = "TSA"
+
+	adminAttr = "evidence.admin" //管理员证书属性
+)
+
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+//可信时间戳，由TSA按RFC 3161对存证摘要sha256(body)签发
+type TrustedTimestamp struct {
+	GenTime        time.Time `json:"genTime"`        //TSA签发时间
+	TSA            string    `json:"tsa"`            //TSA证书主题
+	TSAFingerprint string    `json:"tsaFingerprint"` //TSA证书sha256指纹
+	SerialNumber   string    `json:"serialNumber"`   //时间戳序列号
+	Policy         string    `json:"policy"`         //TSA策略
+	MessageImprint string    `json:"messageImprint"` //被签发的摘要，hex编码
+	Token          string    `json:"token"`          //时间戳令牌原文，base64编码
+}
+
+//已登记的TSA证书
+type TSACertificate struct {
+	ObjectType  string `json:"objectType"`
+	Fingerprint string `json:"fingerprint"`
+	Subject     string `json:"subject"`
+	Certificate string `json:"certificate"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time        `asn1:"generalized"`
+	Accuracy       accuracy         `asn1:"optional"`
+	Ordering       bool             `asn1:"optional"`
+	Nonce          *big.Int         `asn1:"optional"`
+	TSA            asn1.RawValue    `asn1:"explicit,optional,tag:0"`
+	Extensions     []pkix.Extension `asn1:"optional,tag:1"`
+}
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+//登记TSA证书，仅管理员可调用
+func (v *EvidenceCC) registerTSA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if err := assertAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	cert, err := byteToCert([]byte(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	timeStamping := false
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageTimeStamping {
+			timeStamping = true
+		}
+	}
+	if !timeStamping {
+		return shim.Error(fmt.Sprint("Certificate is not authorized for time stamping!"))
+	}
+
+	tsa := &TSACertificate{
+		ObjectType:  TSA,
+		Fingerprint: certFingerprint(cert),
+		Subject:     cert.Subject.String(),
+		Certificate: args[0],
+	}
+	tsaJson, _ := json.Marshal(tsa)
+	err = stub.PutState(TSA+"_"+tsa.Fingerprint, tsaJson)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to register TSA: %s", tsa.Subject))
+	}
+	fmt.Println("registerTSA：", tsa.Subject)
+
+	return shim.Success(tsaJson)
+}
+
+//注销TSA证书，参数为证书指纹
+func (v *EvidenceCC) removeTSA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if err := assertAdmin(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key := TSA + "_" + args[0]
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return shim.Error(fmt.Sprintf("There is no record of that TSA %s!", args[0]))
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return shim.Error("Failed to delete state")
+	}
+	return shim.Success(nil)
+}
+
+func assertAdmin(stub shim.ChaincodeStubInterface) error {
+	return cid.AssertAttributeValue(stub, adminAttr, "true")
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+  校验RFC 3161时间戳令牌：摘要必须等于digest，签名者必须是已登记的TSA证书，
+  不访问网络，也不信任令牌中携带的证书
+*/
+func verifyTimestampToken(stub shim.ChaincodeStubInterface, token string, digest []byte) (*TrustedTimestamp, error) {
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("Timestamp token is not base64 encoded")
+	}
+
+	var ci contentInfo
+	if _, err = asn1.Unmarshal(raw, &ci); err != nil {
+		return nil, fmt.Errorf("Failed to parse timestamp token: %s", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.New("Timestamp token is not a SignedData")
+	}
+	var sd signedData
+	if _, err = asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("Failed to parse SignedData: %s", err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, errors.New("Timestamp token does not contain a TSTInfo")
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, errors.New("Timestamp token must have exactly one signer")
+	}
+
+	content := sd.EncapContentInfo.EContent
+	var info tstInfo
+	if _, err = asn1.Unmarshal(content, &info); err != nil {
+		return nil, fmt.Errorf("Failed to parse TSTInfo: %s", err)
+	}
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) {
+		return nil, errors.New("Timestamp message imprint must use SHA-256")
+	}
+	if !bytes.Equal(info.MessageImprint.HashedMessage, digest) {
+		return nil, errors.New("Timestamp message imprint does not match the evidence digest")
+	}
+
+	signer := sd.SignerInfos[0]
+	hash, err := hashForOID(signer.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := checkSignedAttrs(signer, hash, content)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := findTSA(stub, signer.SID)
+	if err != nil {
+		return nil, err
+	}
+	if info.GenTime.Before(cert.NotBefore) || info.GenTime.After(cert.NotAfter) {
+		return nil, errors.New("Timestamp was issued outside the TSA certificate validity")
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	hashed := h.Sum(nil)
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		rint, sint, err := UnmarshalECDSASignature(signer.Signature)
+		if err != nil {
+			return nil, err
+		}
+		if !ecdsa.Verify(pub, hashed, rint, sint) {
+			return nil, errors.New("Failed to verify timestamp signature")
+		}
+	case *rsa.PublicKey:
+		if err = rsa.VerifyPKCS1v15(pub, hash, hashed, signer.Signature); err != nil {
+			return nil, errors.New("Failed to verify timestamp signature")
+		}
+	default:
+		return nil, errors.New("There is no certificate of this type!")
+	}
+
+	return &TrustedTimestamp{
+		GenTime:        info.GenTime.UTC(),
+		TSA:            cert.Subject.String(),
+		TSAFingerprint: certFingerprint(cert),
+		SerialNumber:   info.SerialNumber.String(),
+		Policy:         info.Policy.String(),
+		MessageImprint: hex.EncodeToString(digest),
+		Token:          token,
+	}, nil
+}
+
+//校验签名属性中的contentType和messageDigest，返回参与签名的DER编码
+func checkSignedAttrs(signer signerInfo, hash crypto.Hash, content []byte) ([]byte, error) {
+	if len(signer.SignedAttrs.FullBytes) == 0 {
+		return nil, errors.New("Timestamp token has no signed attributes")
+	}
+
+	var contentTypeOK, digestOK bool
+	rest := signer.SignedAttrs.Bytes
+	for len(rest) > 0 {
+		var attr attribute
+		var err error
+		rest, err = asn1.Unmarshal(rest, &attr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse signed attributes: %s", err)
+		}
+		switch {
+		case attr.Type.Equal(oidContentType):
+			var ct asn1.ObjectIdentifier
+			if _, err = asn1.Unmarshal(attr.Values.Bytes, &ct); err == nil && ct.Equal(oidTSTInfo) {
+				contentTypeOK = true
+			}
+		case attr.Type.Equal(oidMessageDigest):
+			var md []byte
+			if _, err = asn1.Unmarshal(attr.Values.Bytes, &md); err == nil {
+				h := hash.New()
+				h.Write(content)
+				digestOK = bytes.Equal(md, h.Sum(nil))
+			}
+		}
+	}
+	if !contentTypeOK {
+		return nil, errors.New("Timestamp content type attribute is invalid")
+	}
+	if !digestOK {
+		return nil, errors.New("Timestamp message digest attribute does not match TSTInfo")
+	}
+
+	//签名计算在以SET OF标签编码的属性上，而非[0] IMPLICIT
+	signed := make([]byte, len(signer.SignedAttrs.FullBytes))
+	copy(signed, signer.SignedAttrs.FullBytes)
+	signed[0] = 0x31
+	return signed, nil
+}
+
+//在已登记的TSA证书中查找签名者
+func findTSA(stub shim.ChaincodeStubInterface, sid asn1.RawValue) (*x509.Certificate, error) {
+	iter, err := stub.GetStateByRange(TSA+"_", TSA+"_~")
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		var tsa TSACertificate
+		if err = json.Unmarshal(res.Value, &tsa); err != nil {
+			continue
+		}
+		cert, err := byteToCert([]byte(tsa.Certificate))
+		if err != nil {
+			continue
+		}
+		if matchSignerID(sid, cert) {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("Timestamp was not signed by a registered TSA")
+}
+
+func matchSignerID(sid asn1.RawValue, cert *x509.Certificate) bool {
+	if sid.Class == asn1.ClassContextSpecific && sid.Tag == 0 {
+		return len(cert.SubjectKeyId) > 0 && bytes.Equal(sid.Bytes, cert.SubjectKeyId)
+	}
+	var ias issuerAndSerialNumber
+	if _, err := asn1.Unmarshal(sid.FullBytes, &ias); err != nil {
+		return false
+	}
+	return bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && ias.SerialNumber.Cmp(cert.SerialNumber) == 0
+}
+
+func hashForOID(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("Unsupported digest algorithm %s", oid)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+
+	"com.jerry/contract/shimtest"
+	"com.jerry/contract/token"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func newIdentity(t *testing.T, attrs map[string]string) *shimtest.Identity {
+	id, err := shimtest.NewIdentity("Org1MSP", attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func checkBalance(t *testing.T, stub *shimtest.Stub, account, value string) {
+	payload, err := stub.Call("query", account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != value {
+		t.Fatal("balance of", account, "was", string(payload), "expecting", value)
+	}
+}
+
+func TestExample_Bridge(t *testing.T) {
+	alice := newIdentity(t, map[string]string{token.AccountAttr: "A"})
+	bob := newIdentity(t, map[string]string{token.AccountAttr: "B"})
+	issuer := newIdentity(t, map[string]string{token.IssuerAttr: "true"})
+	stub := shimtest.NewStub("example", new(SimpleChaincode)).As(alice)
+	if res := stub.Init("A", "100", "B", "0"); res.Status != shim.OK {
+		t.Fatal(res.Message)
+	}
+
+	if res := stub.InvokeVia("abac", "bridgeIn", "X", "B", "10"); res.Status == shim.OK {
+		t.Fatal("bridgeIn without a registered peer should fail")
+	}
+	if _, err := stub.Call("bridgeOut", "A", "X", "10"); err == nil {
+		t.Fatal("bridgeOut without a registered peer should fail")
+	}
+	checkBalance(t, stub, "A", "100")
+	if _, err := stub.Call("registerBridge", "abac"); err == nil {
+		t.Fatal("registerBridge without the issuer attribute should fail")
+	}
+	if _, err := stub.As(newIdentity(t, map[string]string{token.IssuerAttr: "false"})).Call("registerBridge", "abac"); err == nil {
+		t.Fatal("registerBridge by a non issuer should fail")
+	}
+	if _, err := stub.As(issuer).Call("registerBridge", "abac"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := stub.As(bob).Call("bridgeOut", "A", "X", "10"); err == nil {
+		t.Fatal("only the owner of A may bridge funds out of it")
+	}
+	checkBalance(t, stub, "A", "100")
+
+	stub.As(alice)
+	if _, err := stub.Call("bridgeIn", "X", "B", "10"); err == nil {
+		t.Fatal("bridgeIn called by a client should fail")
+	}
+	if res := stub.InvokeVia("other", "bridgeIn", "X", "B", "10"); res.Status == shim.OK {
+		t.Fatal("bridgeIn proposed to an unregistered chaincode should fail")
+	}
+	checkBalance(t, stub, "B", "0")
+	if res := stub.InvokeVia("abac", "bridgeIn", "X", "B", "10"); res.Status != shim.OK {
+		t.Fatal("bridgeIn from the peer failed", res.Message)
+	}
+	checkBalance(t, stub, "B", "10")
+}
+
+func TestExample_Invoke(t *testing.T) {
+	for _, storage := range []string{"", token.StorageDelta} {
+		alice := newIdentity(t, map[string]string{token.AccountAttr: "A"})
+		bob := newIdentity(t, map[string]string{token.AccountAttr: "B"})
+		stub := shimtest.NewStub("example", new(SimpleChaincode))
+		args := []string{"A", "100", "B", "0"}
+		if storage != "" {
+			args = append(args, "0", storage)
+		}
+		if res := stub.Init(args...); res.Status != shim.OK {
+			t.Fatal(res.Message)
+		}
+
+		if _, err := stub.Call("invoke", "A", "B", "10"); err == nil {
+			t.Fatal("transfer by a caller without an account should fail", storage)
+		}
+		if _, err := stub.As(bob).Call("invoke", "A", "B", "10"); err == nil {
+			t.Fatal("only the owner of A may transfer from it", storage)
+		}
+		if _, err := stub.As(alice).Call("invoke", "A", "B", "10"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stub.As(bob).Call("invoke", "B", "A", "4"); err != nil {
+			t.Fatal(err)
+		}
+		payload, err := stub.Call("balance", "B")
+		if err != nil || string(payload) != "6" {
+			t.Fatal("unexpected balance of B", string(payload), err, storage)
+		}
+	}
+}
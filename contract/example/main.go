@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"strconv"
+	"time"
 
+	"com.jerry/contract/bridge"
+	"com.jerry/contract/token"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
 
@@ -15,36 +19,41 @@ type SimpleChaincode struct {
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println("ex02 Init")
 	_, args := stub.GetFunctionAndParameters()
-	var A, B string    // Entities
-	var Aval, Bval int // Asset holdings
+	var A, B string       // Entities
+	var Aval, Bval string // Genesis allocations
+	var decimals int      // Token precision
 	var err error
 
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+	if len(args) < 4 || len(args) > 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 to 6")
 	}
 
 	// Initialize the chaincode
-	A = args[0]
-	Aval, err = strconv.Atoi(args[1])
-	if err != nil {
-		return shim.Error("Expecting integer value for asset holding")
-	}
-	B = args[2]
-	Bval, err = strconv.Atoi(args[3])
-	if err != nil {
-		return shim.Error("Expecting integer value for asset holding")
+	A, Aval = args[0], args[1]
+	B, Bval = args[2], args[3]
+	if len(args) >= 5 {
+		decimals, err = strconv.Atoi(args[4])
+		if err != nil {
+			return shim.Error("Expecting integer value for decimals")
+		}
 	}
-	fmt.Printf("Aval = %d, Bval = %d\n", Aval, Bval)
+	fmt.Printf("Aval = %s, Bval = %s\n", Aval, Bval)
 
-	// Write the state to the ledger
-	err = stub.PutState(A, []byte(strconv.Itoa(Aval)))
+	// Write the genesis allocation and total supply to the ledger
+	err = token.Genesis(stub, decimals, token.Allocation{Account: A, Amount: Aval}, token.Allocation{Account: B, Amount: Bval})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	err = stub.PutState(B, []byte(strconv.Itoa(Bval)))
-	if err != nil {
-		return shim.Error(err.Error())
+	// "delta" stores transfers as delta records for high throughput
+	if len(args) == 6 {
+		if args[5] != token.StorageDelta {
+			return shim.Error("Unknown storage mode " + args[5])
+		}
+		err = token.UseDeltas(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 	}
 
 	return shim.Success(nil)
@@ -62,61 +71,160 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	} else if function == "query" {
 		// the old "Query" is now implemtned in invoke
 		return t.query(stub, args)
+	} else if function == "mint" || function == "burn" {
+		// Issuers create or destroy tokens
+		return t.supply(stub, function, args)
+	} else if function == "approve" {
+		return t.approve(stub, args)
+	} else if function == "transferFrom" {
+		return t.transferFrom(stub, args)
+	} else if function == "allowance" {
+		return t.allowance(stub, args)
+	} else if function == "totalSupply" {
+		return t.totalSupply(stub, args)
+	} else if function == "decimals" {
+		return t.decimals(stub, args)
+	} else if function == "history" {
+		// Transfers of an account, paged with a bookmark
+		return t.history(stub, args)
+	} else if function == "balance" {
+		// Snapshot plus pending deltas
+		return t.balance(stub, args)
+	} else if function == "compact" {
+		// Folds the deltas of accounts into their snapshots
+		return t.compact(stub, args)
+	} else if function == "registerBridge" {
+		// Moves funds to and from the peer chaincode atomically
+		return t.registerBridge(stub, args)
+	} else if function == "bridgeOut" {
+		return t.bridgeOut(stub, args)
+	} else if function == bridge.InFunction {
+		return t.bridgeIn(stub, args)
 	}
 
-	return shim.Error("Invalid invoke function name. Expecting \"invoke\" \"delete\" \"query\"")
+	return shim.Error("Invalid invoke function name. Expecting \"invoke\" \"delete\" \"query\" \"mint\" \"burn\" \"approve\" \"transferFrom\" \"allowance\" \"totalSupply\" \"decimals\" \"history\" \"balance\" \"compact\" \"registerBridge\" \"bridgeOut\" \"bridgeIn\"")
 }
 
-// Transaction makes payment of X units from A to B
+// Transaction makes payment of X units from A to B; owner of A only
 func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var A, B string    // Entities
-	var Aval, Bval int // Asset holdings
-	var X int          // Transaction value
-	var err error
-
 	if len(args) != 3 {
 		return shim.Error("Incorrect number of arguments. Expecting 3")
 	}
 
+	deltas, err := token.Deltas(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if deltas {
+		// Write deltas, reading only the sender's balance
+		err = token.MoveDelta(stub, args[0], args[1], args[2])
+	} else {
+		// Move X units, failing if A does not hold enough
+		err = token.Move(stub, args[0], args[1], args[2])
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// Deletes an entity from state, its balance leaves the total supply; issuers only
+func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	err := settle(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = token.Remove(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// query callback representing the query of a chaincode
+func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var A string // Entities
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting name of the person to query")
+	}
+
 	A = args[0]
-	B = args[1]
 
-	// Get the state from the ledger
-	// TODO: will be nice to have a GetAllState call to ledger
-	Avalbytes, err := stub.GetState(A)
+	// Get the balance from the ledger, including pending deltas
+	Aval, err := token.Balance(stub, A)
+	if err == token.ErrAccountNotFound {
+		jsonResp := "{\"Error\":\"Nil amount for " + A + "\"}"
+		return shim.Error(jsonResp)
+	}
+	if err != nil {
+		jsonResp := "{\"Error\":\"Failed to get state for " + A + "\"}"
+		return shim.Error(jsonResp)
+	}
+	amount, err := token.Format(stub, Aval)
 	if err != nil {
-		return shim.Error("Failed to get state")
+		return shim.Error(err.Error())
 	}
-	if Avalbytes == nil {
-		return shim.Error("Entity not found")
+
+	jsonResp := "{\"Name\":\"" + A + "\",\"Amount\":\"" + amount + "\"}"
+	fmt.Printf("Query Response:%s\n", jsonResp)
+	return shim.Success([]byte(amount))
+}
+
+// supply mints X units to A or burns X units from A,
+// the caller must have the "token.issuer" attribute with a value of true
+func (t *SimpleChaincode) supply(stub shim.ChaincodeStubInterface, function string, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
-	Aval, _ = strconv.Atoi(string(Avalbytes))
 
-	Bvalbytes, err := stub.GetState(B)
+	var err error
+	if function == "mint" {
+		err = token.Mint(stub, args[0], args[1])
+	} else if err = settle(stub, args[0]); err == nil {
+		err = token.Burn(stub, args[0], args[1])
+	}
 	if err != nil {
-		return shim.Error("Failed to get state")
+		return shim.Error(err.Error())
 	}
-	if Bvalbytes == nil {
-		return shim.Error("Entity not found")
+
+	return shim.Success(nil)
+}
+
+// approve lets a spender move up to X units from the caller's account,
+// the caller's account is named by its "token.account" attribute
+func (t *SimpleChaincode) approve(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
-	Bval, _ = strconv.Atoi(string(Bvalbytes))
 
-	// Perform the execution
-	X, err = strconv.Atoi(args[2])
+	err := token.Approve(stub, args[0], args[1])
 	if err != nil {
-		return shim.Error("Invalid transaction amount, expecting a integer value")
+		return shim.Error(err.Error())
 	}
-	Aval = Aval - X
-	Bval = Bval + X
-	fmt.Printf("Aval = %d, Bval = %d\n", Aval, Bval)
 
-	// Write the state back to the ledger
-	err = stub.PutState(A, []byte(strconv.Itoa(Aval)))
+	return shim.Success(nil)
+}
+
+// transferFrom moves X units from A to B out of the caller's allowance
+func (t *SimpleChaincode) transferFrom(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	err := settle(stub, args[0])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	err = stub.PutState(B, []byte(strconv.Itoa(Bval)))
+	err = token.TransferFrom(stub, args[0], args[1], args[2])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -124,49 +232,134 @@ func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string
 	return shim.Success(nil)
 }
 
-// Deletes an entity from state
-func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+// allowance returns how much a spender may still move from an owner
+func (t *SimpleChaincode) allowance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting owner and spender")
+	}
+
+	v, err := token.Allowance(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := token.Format(stub, v)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	A := args[0]
+	return shim.Success([]byte(amount))
+}
 
-	// Delete the key from the state in ledger
-	err := stub.DelState(A)
+// totalSupply returns the number of tokens in circulation
+func (t *SimpleChaincode) totalSupply(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	v, err := token.TotalSupply(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := token.Format(stub, v)
 	if err != nil {
-		return shim.Error("Failed to delete state")
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success(nil)
+	return shim.Success([]byte(amount))
 }
 
-// query callback representing the query of a chaincode
-func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var A string // Entities
+// decimals returns the token precision chosen at init
+func (t *SimpleChaincode) decimals(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	decimals, err := token.Decimals(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(strconv.Itoa(decimals)))
+}
+
+// history returns the transfers of an account between two RFC 3339 times,
+// empty times leave the range open; pass the returned bookmark to get the next page
+func (t *SimpleChaincode) history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting account, from, to, pageSize and bookmark")
+	}
+
+	var from, to time.Time
 	var err error
+	if args[1] != "" {
+		from, err = time.Parse(time.RFC3339, args[1])
+		if err != nil {
+			return shim.Error("Expecting RFC 3339 time for from")
+		}
+	}
+	if args[2] != "" {
+		to, err = time.Parse(time.RFC3339, args[2])
+		if err != nil {
+			return shim.Error("Expecting RFC 3339 time for to")
+		}
+	}
+	pageSize, err := strconv.Atoi(args[3])
+	if err != nil {
+		return shim.Error("Expecting integer value for pageSize")
+	}
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting name of the person to query")
+	page, err := token.History(stub, args[0], from, to, pageSize, args[4])
+	if err != nil {
+		return shim.Error(err.Error())
 	}
+	pageBytes, _ := json.Marshal(page)
+	return shim.Success(pageBytes)
+}
 
-	A = args[0]
+// balance returns the balance of A summed from its snapshot and pending deltas
+func (t *SimpleChaincode) balance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting account")
+	}
 
-	// Get the state from the ledger
-	Avalbytes, err := stub.GetState(A)
+	v, err := token.Balance(stub, args[0])
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + A + "\"}"
-		return shim.Error(jsonResp)
+		return shim.Error(err.Error())
+	}
+	amount, err := token.Format(stub, v)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	if Avalbytes == nil {
-		jsonResp := "{\"Error\":\"Nil amount for " + A + "\"}"
-		return shim.Error(jsonResp)
+	return shim.Success([]byte(amount))
+}
+
+// compact folds the pending deltas of one or more accounts into their
+// snapshots; schedule it off-peak since it conflicts with concurrent transfers
+func (t *SimpleChaincode) compact(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) == 0 {
+		return shim.Error("Incorrect number of arguments. Expecting at least one account")
 	}
 
-	jsonResp := "{\"Name\":\"" + A + "\",\"Amount\":\"" + string(Avalbytes) + "\"}"
-	fmt.Printf("Query Response:%s\n", jsonResp)
-	return shim.Success(Avalbytes)
+	for _, account := range args {
+		_, err := token.Compact(stub, account)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	return shim.Success(nil)
+}
+
+// settle compacts accounts in delta storage before functions that debit
+// the snapshot directly
+func settle(stub shim.ChaincodeStubInterface, accounts ...string) error {
+	deltas, err := token.Deltas(stub)
+	if err != nil || !deltas {
+		return err
+	}
+	for _, account := range accounts {
+		_, err = token.Compact(stub, account)
+		if err == token.ErrAccountNotFound {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func main() {
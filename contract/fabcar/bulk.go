@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+ * Bulk import and export of cars as CSV or a JSON array of CarRow objects. A CSV starts
+ * with a header naming the columns, in any order: vin, make, model, colour, year and
+ * mileage are required, other columns such as the exported status and ownerId are
+ * ignored on import, so an export can be imported again as is.
+ */
+const (
+	formatCSV  = "csv"
+	formatJSON = "json"
+
+	// maxImportRows caps the number of cars written by one importCars call
+	maxImportRows = 500
+)
+
+var csvColumns = []string{"vin", "make", "model", "colour", "year", "mileage", "status", "ownerId"}
+
+// CarRow is a car as imported and exported in bulk
+type CarRow struct {
+	VIN     string `json:"vin"`
+	Make    string `json:"make"`
+	Model   string `json:"model"`
+	Colour  string `json:"colour"`
+	Year    int    `json:"year"`
+	Mileage int    `json:"mileage"`
+	Status  string `json:"status,omitempty"`  // export only
+	OwnerId string `json:"ownerId,omitempty"` // export only
+}
+
+// RowError reports why a row was not imported, rows count from 1 after any header
+type RowError struct {
+	Row   int    `json:"row"`
+	VIN   string `json:"vin"`
+	Error string `json:"error"`
+}
+
+// ImportResult counts what importCars did with each row
+type ImportResult struct {
+	Created   int         `json:"created"`
+	Updated   int         `json:"updated"`
+	Unchanged int         `json:"unchanged"`
+	Errors    []*RowError `json:"errors"`
+}
+
+// ExportPage is a page of exportCars results, Bookmark is empty on the last page
+type ExportPage struct {
+	Format   string    `json:"format"`
+	Cars     []*CarRow `json:"cars,omitempty"` // json format
+	CSV      string    `json:"csv,omitempty"`  // csv format, with a header
+	Count    int       `json:"fetchedRecordsCount"`
+	Bookmark string    `json:"bookmark"`
+}
+
+// parseCarRow reads the VIN, make, model, colour, year and mileage of a car
+func parseCarRow(fields []string) (*CarRow, error) {
+	year, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("Expecting integer value for year")
+	}
+	mileage, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("Expecting integer value for mileage")
+	}
+	return &CarRow{VIN: fields[0], Make: fields[1], Model: fields[2], Colour: fields[3],
+		Year: year, Mileage: mileage}, nil
+}
+
+// validate checks the fields every new car needs
+func (r *CarRow) validate(now time.Time) error {
+	if err := validateVIN(r.VIN); err != nil {
+		return err
+	}
+	for _, field := range []struct{ name, value string }{
+		{"make", r.Make}, {"model", r.Model}, {"colour", r.Colour},
+	} {
+		if field.value == "" {
+			return fmt.Errorf("The %s must not be empty", field.name)
+		}
+	}
+	// 1886 saw the first patented motor car, next year's models are sold already
+	if r.Year < 1886 || r.Year > now.Year()+1 {
+		return fmt.Errorf("Year must be between 1886 and %d", now.Year()+1)
+	}
+	if r.Mileage < 0 {
+		return fmt.Errorf("Expecting non-negative integer value for mileage")
+	}
+	return nil
+}
+
+/*
+ * importCars creates or updates cars in bulk. A row creates a new car owned by the caller,
+ * like createCar, or updates the make, model, colour, year and mileage of a car the caller
+ * owns, so importing the same data again changes nothing. Invalid rows are reported and
+ * skipped, the valid ones are written. Args: format (csv or json), data
+ */
+func (s *SmartContract) importCars(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting format and data")
+	}
+
+	result := &ImportResult{Errors: []*RowError{}}
+	var rows []*CarRow
+	var err error
+	if args[0] == formatCSV {
+		rows, err = readCSV(args[1], result)
+	} else if args[0] == formatJSON {
+		rows, err = readJSON(args[1], result)
+	} else {
+		err = fmt.Errorf("Format must be %s or %s", formatCSV, formatJSON)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(rows) > maxImportRows {
+		return shim.Error(fmt.Sprintf("At most %d rows can be imported at once", maxImportRows))
+	}
+
+	ownerId, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// A transaction does not read its own writes, so repeated VINs are caught here
+	seen := map[string]bool{}
+	for i, row := range rows {
+		if row == nil {
+			continue
+		}
+		err := importCar(APIstub, row, ownerId, now, seen, result)
+		if err != nil {
+			result.Errors = append(result.Errors, &RowError{Row: i + 1, VIN: row.VIN, Error: err.Error()})
+		}
+	}
+	sort.Slice(result.Errors, func(i, j int) bool { return result.Errors[i].Row < result.Errors[j].Row })
+
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// importCar writes one row and counts it in result, an error rejects the row
+func importCar(APIstub shim.ChaincodeStubInterface, row *CarRow, ownerId string, now time.Time, seen map[string]bool, result *ImportResult) error {
+	if err := row.validate(now); err != nil {
+		return err
+	}
+	if seen[row.VIN] {
+		return fmt.Errorf("Car %s appears more than once", row.VIN)
+	}
+	seen[row.VIN] = true
+
+	carAsBytes, err := APIstub.GetState(row.VIN)
+	if err != nil {
+		return err
+	}
+	if carAsBytes == nil {
+		car := &Car{Make: row.Make, Model: row.Model, Colour: row.Colour, OwnerId: ownerId,
+			Year: row.Year, Mileage: row.Mileage, MileageDate: now.UTC().Format(recordDateFormat), Status: statusRegistered}
+		if err = putCar(APIstub, row.VIN, nil, car); err != nil {
+			return err
+		}
+		result.Created++
+		return nil
+	}
+
+	car := toCar(row.VIN, carAsBytes)
+	if car == nil {
+		return fmt.Errorf("Key %s is not a car", row.VIN)
+	}
+	if car.OwnerId != ownerId {
+		return fmt.Errorf("Car %s belongs to another identity", row.VIN)
+	}
+	if row.Mileage < car.Mileage {
+		return fmt.Errorf("Car %s has a recorded mileage of %d", row.VIN, car.Mileage)
+	}
+	if car.Make == row.Make && car.Model == row.Model && car.Colour == row.Colour &&
+		car.Year == row.Year && car.Mileage == row.Mileage {
+		result.Unchanged++
+		return nil
+	}
+
+	old := *car
+	if row.Mileage != car.Mileage {
+		car.MileageDate = now.UTC().Format(recordDateFormat)
+	}
+	car.Make, car.Model, car.Colour, car.Year, car.Mileage = row.Make, row.Model, row.Colour, row.Year, row.Mileage
+	if err = putCar(APIstub, row.VIN, &old, car); err != nil {
+		return err
+	}
+	result.Updated++
+	return nil
+}
+
+// readCSV parses the rows of a CSV with a header, reporting rows it can not read
+// in result and leaving a nil row in their place
+func readCSV(data string, result *ImportResult) ([]*CarRow, error) {
+	reader := csv.NewReader(strings.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CSV: %s", err.Error())
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("The CSV has no header")
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	order := make([]int, 6)
+	for i, name := range csvColumns[:6] {
+		col, ok := columns[name]
+		if !ok {
+			return nil, fmt.Errorf("The CSV header has no %s column", name)
+		}
+		order[i] = col
+	}
+
+	rows := make([]*CarRow, 0, len(records)-1)
+	for i, record := range records[1:] {
+		if len(record) != len(records[0]) {
+			result.Errors = append(result.Errors, &RowError{Row: i + 1,
+				Error: fmt.Sprintf("Expecting %d fields, found %d", len(records[0]), len(record))})
+			rows = append(rows, nil)
+			continue
+		}
+		fields := make([]string, len(order))
+		for j, col := range order {
+			fields[j] = record[col]
+		}
+		row, err := parseCarRow(fields)
+		if err != nil {
+			result.Errors = append(result.Errors, &RowError{Row: i + 1, VIN: fields[0], Error: err.Error()})
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// readJSON parses a JSON array of CarRow objects, reporting rows it can not read
+// in result and leaving a nil row in their place
+func readJSON(data string, result *ImportResult) ([]*CarRow, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, fmt.Errorf("Expecting a JSON array of cars: %s", err.Error())
+	}
+
+	rows := make([]*CarRow, 0, len(raw))
+	for i, item := range raw {
+		row := &CarRow{}
+		if err := json.Unmarshal(item, row); err != nil {
+			result.Errors = append(result.Errors, &RowError{Row: i + 1, Error: err.Error()})
+			row = nil
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+/*
+ * exportCars returns a page of all cars as CSV or JSON rows, in key order. Pass the returned
+ * bookmark to get the next page. Args: format (csv or json), pageSize, bookmark
+ */
+func (s *SmartContract) exportCars(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting format, pageSize and bookmark")
+	}
+	if args[0] != formatCSV && args[0] != formatJSON {
+		return shim.Error("Format must be " + formatCSV + " or " + formatJSON)
+	}
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	page, err := findCars(APIstub, &CarFilter{}, pageSize, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	export := &ExportPage{Format: args[0], Count: page.Count, Bookmark: page.Bookmark}
+	rows := make([]*CarRow, 0, len(page.Records))
+	for _, res := range page.Records {
+		car := res.Record
+		rows = append(rows, &CarRow{VIN: res.Key, Make: car.Make, Model: car.Model, Colour: car.Colour, Year: car.Year, Mileage: car.Mileage, Status: car.Status, OwnerId: car.OwnerId})
+	}
+	if args[0] == formatJSON {
+		export.Cars = rows
+	} else {
+		var buffer bytes.Buffer
+		writer := csv.NewWriter(&buffer)
+		writer.Write(csvColumns)
+		for _, row := range rows {
+			writer.Write([]string{row.VIN, row.Make, row.Model, row.Colour,
+				strconv.Itoa(row.Year), strconv.Itoa(row.Mileage), row.Status, row.OwnerId})
+		}
+		writer.Flush()
+		if err = writer.Error(); err != nil {
+			return shim.Error(err.Error())
+		}
+		export.CSV = buffer.String()
+	}
+
+	exportAsBytes, _ := json.Marshal(export)
+	return shim.Success(exportAsBytes)
+}
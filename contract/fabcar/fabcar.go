@@ -1,16 +1,16 @@
 package main
 
 /* Imports
- * 4 utility libraries for formatting, handling bytes, reading and writing JSON, and string manipulation
+ * 3 utility libraries for formatting, handling bytes and reading and writing JSON
  * 2 specific Hyperledger Fabric specific libraries for Smart Contracts
  */
 import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"strconv"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
 
@@ -18,12 +18,27 @@ import (
 type SmartContract struct {
 }
 
+// carDocType marks car documents for CouchDB selector queries and indexes
+const carDocType = "car"
+
 // Define the car structure, with 4 properties.  Structure tags are used by encoding/json library
 type Car struct {
-	Make   string `json:"make"`
-	Model  string `json:"model"`
-	Colour string `json:"colour"`
-	Owner  string `json:"owner"`
+	DocType     string         `json:"docType"`
+	Make        string         `json:"make"`
+	Model       string         `json:"model"`
+	Colour      string         `json:"colour"`
+	OwnerId     string         `json:"ownerId"`   // mspId/id of the owner's client identity
+	OwnerHash   string         `json:"ownerHash"` // hash of the owner's private details, empty until they register
+	Custodian   string         `json:"custodian"` // mspId/id of who holds the car, the lessee during a lease
+	Year        int            `json:"year"`
+	Mileage     int            `json:"mileage"`
+	MileageDate string         `json:"mileageDate,omitempty"` // YYYY-MM-DD of the Mileage reading, empty on older cars
+	Status      string         `json:"status"`
+	Offer       *TransferOffer `json:"offer,omitempty"`
+	Lease       *Lease         `json:"lease,omitempty"`
+
+	// OdometerRollback is set once a workshop reading contradicts the recorded ones
+	OdometerRollback bool `json:"odometerRollback"`
 }
 
 /*
@@ -31,6 +46,13 @@ type Car struct {
  * Best practice is to have any Ledger initialization in separate function -- see initLedger()
  */
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+	// An optional JSON array names the MSP ids allowed to read every owner's details
+	_, args := APIstub.GetFunctionAndParameters()
+	if len(args) > 0 && args[0] != "" {
+		if err := putOwnerReaders(APIstub, args[0]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	return shim.Success(nil)
 }
 
@@ -51,8 +73,54 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.createCar(APIstub, args)
 	} else if function == "queryAllCars" {
 		return s.queryAllCars(APIstub)
-	} else if function == "changeCarOwner" {
-		return s.changeCarOwner(APIstub, args)
+	} else if function == "offerTransfer" {
+		return s.offerTransfer(APIstub, args)
+	} else if function == "acceptTransfer" {
+		return s.acceptTransfer(APIstub, args)
+	} else if function == "declineTransfer" {
+		return s.declineTransfer(APIstub, args)
+	} else if function == "cancelTransfer" {
+		return s.cancelTransfer(APIstub, args)
+	} else if function == "getCarHistory" {
+		return s.getCarHistory(APIstub, args)
+	} else if function == "setCarStatus" {
+		return s.setCarStatus(APIstub, args)
+	} else if function == "addCarRecord" {
+		return s.addCarRecord(APIstub, args)
+	} else if function == "getCarRecords" {
+		return s.getCarRecords(APIstub, args)
+	} else if function == "createListing" {
+		return s.createListing(APIstub, args)
+	} else if function == "placeBid" {
+		return s.placeBid(APIstub, args)
+	} else if function == "withdrawBid" {
+		return s.withdrawBid(APIstub, args)
+	} else if function == "getListing" {
+		return s.getListing(APIstub, args)
+	} else if function == "getBids" {
+		return s.getBids(APIstub, args)
+	} else if function == "acceptBid" {
+		return s.acceptBid(APIstub, args)
+	} else if function == "cancelListing" {
+		return s.cancelListing(APIstub, args)
+	} else if function == "queryCars" {
+		return s.queryCars(APIstub, args)
+	} else if function == "richQueryCars" {
+		return s.richQueryCars(APIstub, args)
+	} else if function == "importCars" {
+		return s.importCars(APIstub, args)
+	} else if function == "exportCars" {
+		return s.exportCars(APIstub, args)
+	} else if function == "registerOwner" {
+		return s.registerOwner(APIstub)
+	} else if function == "getOwner" {
+		return s.getOwner(APIstub, args)
+	} else if function == "createLease" {
+		return s.createLease(APIstub, args)
+	} else if function == "endLease" {
+		return s.endLease(APIstub, args)
+	} else if function == "rebuildIndexes" {
+		return s.rebuildIndexes(APIstub, args)
 	}
 
 	return shim.Error("Invalid Smart Contract function name.")
@@ -65,28 +133,86 @@ func (s *SmartContract) queryCar(APIstub shim.ChaincodeStubInterface, args []str
 	}
 
 	carAsBytes, _ := APIstub.GetState(args[0])
+	car := toCar(args[0], carAsBytes)
+	if car == nil {
+		return shim.Success(carAsBytes)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	car.expireLease(now)
+	details, err := joinOwner(APIstub, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	carAsBytes, _ = json.Marshal(&CarView{Car: car, OwnerDetails: details})
 	return shim.Success(carAsBytes)
 }
 
+/*
+ * initLedger seeds ten cars owned by the calling identity, admins only. It runs once,
+ * failing if any of the seed cars already exists.
+ */
 func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Response {
+	if err := cid.AssertAttributeValue(APIstub, adminAttr, "true"); err != nil {
+		return shim.Error("Only admins with the " + adminAttr + " attribute can seed the ledger")
+	}
+	ownerId, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	cars := []Car{
-		{Make: "Toyota", Model: "Prius", Colour: "blue", Owner: "Tomoko"},
-		{Make: "Ford", Model: "Mustang", Colour: "red", Owner: "Brad"},
-		{Make: "Hyundai", Model: "Tucson", Colour: "green", Owner: "Jin Soo"},
-		{Make: "Volkswagen", Model: "Passat", Colour: "yellow", Owner: "Max"},
-		{Make: "Tesla", Model: "S", Colour: "black", Owner: "Adriana"},
-		{Make: "Peugeot", Model: "205", Colour: "purple", Owner: "Michel"},
-		{Make: "Chery", Model: "S22L", Colour: "white", Owner: "Aarav"},
-		{Make: "Fiat", Model: "Punto", Colour: "violet", Owner: "Pari"},
-		{Make: "Tata", Model: "Nano", Colour: "indigo", Owner: "Valeria"},
-		{Make: "Holden", Model: "Barina", Colour: "brown", Owner: "Shotaro"},
+		{Make: "Toyota", Model: "Prius", Colour: "blue", Year: 2010, Mileage: 120000},
+		{Make: "Ford", Model: "Mustang", Colour: "red", Year: 2018, Mileage: 30000},
+		{Make: "Hyundai", Model: "Tucson", Colour: "green", Year: 2016, Mileage: 65000},
+		{Make: "Volkswagen", Model: "Passat", Colour: "yellow", Year: 2014, Mileage: 98000},
+		{Make: "Tesla", Model: "S", Colour: "black", Year: 2017, Mileage: 42000},
+		{Make: "Peugeot", Model: "205", Colour: "purple", Year: 2010, Mileage: 150000},
+		{Make: "Chery", Model: "S22L", Colour: "white", Year: 2010, Mileage: 88000},
+		{Make: "Fiat", Model: "Punto", Colour: "violet", Year: 2000, Mileage: 210000},
+		{Make: "Tata", Model: "Nano", Colour: "indigo", Year: 2000, Mileage: 45000},
+		{Make: "Holden", Model: "Barina", Colour: "brown", Year: 2010, Mileage: 76000},
+	}
+	vins := []string{
+		"JTDKB20U9A3000001",
+		"1FA6P8TH9J5100002",
+		"KM8J33A40GU200003",
+		"WVWZZZ3C20E300004",
+		"5YJSA1E2XHF400005",
+		"VF3CA5FV7AJ500006",
+		"LVVDC11B1AD600007",
+		"ZFA18800400700008",
+		"MAT60000700800009",
+		"6G1TB68B4AL900010",
+	}
+
+	for _, vin := range vins {
+		carAsBytes, err := APIstub.GetState(vin)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if carAsBytes != nil {
+			return shim.Error("Car " + vin + " already exists")
+		}
 	}
 
 	i := 0
 	for i < len(cars) {
 		fmt.Println("i is ", i)
-		carAsBytes, _ := json.Marshal(cars[i])
-		APIstub.PutState("CAR"+strconv.Itoa(i), carAsBytes)
+		cars[i].OwnerId = ownerId
+		cars[i].Status = statusInService
+		cars[i].MileageDate = now.UTC().Format(recordDateFormat)
+		err := putCar(APIstub, vins[i], nil, &cars[i])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 		fmt.Println("Added", cars[i])
 		i = i + 1
 	}
@@ -94,30 +220,64 @@ func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Respo
 	return shim.Success(nil)
 }
 
+/*
+ * createCar registers a new car under its VIN, owned by the caller. Args: VIN, make, model, colour, year, mileage
+ */
 func (s *SmartContract) createCar(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 5 {
-		return shim.Error("Incorrect number of arguments. Expecting 5")
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 6")
+	}
+
+	row, err := parseCarRow(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = row.validate(now)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	var car = Car{Make: args[1], Model: args[2], Colour: args[3], Owner: args[4]}
+	carAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if carAsBytes != nil {
+		return shim.Error("Car " + args[0] + " already exists")
+	}
 
-	carAsBytes, _ := json.Marshal(car)
-	APIstub.PutState(args[0], carAsBytes)
+	ownerId, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// The calling identity owns the new car and can offer it to others
+	var car = Car{Make: row.Make, Model: row.Model, Colour: row.Colour, OwnerId: ownerId,
+		Year: row.Year, Mileage: row.Mileage, MileageDate: now.UTC().Format(recordDateFormat), Status: statusRegistered}
+
+	err = putCar(APIstub, args[0], nil, &car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
 func (s *SmartContract) queryAllCars(APIstub shim.ChaincodeStubInterface) sc.Response {
 
-	startKey := "CAR0"
-	endKey := "CAR999"
-
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	// An open range returns every car whatever its key, index entries are skipped below
+	resultsIterator, err := APIstub.GetStateByRange("", "")
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	defer resultsIterator.Close()
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// buffer is a JSON array containing QueryResults
 	var buffer bytes.Buffer
@@ -129,6 +289,11 @@ func (s *SmartContract) queryAllCars(APIstub shim.ChaincodeStubInterface) sc.Res
 		if err != nil {
 			return shim.Error(err.Error())
 		}
+		car := toCar(queryResponse.Key, queryResponse.Value)
+		if car == nil {
+			continue
+		}
+		car.expireLease(now)
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
 			buffer.WriteString(",")
@@ -139,8 +304,9 @@ func (s *SmartContract) queryAllCars(APIstub shim.ChaincodeStubInterface) sc.Res
 		buffer.WriteString("\"")
 
 		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
+		// Record is the car as of this transaction, without a lease that has ended
+		carAsBytes, _ := json.Marshal(car)
+		buffer.Write(carAsBytes)
 		buffer.WriteString("}")
 		bArrayMemberAlreadyWritten = true
 	}
@@ -151,24 +317,6 @@ func (s *SmartContract) queryAllCars(APIstub shim.ChaincodeStubInterface) sc.Res
 	return shim.Success(buffer.Bytes())
 }
 
-func (s *SmartContract) changeCarOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
-
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
-	}
-
-	carAsBytes, _ := APIstub.GetState(args[0])
-	car := Car{}
-
-	json.Unmarshal(carAsBytes, &car)
-	car.Owner = args[1]
-
-	carAsBytes, _ = json.Marshal(car)
-	APIstub.PutState(args[0], carAsBytes)
-
-	return shim.Success(nil)
-}
-
 // The main function is only relevant in unit test mode. Only included here for completeness.
 func main() {
 
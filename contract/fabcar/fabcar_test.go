@@ -0,0 +1,960 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"com.jerry/contract/shimtest"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+)
+
+func newIdentity(t *testing.T, mspID string, attrs map[string]string) *shimtest.Identity {
+	id, err := shimtest.NewIdentity(mspID, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// clientId is the owner id fabcar records for id
+func clientId(t *testing.T, id *shimtest.Identity) string {
+	cid, err := id.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id.MSPID + "/" + cid
+}
+
+func newStub(t *testing.T) *shimtest.Stub {
+	stub := shimtest.NewStub("fabcar", new(SmartContract)).As(newIdentity(t, "Org1MSP", nil))
+	if res := stub.Init(); res.Status != shim.OK {
+		t.Fatal("Init failed", res.Message)
+	}
+	return stub
+}
+
+func queryCar(t *testing.T, stub *shimtest.Stub, key string) *Car {
+	payload, err := stub.Call("queryCar", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var car Car
+	if err = json.Unmarshal(payload, &car); err != nil {
+		t.Fatal(key, err)
+	}
+	return &car
+}
+
+func queryCars(t *testing.T, stub *shimtest.Stub, filter, pageSize, bookmark string) *CarPage {
+	payload, err := stub.Call("queryCars", filter, pageSize, bookmark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page CarPage
+	if err = json.Unmarshal(payload, &page); err != nil {
+		t.Fatal(err)
+	}
+	return &page
+}
+
+func TestFabcar_QueryCars(t *testing.T) {
+	stub := newStub(t)
+	if _, err := stub.Call("initLedger"); err == nil {
+		t.Fatal("initLedger by a non admin should fail")
+	}
+	admin := newIdentity(t, "Org1MSP", map[string]string{adminAttr: "true"})
+	if _, err := stub.As(admin).Call("initLedger"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.As(newIdentity(t, "Org1MSP", map[string]string{adminAttr: "true"})).Call("initLedger"); err == nil {
+		t.Fatal("initLedger must not overwrite the seeded cars")
+	}
+	if car := queryCar(t, stub, "JTDKB20U9A3000001"); car.OwnerId != clientId(t, admin) {
+		t.Fatal("a second initLedger should leave the owner", car)
+	}
+	tomoko := newIdentity(t, "Org1MSP", nil)
+	stub.As(tomoko)
+	if _, err := stub.Call("createCar", "2T1BURHE2JC000011", "Toyota", "Corolla", "blue", "2018", "20000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.Call("createCar", "3FADP4BJ2EM000022", "Ford", "Fiesta", "blue", "2014", "80000"); err != nil {
+		t.Fatal(err)
+	}
+
+	var all []*QueryResult
+	payload, err := stub.Call("queryAllCars")
+	if err != nil || json.Unmarshal(payload, &all) != nil || len(all) != 12 {
+		t.Fatal("queryAllCars should return every car", len(all), err)
+	}
+
+	page := queryCars(t, stub, `{"colour":"blue"}`, "10", "")
+	if page.Count != 3 || page.Bookmark != "" {
+		t.Fatal("expecting 3 blue cars", page)
+	}
+	page = queryCars(t, stub, `{"ownerId":"`+clientId(t, tomoko)+`","colour":"blue"}`, "10", "")
+	if page.Count != 2 {
+		t.Fatal("expecting 2 blue cars of Tomoko", page)
+	}
+
+	// page through all cars two at a time
+	seen := map[string]bool{}
+	bookmark := ""
+	for {
+		page = queryCars(t, stub, "", "2", bookmark)
+		for _, r := range page.Records {
+			seen[r.Key] = true
+		}
+		if page.Bookmark == "" {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+	if len(seen) != 12 {
+		t.Fatal("pagination should visit every car once", len(seen))
+	}
+
+	buyer := newIdentity(t, "Org1MSP", nil)
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if _, err = stub.Call("offerTransfer", "2T1BURHE2JC000011", clientId(t, buyer), expires); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stub.As(buyer).Call("acceptTransfer", "2T1BURHE2JC000011"); err != nil {
+		t.Fatal(err)
+	}
+	if page = queryCars(t, stub, `{"ownerId":"`+clientId(t, tomoko)+`"}`, "10", ""); page.Count != 1 || page.Records[0].Key != "3FADP4BJ2EM000022" {
+		t.Fatal("the owner index should follow the new owner", page)
+	}
+	if page = queryCars(t, stub, `{"ownerId":"`+clientId(t, buyer)+`","make":"Toyota"}`, "10", ""); page.Count != 1 || page.Records[0].Key != "2T1BURHE2JC000011" {
+		t.Fatal("expecting the Corolla of the buyer", page)
+	}
+	if _, err = stub.Call("queryCars", "", "0", ""); err == nil {
+		t.Fatal("page size 0 should fail")
+	}
+}
+
+func TestFabcar_Transfer(t *testing.T) {
+	owner := newIdentity(t, "Org1MSP", nil)
+	stub := newStub(t).As(owner)
+	buyer := newIdentity(t, "Org2MSP", nil)
+	vin := "1FATP8FF4K5000033"
+	other := newIdentity(t, "Org1MSP", nil)
+	if _, err := stub.Call("createCar", vin, "Ford", "Mustang", "red", "2019", "15000"); err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	if _, err := stub.As(other).Call("offerTransfer", vin, clientId(t, other), expires); err == nil {
+		t.Fatal("only the owner may offer a car")
+	}
+	stub.As(owner)
+	if _, err := stub.Call("offerTransfer", "1HGCM82633A004352", clientId(t, buyer), expires); err == nil {
+		t.Fatal("offering a missing car should fail")
+	}
+	if _, err := stub.Call("offerTransfer", vin, clientId(t, buyer), "2000-01-01T00:00:00Z"); err == nil {
+		t.Fatal("an offer expiring in the past should fail")
+	}
+	if _, err := stub.Call("offerTransfer", vin, clientId(t, buyer), expires); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.As(other).Call("acceptTransfer", vin); err == nil {
+		t.Fatal("only the recipient may accept")
+	}
+	if _, err := stub.As(buyer).Call("declineTransfer", vin); err != nil {
+		t.Fatal(err)
+	}
+	if car := queryCar(t, stub, vin); car.Offer != nil || car.OwnerId != clientId(t, owner) {
+		t.Fatal("declined offer should leave the owner", car)
+	}
+	if _, err := stub.Call("acceptTransfer", vin); err == nil {
+		t.Fatal("accepting without an offer should fail")
+	}
+
+	// an offer accepted after it has expired
+	if _, err := stub.As(owner).Call("offerTransfer", vin, clientId(t, buyer), expires); err != nil {
+		t.Fatal(err)
+	}
+	stub.Advance(2 * time.Hour)
+	if _, err := stub.As(buyer).Call("acceptTransfer", vin); err == nil {
+		t.Fatal("an expired offer should not be accepted")
+	}
+	if _, err := stub.As(buyer).Call("cancelTransfer", vin); err == nil {
+		t.Fatal("only the owner may cancel an offer")
+	}
+	if _, err := stub.As(owner).Call("cancelTransfer", vin); err != nil {
+		t.Fatal(err)
+	}
+	if car := queryCar(t, stub, vin); car.Offer != nil {
+		t.Fatal("cancelled offer should be dropped", car)
+	}
+	if _, err := stub.Call("cancelTransfer", vin); err == nil {
+		t.Fatal("cancelling without an offer should fail")
+	}
+
+	expires = stub.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if _, err := stub.As(owner).Call("offerTransfer", vin, clientId(t, buyer), expires); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.As(buyer).Call("acceptTransfer", vin); err != nil {
+		t.Fatal(err)
+	}
+	car := queryCar(t, stub, vin)
+	if car.OwnerId != clientId(t, buyer) || car.Offer != nil {
+		t.Fatal("the buyer should own the car", car)
+	}
+	if _, err := stub.As(owner).Call("offerTransfer", vin, clientId(t, other), expires); err == nil {
+		t.Fatal("the previous owner can no longer offer the car")
+	}
+}
+
+// historyStub returns a fixed history for every key, MockStub does not implement GetHistoryForKey
+type historyStub struct {
+	*shim.MockStub
+	history []*queryresult.KeyModification
+}
+
+func (h *historyStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{mods: h.history}, nil
+}
+
+type historyIterator struct {
+	mods []*queryresult.KeyModification
+}
+
+func (it *historyIterator) HasNext() bool { return len(it.mods) > 0 }
+
+func (it *historyIterator) Close() error { return nil }
+
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	mod := it.mods[0]
+	it.mods = it.mods[1:]
+	return mod, nil
+}
+
+func TestFabcar_History(t *testing.T) {
+	vin := "1FATP8FF4K5000033"
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	mod := func(i int, ownerId string, offer *TransferOffer) *queryresult.KeyModification {
+		carAsBytes, _ := json.Marshal(&Car{DocType: carDocType, Make: "Ford", OwnerId: ownerId, Offer: offer})
+		ts, _ := ptypes.TimestampProto(start.Add(time.Duration(i) * time.Hour))
+		return &queryresult.KeyModification{TxId: "tx" + strconv.Itoa(i), Value: carAsBytes, Timestamp: ts}
+	}
+	stub := &historyStub{MockStub: shim.NewMockStub("fabcar", new(SmartContract)), history: []*queryresult.KeyModification{
+		mod(0, "Org1MSP/alice", nil),
+		mod(1, "Org1MSP/alice", &TransferOffer{To: "Org2MSP/bob"}),
+		mod(2, "Org2MSP/bob", nil),
+		{TxId: "tx3", IsDelete: true},
+		mod(4, "Org1MSP/alice", nil),
+	}}
+
+	res := new(SmartContract).getCarHistory(stub, []string{vin})
+	if res.Status != shim.OK {
+		t.Fatal(res.Message)
+	}
+	var owners []*Ownership
+	if err := json.Unmarshal(res.Payload, &owners); err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 3 {
+		t.Fatal("expecting 3 changes of owner", string(res.Payload))
+	}
+	for i, want := range []struct{ txId, ownerId string }{{"tx0", "Org1MSP/alice"}, {"tx2", "Org2MSP/bob"}, {"tx4", "Org1MSP/alice"}} {
+		if owners[i].TxId != want.txId || owners[i].OwnerId != want.ownerId {
+			t.Fatal("unexpected owner", i, owners[i])
+		}
+	}
+	if !owners[1].Timestamp.Equal(start.Add(2 * time.Hour)) {
+		t.Fatal("owners should carry the time of their transaction", owners[1].Timestamp)
+	}
+}
+
+func TestFabcar_RebuildIndexes(t *testing.T) {
+	stub := newStub(t)
+	admin := newIdentity(t, "Org1MSP", map[string]string{adminAttr: "true"})
+	tomoko := newIdentity(t, "Org1MSP", nil)
+
+	// cars written before owner ids only named their owner
+	stub.MockTransactionStart("legacy")
+	stub.PutState("CAR0", []byte(`{"make":"Toyota","model":"Prius","colour":"blue","owner":"Tomoko"}`))
+	stub.PutState("CAR1", []byte(`{"make":"Ford","model":"Mustang","colour":"red","owner":"Brad"}`))
+	stub.MockTransactionEnd("legacy")
+
+	if _, err := stub.Call("rebuildIndexes"); err == nil {
+		t.Fatal("only admins may rebuild the indexes")
+	}
+	if _, err := stub.As(admin).Call("rebuildIndexes", "not json"); err == nil {
+		t.Fatal("owner ids must be a JSON object")
+	}
+	count, err := stub.Call("rebuildIndexes", `{"Tomoko":"`+clientId(t, tomoko)+`"}`)
+	if err != nil || string(count) != "2" {
+		t.Fatal("expecting 2 cars rewritten", string(count), err)
+	}
+	if car := queryCar(t, stub, "CAR0"); car.OwnerId != clientId(t, tomoko) || car.Custodian != car.OwnerId {
+		t.Fatal("mapped owner should own the car", car)
+	}
+	if car := queryCar(t, stub, "CAR1"); car.OwnerId != "" {
+		t.Fatal("unmapped owner should leave the car without owner", car)
+	}
+	if page := queryCars(t, stub, `{"ownerId":"`+clientId(t, tomoko)+`"}`, "10", ""); page.Count != 1 || page.Records[0].Key != "CAR0" {
+		t.Fatal("the car should be indexed under its owner id", page)
+	}
+	for key, indexed := range map[string]bool{"CAR0": false, "CAR1": true} {
+		unowned, _ := stub.CreateCompositeKey(ownerIndex, []string{"", key})
+		if _, ok := stub.State[unowned]; ok != indexed {
+			t.Fatal("only the unmapped car should stay indexed without owner", key)
+		}
+	}
+
+	// the new owner can now offer the car
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if _, err = stub.As(tomoko).Call("offerTransfer", "CAR0", clientId(t, admin), expires); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateVIN(t *testing.T) {
+	for _, vin := range []string{"1HGCM82633A004352", "5YJSA1E2XHF400005", "1FATP8FF4K5000033"} {
+		if err := validateVIN(vin); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, vin := range []string{"1HGCM82643A004352", "1HGCM82633A00435", "1HGCM82633A0043520", "1HGCM8263OA004352", "1hgcm82633a004352"} {
+		if validateVIN(vin) == nil {
+			t.Errorf("%s should be rejected", vin)
+		}
+	}
+}
+
+func TestFabcar_Lifecycle(t *testing.T) {
+	owner := newIdentity(t, "Org1MSP", nil)
+	stub := newStub(t).As(owner)
+	vin := "1HGCM82633A004352"
+	for _, args := range [][]string{
+		{"1HGCM82643A004352", "Honda", "Accord", "silver", "2003", "1000"},
+		{vin, "Honda", "Accord", "silver", "1885", "1000"},
+		{vin, "Honda", "Accord", "silver", "2003", "-1"},
+		{vin, "", "Accord", "silver", "2003", "1000"},
+	} {
+		if _, err := stub.Call("createCar", args...); err == nil {
+			t.Error("createCar should fail", args)
+		}
+	}
+	if _, err := stub.Call("createCar", vin, "Honda", "Accord", "silver", "2003", "1000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.Call("createCar", vin, "Honda", "Civic", "red", "2004", "0"); err == nil {
+		t.Fatal("a duplicate VIN should be rejected")
+	}
+	if car := queryCar(t, stub, vin); car.Status != statusRegistered || car.Year != 2003 || car.Mileage != 1000 {
+		t.Fatal("unexpected new car", car)
+	}
+
+	if _, err := stub.As(newIdentity(t, "Org1MSP", nil)).Call("setCarStatus", vin, statusStolen); err == nil {
+		t.Fatal("only the owner may change the status")
+	}
+	stub.As(owner)
+	for _, step := range []struct {
+		status string
+		legal  bool
+	}{
+		{"parked", false},
+		{statusInService, true},
+		{statusRegistered, false},
+		{statusStolen, true},
+		{statusInService, true},
+		{statusScrapped, true},
+		{statusInService, false},
+	} {
+		_, err := stub.Call("setCarStatus", vin, step.status)
+		if (err == nil) != step.legal {
+			t.Fatalf("moving to %s: expected legal=%v, got %v", step.status, step.legal, err)
+		}
+	}
+}
+
+func TestFabcar_Records(t *testing.T) {
+	owner := newIdentity(t, "Org1MSP", nil)
+	stub := newStub(t).As(owner)
+	vin := "1HGCM82633A004352"
+	if _, err := stub.Call("createCar", vin, "Honda", "Accord", "silver", "2003", "1000"); err != nil {
+		t.Fatal(err)
+	}
+	workshop := newIdentity(t, "Org1MSP", map[string]string{workshopAttr: "Joe's Garage"})
+	hash := strings.Repeat("ab", 32)
+	// Records are dated in the year after the car was registered
+	registered := stub.Now()
+	day := func(n int) string { return registered.AddDate(0, 0, n).UTC().Format(recordDateFormat) }
+	stub.Advance(365 * 24 * time.Hour)
+
+	if _, err := stub.Call("addCarRecord", vin, recordMaintenance, "5000", "2020-01-02", "oil change", hash); err == nil {
+		t.Fatal("only workshops may add records")
+	}
+	stub.As(workshop)
+	for _, args := range [][]string{
+		{vin, "tuning", "5000", "2020-01-02", "oil change", hash},
+		{vin, recordMaintenance, "-1", "2020-01-02", "oil change", hash},
+		{vin, recordMaintenance, "5000", "02/01/2020", "oil change", hash},
+		{vin, recordMaintenance, "5000", "2999-01-01", "oil change", hash},
+		{vin, recordMaintenance, "5000", "2020-01-02", "oil change", "abc"},
+		{"1FATP8FF4K5000033", recordMaintenance, "5000", "2020-01-02", "oil change", hash},
+	} {
+		if _, err := stub.Call("addCarRecord", args...); err == nil {
+			t.Error("addCarRecord should fail", args)
+		}
+	}
+	if _, err := stub.Call("addCarRecord", vin, recordMaintenance, "5000", day(10), "oil change", hash); err != nil {
+		t.Fatal(err)
+	}
+	if car := queryCar(t, stub, vin); car.Mileage != 5000 || car.OdometerRollback {
+		t.Fatal("the mileage should follow the odometer", car)
+	}
+	if _, err := stub.Call("addCarRecord", vin, recordAccident, "4000", day(20), "rear bumper", hash); err != nil {
+		t.Fatal(err)
+	}
+	if car := queryCar(t, stub, vin); car.Mileage != 5000 || !car.OdometerRollback {
+		t.Fatal("a lower reading should flag a rollback", car)
+	}
+
+	payload, err := stub.Call("getCarRecords", vin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []*CarRecord
+	if err = json.Unmarshal(payload, &records); err != nil || len(records) != 2 {
+		t.Fatal("expecting 2 records", string(payload), err)
+	}
+	if records[0].Type != recordMaintenance || records[0].Rollback || records[1].Type != recordAccident || !records[1].Rollback || records[1].Workshop != "Joe's Garage" {
+		t.Fatal("unexpected record log", string(payload))
+	}
+
+	// Records entered late are compared by date, not with the current mileage
+	type reading struct {
+		odometer, date string
+		rollback       bool
+	}
+	addRecords := func(vin string, readings ...reading) {
+		for _, r := range readings {
+			payload, err := stub.Call("addCarRecord", vin, recordMaintenance, r.odometer, r.date, "service", hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record := &CarRecord{}
+			if err = json.Unmarshal(payload, record); err != nil || record.Rollback != r.rollback {
+				t.Fatal("unexpected rollback flag", r, string(payload), err)
+			}
+		}
+	}
+	vin = "1FATP8FF4K5000033"
+	if _, err = stub.As(owner).Call("createCar", vin, "Ford", "Mustang", "red", "2019", "0"); err != nil {
+		t.Fatal(err)
+	}
+	registered = stub.Now()
+	stub.Advance(365 * 24 * time.Hour).As(workshop)
+	addRecords(vin,
+		reading{"30000", day(300), false},
+		reading{"10000", day(100), false}, // an older service entered late
+		reading{"20000", day(200), false},
+		reading{"15000", day(250), true}, // below the reading of day 200
+		reading{"35000", day(280), true}, // above the reading of day 300
+		reading{"29000", day(330), true}, // below the mileage read on day 300
+	)
+	if car := queryCar(t, stub, vin); car.Mileage != 30000 || car.MileageDate != day(300) || !car.OdometerRollback {
+		t.Fatal("a backdated record should not lower the mileage", car)
+	}
+
+	// A car registered with its mileage takes older records below it, not above it
+	vin = "WVWZZZ3C20E300004"
+	if _, err = stub.As(owner).Call("createCar", vin, "Volkswagen", "Passat", "yellow", "2014", "50000"); err != nil {
+		t.Fatal(err)
+	}
+	registered = stub.Now()
+	stub.As(workshop)
+	addRecords(vin, reading{"20000", day(-730), false})
+	if car := queryCar(t, stub, vin); car.Mileage != 50000 || car.OdometerRollback {
+		t.Fatal("an older record below the registered mileage is no rollback", car)
+	}
+	addRecords(vin, reading{"60000", day(-365), true})
+}
+
+func TestFabcar_Market(t *testing.T) {
+	seller := newIdentity(t, "Org1MSP", nil)
+	stub := newStub(t).As(seller)
+	alice := newIdentity(t, "Org1MSP", nil)
+	bob := newIdentity(t, "Org2MSP", nil)
+	vin := "2T1BURHE2JC000011"
+	if _, err := stub.Call("createCar", vin, "Toyota", "Corolla", "white", "2018", "20000"); err != nil {
+		t.Fatal(err)
+	}
+	bid := func(id *shimtest.Identity, amount string) error {
+		transient := map[string][]byte{bidTransient: []byte(`{"amount":` + amount + `,"salt":"salt-` + amount + `"}`)}
+		if res := stub.As(id).InvokeTransient(transient, "placeBid", vin); res.Status != shim.OK {
+			return errors.New(res.Message)
+		}
+		return nil
+	}
+
+	if _, err := stub.As(alice).Call("createListing", vin, "15000"); err == nil {
+		t.Fatal("only the owner may list a car")
+	}
+	if _, err := stub.As(seller).Call("createListing", vin, "0"); err == nil {
+		t.Fatal("the asking price must be positive")
+	}
+	if err := bid(alice, "14000"); err == nil {
+		t.Fatal("bidding on an unlisted car should fail")
+	}
+	// an offer blocks the listing until it has expired
+	expiring := stub.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if _, err := stub.As(seller).Call("offerTransfer", vin, clientId(t, alice), expiring); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.Call("createListing", vin, "15000"); err == nil {
+		t.Fatal("a car with a pending offer can not be listed")
+	}
+	stub.Advance(2 * time.Hour)
+	listed, err := stub.Call("createListing", vin, "15000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opened Listing
+	if err = json.Unmarshal(listed, &opened); err != nil {
+		t.Fatal(err)
+	}
+	if car := queryCar(t, stub, vin); car.Offer != nil {
+		t.Fatal("listing should drop the expired offer", car)
+	}
+	if _, err := stub.Call("createListing", vin, "16000"); err == nil {
+		t.Fatal("a car is listed once at a time")
+	}
+	expires := stub.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if _, err := stub.Call("offerTransfer", vin, clientId(t, alice), expires); err == nil {
+		t.Fatal("a listed car can not be offered")
+	}
+
+	if err := bid(seller, "20000"); err == nil {
+		t.Fatal("the seller may not bid")
+	}
+	if err := bid(alice, "-5"); err == nil {
+		t.Fatal("the bid amount must be positive")
+	}
+	if res := stub.As(alice).Invoke("placeBid", vin); res.Status == shim.OK {
+		t.Fatal("a bid without the transient amount should fail")
+	}
+	for _, b := range []struct {
+		id     *shimtest.Identity
+		amount string
+	}{{alice, "13000"}, {bob, "14500"}, {alice, "14000"}} {
+		if err := bid(b.id, b.amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A withdrawn bid leaves neither the public entry nor the amount behind
+	carol := newIdentity(t, "Org1MSP", nil)
+	if res := stub.As(carol).InvokeTransient(nil, "withdrawBid", vin); res.Status == shim.OK {
+		t.Fatal("withdrawing a missing bid should fail")
+	}
+	if err := bid(carol, "14200"); err != nil {
+		t.Fatal(err)
+	}
+	if res := stub.As(carol).InvokeTransient(nil, "withdrawBid", vin); res.Status != shim.OK {
+		t.Fatal(res.Message)
+	}
+	carolKey, _ := stub.CreateCompositeKey(bidIndex, []string{vin, opened.Id, clientId(t, carol)})
+	if _, ok := stub.State[carolKey]; ok {
+		t.Fatal("the withdrawn bid should leave the public state")
+	}
+	if _, ok := stub.PvtState[bidCollection][carolKey]; ok {
+		t.Fatal("the withdrawn bid should leave the collection")
+	}
+
+	// Bidders only see who bid, the amounts stay in the collection
+	payload, err := stub.As(bob).Call("getListing", vin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(payload), "14000") || strings.Contains(string(payload), "salt") {
+		t.Fatal("the public listing reveals a bid", string(payload))
+	}
+	var listing Listing
+	if err = json.Unmarshal(payload, &listing); err != nil || len(listing.Bids) != 2 || listing.Status != listingOpen {
+		t.Fatal("expecting an open listing with 2 bids", string(payload), err)
+	}
+	if _, err = stub.Call("getBids", vin); err == nil {
+		t.Fatal("only the seller may read the bids")
+	}
+	if _, err = stub.Call("acceptBid", vin, clientId(t, bob)); err == nil {
+		t.Fatal("only the seller may accept a bid")
+	}
+	payload, err = stub.As(seller).Call("getBids", vin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bids []*Bid
+	if err = json.Unmarshal(payload, &bids); err != nil || len(bids) != 2 {
+		t.Fatal("expecting 2 bids", string(payload), err)
+	}
+	amounts := map[string]int64{}
+	for _, b := range bids {
+		amounts[b.Bidder] = b.Amount
+	}
+	if amounts[clientId(t, alice)] != 14000 || amounts[clientId(t, bob)] != 14500 {
+		t.Fatal("unexpected bids", string(payload))
+	}
+
+	if _, err = stub.Call("acceptBid", vin, clientId(t, newIdentity(t, "Org1MSP", nil))); err == nil {
+		t.Fatal("accepting a missing bid should fail")
+	}
+	if _, err = stub.Call("acceptBid", vin, clientId(t, bob)); err != nil {
+		t.Fatal(err)
+	}
+	car := queryCar(t, stub, vin)
+	if car.OwnerId != clientId(t, bob) {
+		t.Fatal("the buyer should own the car", car)
+	}
+	payload, err = stub.Call("getListing", vin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing = Listing{}
+	if err = json.Unmarshal(payload, &listing); err != nil || listing.Status != listingSold || listing.SalePrice != 14500 || listing.BuyerId != clientId(t, bob) || len(listing.Bids) != 0 {
+		t.Fatal("the listing should record the sale", string(payload), err)
+	}
+	if err := bid(alice, "15000"); err == nil {
+		t.Fatal("a sold listing takes no bids")
+	}
+
+	// The new owner relists, a stolen report takes the car off the market
+	if _, err = stub.As(bob).Call("createListing", vin, "18000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stub.As(seller).Call("createListing", vin, "18000"); err == nil {
+		t.Fatal("the previous owner can no longer list the car")
+	}
+	if err := bid(alice, "17000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stub.As(bob).Call("setCarStatus", vin, statusStolen); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stub.Call("acceptBid", vin, clientId(t, alice)); err == nil {
+		t.Fatal("a stolen car can not be sold")
+	}
+	if _, err = stub.Call("createListing", vin, "18000"); err == nil {
+		t.Fatal("a stolen car can not be listed")
+	}
+}
+
+func TestFabcar_ImportExport(t *testing.T) {
+	owner := newIdentity(t, "Org1MSP", map[string]string{adminAttr: "true"})
+	stub := newStub(t).As(owner)
+	importCars := func(format, data string) *ImportResult {
+		payload, err := stub.Call("importCars", format, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result ImportResult
+		if err = json.Unmarshal(payload, &result); err != nil {
+			t.Fatal(err)
+		}
+		return &result
+	}
+
+	csv := "vin,make,model,colour,year,mileage\n" +
+		"1HGCM82633A004352,Honda,Accord,silver,2003,1000\n" +
+		"2T1BURHE2JC000011,Toyota,Corolla,white,2018,20000\n" +
+		"1HGCM82643A004352,Honda,Civic,red,2004,0\n" +
+		"3FADP4BJ2EM000022,Ford,Fiesta,blue,soon,0\n" +
+		"3FADP4BJ2EM000022,Ford,Fiesta\n" +
+		"1HGCM82633A004352,Honda,Accord,black,2003,1000\n"
+	result := importCars(formatCSV, csv)
+	if result.Created != 2 || result.Updated != 0 || len(result.Errors) != 4 {
+		t.Fatal("expecting 2 cars and 4 row errors", result)
+	}
+	for i, row := range []int{3, 4, 5, 6} {
+		if result.Errors[i].Row != row {
+			t.Fatal("unexpected row errors", result.Errors)
+		}
+	}
+	if queryCar(t, stub, "1HGCM82633A004352").Colour != "silver" {
+		t.Fatal("a repeated VIN should not be imported")
+	}
+
+	// The same data again changes nothing, a fix updates the car in place
+	if result = importCars(formatCSV, csv); result.Created != 0 || result.Unchanged != 2 {
+		t.Fatal("a second import should be idempotent", result)
+	}
+	rows := `[{"vin":"2T1BURHE2JC000011","make":"Toyota","model":"Corolla","colour":"grey","year":2018,"mileage":21000},
+		{"vin":"3FADP4BJ2EM000022","make":"Ford","model":"Fiesta","colour":"blue","year":2014,"mileage":0},
+		{"vin":"1HGCM82633A004352","make":"Honda","model":"Accord","colour":"silver","year":2003,"mileage":900},
+		{"vin":"1FATP8FF4K5000033","make":"Ford","model":"Mustang","colour":"red","year":"new","mileage":0}]`
+	result = importCars(formatJSON, rows)
+	if result.Created != 1 || result.Updated != 1 || len(result.Errors) != 2 {
+		t.Fatal("expecting 1 new car, 1 update and 2 row errors", result)
+	}
+	if car := queryCar(t, stub, "2T1BURHE2JC000011"); car.Colour != "grey" || car.Mileage != 21000 || car.OwnerId != clientId(t, owner) {
+		t.Fatal("the import should update the car", car)
+	}
+	result = importCars(formatJSON, `[{"vin":"2T1BURHE2JC000011","make":"Toyota","model":"Corolla","colour":"pink","year":2018,"mileage":21000}]`)
+	if len(result.Errors) != 0 || result.Updated != 1 {
+		t.Fatal(result.Errors)
+	}
+	stub.As(newIdentity(t, "Org1MSP", nil))
+	if result = importCars(formatJSON, rows); len(result.Errors) != 4 {
+		t.Fatal("only the owner may update a car", result)
+	}
+	for _, args := range [][]string{{"xml", "<cars/>"}, {formatJSON, "{}"}, {formatCSV, "vin,make\n"}} {
+		if _, err := stub.Call("importCars", args...); err == nil {
+			t.Error("importCars should fail", args)
+		}
+	}
+
+	// Export pages through every car, initLedger's and the imported ones
+	if _, err := stub.As(owner).Call("initLedger"); err != nil {
+		t.Fatal(err)
+	}
+	var cars []*CarRow
+	bookmark := ""
+	for {
+		payload, err := stub.Call("exportCars", formatJSON, "5", bookmark)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page ExportPage
+		if err = json.Unmarshal(payload, &page); err != nil {
+			t.Fatal(err)
+		}
+		cars = append(cars, page.Cars...)
+		if bookmark = page.Bookmark; bookmark == "" {
+			break
+		}
+	}
+	if len(cars) != 13 {
+		t.Fatalf("expecting 13 cars, got %d", len(cars))
+	}
+
+	payload, err := stub.Call("exportCars", formatCSV, "100", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page ExportPage
+	if err = json.Unmarshal(payload, &page); err != nil || page.Count != 13 || page.Bookmark != "" {
+		t.Fatal("expecting one page of 13 cars", string(payload), err)
+	}
+	lines := strings.Split(strings.TrimSpace(page.CSV), "\n")
+	if len(lines) != 14 || lines[0] != strings.Join(csvColumns, ",") {
+		t.Fatal("unexpected CSV", page.CSV)
+	}
+	// An export imports back unchanged
+	if result = importCars(formatCSV, page.CSV); result.Unchanged != 13 || len(result.Errors) != 0 {
+		t.Fatal("the export should import back unchanged", result)
+	}
+}
+
+func TestFabcar_Owners(t *testing.T) {
+	stub := shimtest.NewStub("fabcar", new(SmartContract))
+	if res := stub.Init(`["Org2MSP"]`); res.Status != shim.OK {
+		t.Fatal("Init failed", res.Message)
+	}
+	owner := newIdentity(t, "Org1MSP", nil)
+	neighbour := newIdentity(t, "Org1MSP", nil)
+	registry := newIdentity(t, "Org2MSP", nil)
+	vin := "1HGCM82633A004352"
+	register := func(id *shimtest.Identity, details string) (*OwnerRecord, error) {
+		res := stub.As(id).InvokeTransient(map[string][]byte{ownerTransient: []byte(details)}, "registerOwner")
+		if res.Status != shim.OK {
+			return nil, errors.New(res.Message)
+		}
+		record := &OwnerRecord{}
+		return record, json.Unmarshal(res.Payload, record)
+	}
+	view := func(id *shimtest.Identity) *CarView {
+		payload, err := stub.As(id).Call("queryCar", vin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		car := &CarView{}
+		if err = json.Unmarshal(payload, car); err != nil {
+			t.Fatal(err)
+		}
+		return car
+	}
+
+	if _, err := stub.As(owner).Call("createCar", vin, "Honda", "Accord", "silver", "2003", "1000"); err != nil {
+		t.Fatal(err)
+	}
+	if car := view(owner); car.OwnerHash != "" || car.OwnerDetails != nil {
+		t.Fatal("an unregistered owner has no details", car)
+	}
+	if res := stub.As(owner).Invoke("registerOwner"); res.Status == shim.OK {
+		t.Fatal("registering without the transient details should fail")
+	}
+	if _, err := register(owner, `{"name":"","idNumber":"X123","salt":"s1"}`); err == nil {
+		t.Fatal("the name must not be empty")
+	}
+	if _, err := register(owner, `{"name":"Ana","idNumber":"X123","phone":"555-0100"}`); err == nil {
+		t.Fatal("the salt must not be empty")
+	}
+	record, err := register(owner, `{"name":"Ana","idNumber":"X123","phone":"555-0100","salt":"s1"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detailsAsBytes, _ := json.Marshal(&OwnerDetails{OwnerId: clientId(t, owner), Name: "Ana", IdNumber: "X123", Phone: "555-0100", Salt: "s1"})
+	if sum := sha256.Sum256(detailsAsBytes); record.Hash != hex.EncodeToString(sum[:]) {
+		t.Fatal("the hash should cover the private details", record)
+	}
+
+	// The owner and the registry organization see the details, other callers only the hash
+	if car := view(owner); car.OwnerHash != record.Hash || car.OwnerDetails == nil || car.OwnerDetails.Name != "Ana" {
+		t.Fatal("the owner should see their details", car)
+	}
+	if car := view(registry); car.OwnerDetails == nil || car.OwnerDetails.IdNumber != "X123" {
+		t.Fatal("the registry should see the details", car)
+	}
+	payload, err := stub.As(neighbour).Call("queryCar", vin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(payload), "Ana") || !strings.Contains(string(payload), record.Hash) {
+		t.Fatal("the public car should only carry the hash", string(payload))
+	}
+	if _, err = stub.Call("getOwner", clientId(t, owner)); err == nil {
+		t.Fatal("an unauthorized organization may not read the details")
+	}
+	if _, err = stub.As(registry).Call("getOwner", clientId(t, owner)); err != nil {
+		t.Fatal(err)
+	}
+	page := queryCars(t, stub, `{"ownerId":"`+clientId(t, owner)+`"}`, "10", "")
+	if page.Count != 1 || page.Records[0].OwnerDetails == nil || page.Records[0].OwnerDetails.Phone != "555-0100" {
+		t.Fatal("queryCars should join the details for the registry", page)
+	}
+
+	// A new owner brings their own hash, registering later updates their cars
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if _, err = stub.As(owner).Call("offerTransfer", vin, clientId(t, neighbour), expires); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stub.As(neighbour).Call("acceptTransfer", vin); err != nil {
+		t.Fatal(err)
+	}
+	if car := view(neighbour); car.OwnerHash != "" || car.OwnerDetails != nil {
+		t.Fatal("the new owner has not registered", car)
+	}
+	if record, err = register(neighbour, `{"name":"Jin Soo","idNumber":"Y456","phone":"","salt":"s2"}`); err != nil {
+		t.Fatal(err)
+	}
+	if car := view(neighbour); car.OwnerHash != record.Hash || car.OwnerDetails.Name != "Jin Soo" {
+		t.Fatal("registering should update the cars of the owner", car)
+	}
+}
+
+func TestFabcar_Lease(t *testing.T) {
+	owner := newIdentity(t, "Org1MSP", nil)
+	stub := newStub(t).As(owner)
+	lessee := newIdentity(t, "Org2MSP", nil)
+	vin := "3FADP4BJ2EM000022"
+	if _, err := stub.Call("createCar", vin, "Ford", "Fiesta", "blue", "2014", "80000"); err != nil {
+		t.Fatal(err)
+	}
+	if car := queryCar(t, stub, vin); car.Custodian != clientId(t, owner) || car.Lease != nil {
+		t.Fatal("the owner should hold a new car", car)
+	}
+	hash := strings.Repeat("cd", 32)
+	at := func(d time.Duration) string { return stub.Now().Add(d).UTC().Format(time.RFC3339) }
+
+	if _, err := stub.As(lessee).Call("createLease", vin, clientId(t, lessee), "", at(time.Hour), hash); err == nil {
+		t.Fatal("only the owner may lease a car")
+	}
+	stub.As(owner)
+	if _, err := stub.Call("createListing", vin, "9000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.Call("createLease", vin, clientId(t, lessee), "", at(time.Hour), hash); err == nil {
+		t.Fatal("a listed car can not be leased")
+	}
+	if _, err := stub.Call("cancelListing", vin); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{vin, clientId(t, owner), "", at(time.Hour), hash},
+		{vin, clientId(t, lessee), "", at(time.Hour), "abc"},
+		{vin, clientId(t, lessee), "", at(-time.Hour), hash},
+		{vin, clientId(t, lessee), at(2 * time.Hour), at(time.Hour), hash},
+	} {
+		if _, err := stub.Call("createLease", args...); err == nil {
+			t.Error("createLease should fail", args)
+		}
+	}
+	if _, err := stub.Call("createLease", vin, clientId(t, lessee), "", at(time.Hour), hash); err != nil {
+		t.Fatal(err)
+	}
+	car := queryCar(t, stub, vin)
+	if car.Custodian != clientId(t, lessee) || car.OwnerId != clientId(t, owner) || car.Lease == nil || car.Lease.TermsHash != hash {
+		t.Fatal("the lessee should hold the car", car)
+	}
+
+	// The title is frozen while the lease runs
+	if _, err := stub.Call("offerTransfer", vin, clientId(t, lessee), at(time.Hour)); err == nil {
+		t.Fatal("a leased car can not be offered")
+	}
+	if _, err := stub.Call("createListing", vin, "9000"); err == nil {
+		t.Fatal("a leased car can not be listed")
+	}
+	if _, err := stub.Call("setCarStatus", vin, statusScrapped); err == nil {
+		t.Fatal("a leased car can not be scrapped")
+	}
+	if _, err := stub.Call("createLease", vin, clientId(t, lessee), "", at(time.Hour), hash); err == nil {
+		t.Fatal("a car has one lease at a time")
+	}
+	if _, err := stub.Call("endLease", vin); err == nil {
+		t.Fatal("the owner can not end a lease that has started")
+	}
+	if _, err := stub.As(newIdentity(t, "Org1MSP", nil)).Call("endLease", vin); err == nil {
+		t.Fatal("only the owner or the lessee may end a lease")
+	}
+	if _, err := stub.As(lessee).Call("endLease", vin); err != nil {
+		t.Fatal(err)
+	}
+	if car = queryCar(t, stub, vin); car.Custodian != clientId(t, owner) || car.Lease != nil {
+		t.Fatal("a returned car goes back to the owner", car)
+	}
+
+	// A lease that has not started leaves the car with the owner, who may cancel it
+	if _, err := stub.As(owner).Call("createLease", vin, clientId(t, lessee), at(time.Hour), at(2*time.Hour), hash); err != nil {
+		t.Fatal(err)
+	}
+	if car = queryCar(t, stub, vin); car.Custodian != clientId(t, owner) || car.Lease == nil {
+		t.Fatal("the owner holds the car until the lease starts", car)
+	}
+	if _, err := stub.Call("offerTransfer", vin, clientId(t, lessee), at(time.Hour)); err == nil {
+		t.Fatal("a car with a pending lease can not be offered")
+	}
+	if _, err := stub.Call("endLease", vin); err != nil {
+		t.Fatal(err)
+	}
+
+	// A lease ends on its own, the next read no longer sees it
+	if _, err := stub.Call("createLease", vin, clientId(t, lessee), "", at(time.Hour), hash); err != nil {
+		t.Fatal(err)
+	}
+	car = queryCar(t, stub, vin)
+	if car.Custodian != clientId(t, lessee) {
+		t.Fatal("the lessee should hold the car", car)
+	}
+	stub.Advance(2 * time.Hour)
+	if car = queryCar(t, stub, vin); car.Custodian != clientId(t, owner) || car.Lease != nil {
+		t.Fatal("an ended lease should be dropped on read", car)
+	}
+	if page := queryCars(t, stub, `{"make":"Ford"}`, "10", ""); page.Count != 1 || page.Records[0].Record.Lease != nil {
+		t.Fatal("an ended lease should be dropped from query results", page)
+	}
+	if _, err := stub.Call("offerTransfer", vin, clientId(t, lessee), at(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+ * Leasing. The owner of a car may lease it to another identity for a period, during which
+ * the lessee is the custodian of the car while the owner keeps the title. Start and end
+ * are compared with the transaction timestamp: a lease that has ended is dropped whenever
+ * the car is read, so no transaction is needed to end it on time. A car can not change
+ * owner, be listed for sale or be scrapped while it has a lease that has not ended.
+ */
+
+// Lease lets Lessee hold a car from Start until End
+type Lease struct {
+	TxId      string    `json:"txId"`
+	Lessee    string    `json:"lessee"` // mspId/id of the lessee
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	TermsHash string    `json:"termsHash"` // hex sha256 of the lease contract
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// expireLease drops a lease that has ended by now and sets the custodian of the car at now
+func (car *Car) expireLease(now time.Time) {
+	if car.Lease != nil && !now.Before(car.Lease.End) {
+		car.Lease = nil
+	}
+	car.Custodian = car.OwnerId
+	if car.Lease != nil && !now.Before(car.Lease.Start) {
+		car.Custodian = car.Lease.Lessee
+	}
+}
+
+// checkNotLeased fails if a car has a lease that has not ended
+func checkNotLeased(key string, car *Car) error {
+	if car.Lease != nil {
+		return fmt.Errorf("Car %s is leased until %s", key, car.Lease.End.Format(time.RFC3339))
+	}
+	return nil
+}
+
+/*
+ * createLease leases a car to another identity, owners only. An empty start means now.
+ * Args: VIN, lessee mspId/id, start (RFC 3339), end (RFC 3339), terms hash
+ */
+func (s *SmartContract) createLease(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting VIN, lessee, start, end and terms hash")
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != car.OwnerId {
+		return shim.Error("Only the owner of " + args[0] + " can lease it")
+	}
+	if car.Status == statusStolen || car.Status == statusScrapped {
+		return shim.Error("A " + car.Status + " car can not be leased")
+	}
+	if err = checkNotLeased(args[0], car); err != nil {
+		return shim.Error(err.Error())
+	}
+	// An open listing would keep taking bids that can not be accepted during the lease
+	if listing, err := getListing(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	} else if listing != nil && listing.Status == listingOpen {
+		return shim.Error("Car " + args[0] + " is listed for sale")
+	}
+	if args[1] == "" || args[1] == caller {
+		return shim.Error("Lessee must be another identity")
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	start := now
+	if args[2] != "" {
+		if start, err = time.Parse(time.RFC3339, args[2]); err != nil {
+			return shim.Error("Expecting RFC 3339 time for start")
+		}
+	}
+	end, err := time.Parse(time.RFC3339, args[3])
+	if err != nil {
+		return shim.Error("Expecting RFC 3339 time for end")
+	}
+	if !end.After(start) || !end.After(now) {
+		return shim.Error("End must be after start and in the future")
+	}
+	if hash, err := hex.DecodeString(args[4]); err != nil || len(hash) != 32 {
+		return shim.Error("Expecting hex encoded sha256 for terms hash")
+	}
+
+	old := *car
+	car.Lease = &Lease{TxId: APIstub.GetTxID(), Lessee: args[1], Start: start, End: end, TermsHash: args[4], CreatedAt: now}
+	err = putCar(APIstub, args[0], &old, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * endLease ends a lease before its end: the lessee may return the car at any time, the
+ * owner may only cancel a lease that has not started. Args: VIN
+ */
+func (s *SmartContract) endLease(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.Lease == nil {
+		return shim.Error("Car " + args[0] + " is not leased")
+	}
+	caller, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller == car.OwnerId {
+		if car.Custodian != car.OwnerId {
+			return shim.Error("The lease of " + args[0] + " has started, only the lessee can end it")
+		}
+	} else if caller != car.Lease.Lessee {
+		return shim.Error("Only the owner or the lessee of " + args[0] + " can end its lease")
+	}
+
+	old := *car
+	car.Lease = nil
+	err = putCar(APIstub, args[0], &old, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+ * Marketplace. An owner lists a car with a public asking price and buyers bid on it.
+ * The amount of a bid is passed in the transient field "bid" and kept in the private
+ * collection fabcarBids, so the public state only shows who bid and when. Only the
+ * seller can read the amounts, and the price becomes public when the seller accepts
+ * a bid, which hands the car to the bidder in the same transaction.
+ *
+ * The listing of a car is the composite key listing~vin. Bids are bid~vin keys with
+ * the listing id and the bidder as attributes, both in the public state and in the
+ * collection, so a new listing never sees the bids of an earlier one. A withdrawn bid
+ * is deleted from both, the private bids of closed listings are left to the
+ * collection's blockToLive to purge.
+ */
+const (
+	listingIndex  = "listing~vin"
+	bidIndex      = "bid~vin"
+	bidCollection = "fabcarBids"
+	bidTransient  = "bid"
+
+	listingOpen      = "open"
+	listingSold      = "sold"
+	listingCancelled = "cancelled"
+)
+
+// Listing offers a car for sale, Id is the transaction that listed it
+type Listing struct {
+	Id          string    `json:"id"`
+	VIN         string    `json:"vin"`
+	Seller      string    `json:"seller"` // mspId/id of the owner who listed the car
+	AskingPrice int64     `json:"askingPrice"`
+	Status      string    `json:"status"` // open, sold or cancelled
+	CreatedAt   time.Time `json:"createdAt"`
+	Bids        []*Bid    `json:"bids,omitempty"`
+	SalePrice   int64     `json:"salePrice,omitempty"`
+	BuyerId     string    `json:"buyerId,omitempty"`
+	ClosedAt    time.Time `json:"closedAt"`
+}
+
+// Bid is an offer to buy a listed car. Amount and Salt are only stored in the
+// private collection, the salt keeps the hash on the ledger from revealing the amount
+type Bid struct {
+	Bidder   string    `json:"bidder"` // mspId/id of the bidder
+	PlacedAt time.Time `json:"placedAt"`
+	Amount   int64     `json:"amount,omitempty"`
+	Salt     string    `json:"salt,omitempty"`
+}
+
+/*
+ * createListing puts a car up for sale, owners only. Args: VIN, asking price
+ */
+func (s *SmartContract) createListing(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting VIN and asking price")
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != car.OwnerId {
+		return shim.Error("Only the owner of " + args[0] + " can list it")
+	}
+	if car.Status == statusStolen || car.Status == statusScrapped {
+		return shim.Error("A " + car.Status + " car can not change hands")
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// An expired offer can no longer be accepted and is dropped with the listing
+	if car.Offer != nil && !now.After(car.Offer.Expires) {
+		return shim.Error("Car " + args[0] + " has a pending transfer offer")
+	}
+	if err = checkNotLeased(args[0], car); err != nil {
+		return shim.Error(err.Error())
+	}
+	price, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || price <= 0 {
+		return shim.Error("Expecting positive integer value for asking price")
+	}
+	listing, err := getListing(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if listing != nil && listing.Status == listingOpen {
+		return shim.Error("Car " + args[0] + " is already listed")
+	}
+	if car.Offer != nil {
+		old := *car
+		car.Offer = nil
+		if err = putCar(APIstub, args[0], &old, car); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	listing = &Listing{Id: APIstub.GetTxID(), VIN: args[0], Seller: caller, AskingPrice: price, Status: listingOpen, CreatedAt: now}
+	listingAsBytes, err := putListing(APIstub, listing)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(listingAsBytes)
+}
+
+/*
+ * placeBid bids on a listed car, replacing an earlier bid of the caller. The transient
+ * field "bid" holds {"amount":<positive integer>,"salt":<random string>}. Args: VIN
+ */
+func (s *SmartContract) placeBid(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	listing, err := openListing(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller == listing.Seller {
+		return shim.Error("The seller can not bid on " + args[0])
+	}
+
+	transient, err := APIstub.GetTransient()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bidAsBytes, ok := transient[bidTransient]
+	if !ok {
+		return shim.Error("The bid must be passed in the transient field " + bidTransient)
+	}
+	bid := &Bid{}
+	if err = json.Unmarshal(bidAsBytes, bid); err != nil {
+		return shim.Error("Failed to unmarshal bid: " + err.Error())
+	}
+	if bid.Amount <= 0 {
+		return shim.Error("Expecting positive integer value for bid amount")
+	}
+	if bid.Salt == "" {
+		return shim.Error("Bid salt must not be empty")
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bid.Bidder, bid.PlacedAt = caller, now
+
+	key, err := APIstub.CreateCompositeKey(bidIndex, []string{listing.VIN, listing.Id, caller})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	privateAsBytes, _ := json.Marshal(bid)
+	err = APIstub.PutPrivateData(bidCollection, key, privateAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	public := &Bid{Bidder: bid.Bidder, PlacedAt: bid.PlacedAt}
+	publicAsBytes, _ := json.Marshal(public)
+	err = APIstub.PutState(key, publicAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(publicAsBytes)
+}
+
+/*
+ * withdrawBid removes the caller's bid from an open listing. Args: VIN
+ */
+func (s *SmartContract) withdrawBid(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	listing, err := openListing(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key, err := APIstub.CreateCompositeKey(bidIndex, []string{listing.VIN, listing.Id, caller})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bidAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if bidAsBytes == nil {
+		return shim.Error("No bid of the caller on " + args[0])
+	}
+	err = APIstub.DelState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = APIstub.DelPrivateData(bidCollection, key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * getListing returns the listing of a car with its bidders, without the amounts. Args: VIN
+ */
+func (s *SmartContract) getListing(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	listing, err := getListing(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if listing == nil {
+		return shim.Error("Car " + args[0] + " has never been listed")
+	}
+	if listing.Bids, err = listingBids(APIstub, listing, false); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	listingAsBytes, _ := json.Marshal(listing)
+	return shim.Success(listingAsBytes)
+}
+
+/*
+ * getBids returns the bids on an open listing with their amounts, seller only.
+ * It must be sent to a peer of an organization in the fabcarBids collection. Args: VIN
+ */
+func (s *SmartContract) getBids(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	listing, err := openListing(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = checkSeller(APIstub, listing); err != nil {
+		return shim.Error(err.Error())
+	}
+	bids, err := listingBids(APIstub, listing, true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bidsAsBytes, _ := json.Marshal(bids)
+	return shim.Success(bidsAsBytes)
+}
+
+/*
+ * acceptBid sells a listed car to a bidder, seller only. The car changes owner and the
+ * listing records the sale price in the same transaction. Args: VIN, bidder mspId/id
+ */
+func (s *SmartContract) acceptBid(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting VIN and bidder")
+	}
+
+	listing, err := openListing(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = checkSeller(APIstub, listing); err != nil {
+		return shim.Error(err.Error())
+	}
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.OwnerId != listing.Seller {
+		return shim.Error("The seller no longer owns " + args[0])
+	}
+	if err = checkNotLeased(args[0], car); err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.Status == statusStolen || car.Status == statusScrapped {
+		return shim.Error("A " + car.Status + " car can not change hands")
+	}
+
+	key, err := APIstub.CreateCompositeKey(bidIndex, []string{listing.VIN, listing.Id, args[1]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	publicAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if publicAsBytes == nil {
+		return shim.Error("No bid of " + args[1] + " on " + args[0])
+	}
+	bid, err := privateBid(APIstub, key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	old := *car
+	car.OwnerId, car.Offer = bid.Bidder, nil
+	err = putCar(APIstub, args[0], &old, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	listing.SalePrice, listing.BuyerId = bid.Amount, bid.Bidder
+	listingAsBytes, err := closeListing(APIstub, listing, listingSold, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(listingAsBytes)
+}
+
+/*
+ * cancelListing takes a car off the market, seller only. Args: VIN
+ */
+func (s *SmartContract) cancelListing(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	listing, err := openListing(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = checkSeller(APIstub, listing); err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	listingAsBytes, err := closeListing(APIstub, listing, listingCancelled, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(listingAsBytes)
+}
+
+// getListing loads the latest listing of a car, nil if it has never been listed
+func getListing(APIstub shim.ChaincodeStubInterface, vin string) (*Listing, error) {
+	key, err := APIstub.CreateCompositeKey(listingIndex, []string{vin})
+	if err != nil {
+		return nil, err
+	}
+	listingAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get listing of %s", vin)
+	}
+	if listingAsBytes == nil {
+		return nil, nil
+	}
+	listing := &Listing{}
+	if err = json.Unmarshal(listingAsBytes, listing); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal listing of %s", vin)
+	}
+	return listing, nil
+}
+
+// openListing loads the listing of a car, which must be open
+func openListing(APIstub shim.ChaincodeStubInterface, vin string) (*Listing, error) {
+	listing, err := getListing(APIstub, vin)
+	if err != nil {
+		return nil, err
+	}
+	if listing == nil || listing.Status != listingOpen {
+		return nil, fmt.Errorf("Car %s is not listed", vin)
+	}
+	return listing, nil
+}
+
+func putListing(APIstub shim.ChaincodeStubInterface, listing *Listing) ([]byte, error) {
+	key, err := APIstub.CreateCompositeKey(listingIndex, []string{listing.VIN})
+	if err != nil {
+		return nil, err
+	}
+	listing.Bids = nil
+	listingAsBytes, _ := json.Marshal(listing)
+	return listingAsBytes, APIstub.PutState(key, listingAsBytes)
+}
+
+// closeListing marks a listing sold or cancelled and drops its public bids
+func closeListing(APIstub shim.ChaincodeStubInterface, listing *Listing, status string, now time.Time) ([]byte, error) {
+	iter, err := APIstub.GetStateByPartialCompositeKey(bidIndex, []string{listing.VIN, listing.Id})
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		keys = append(keys, res.Key)
+	}
+	iter.Close()
+	for _, key := range keys {
+		if err = APIstub.DelState(key); err != nil {
+			return nil, err
+		}
+	}
+
+	listing.Status, listing.ClosedAt = status, now
+	return putListing(APIstub, listing)
+}
+
+// closeOpenListing cancels the listing of a car if it is open
+func closeOpenListing(APIstub shim.ChaincodeStubInterface, vin string) error {
+	listing, err := getListing(APIstub, vin)
+	if err != nil || listing == nil || listing.Status != listingOpen {
+		return err
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return err
+	}
+	_, err = closeListing(APIstub, listing, listingCancelled, now)
+	return err
+}
+
+// listingBids returns the bids on a listing, with their amounts if private is set
+func listingBids(APIstub shim.ChaincodeStubInterface, listing *Listing, private bool) ([]*Bid, error) {
+	iter, err := APIstub.GetStateByPartialCompositeKey(bidIndex, []string{listing.VIN, listing.Id})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	bids := []*Bid{}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		bid := &Bid{}
+		if private {
+			bid, err = privateBid(APIstub, res.Key)
+		} else {
+			err = json.Unmarshal(res.Value, bid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		bid.Salt = ""
+		bids = append(bids, bid)
+	}
+	return bids, nil
+}
+
+// privateBid loads a bid with its amount from the private collection
+func privateBid(APIstub shim.ChaincodeStubInterface, key string) (*Bid, error) {
+	bidAsBytes, err := APIstub.GetPrivateData(bidCollection, key)
+	if err != nil {
+		return nil, err
+	}
+	if bidAsBytes == nil {
+		return nil, fmt.Errorf("The amount of the bid is not in the %s collection of this peer", bidCollection)
+	}
+	bid := &Bid{}
+	if err = json.Unmarshal(bidAsBytes, bid); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal bid")
+	}
+	return bid, nil
+}
+
+func checkSeller(APIstub shim.ChaincodeStubInterface, listing *Listing) error {
+	caller, err := callerId(APIstub)
+	if err != nil {
+		return err
+	}
+	if caller != listing.Seller {
+		return fmt.Errorf("Only the seller of %s can do this", listing.VIN)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+ * Owners are known to the public state by their owner id, the mspId/id of their client
+ * identity. An owner registers their name, ID number and phone in the transient field
+ * "owner", and the details go to the private collection fabcarOwners. The public state
+ * keeps the hex sha256 of the private value, which includes a salt chosen by the owner,
+ * both in an ownerRecord and on each car of the owner, so a car proves who owns it to
+ * anyone shown the details without publishing them.
+ *
+ * Owners always read their own details. The organizations allowed to read the details
+ * of every owner are given to Init as a JSON array of MSP ids, and must also be members
+ * of the collection for their peers to hold the details.
+ */
+const (
+	ownerRecordIndex  = "ownerRecord"
+	ownerCollection   = "fabcarOwners"
+	ownerTransient    = "owner"
+	ownerReadersIndex = "config~ownerReaders"
+)
+
+// OwnerDetails are the personal details of an owner, kept in the private collection
+type OwnerDetails struct {
+	OwnerId  string `json:"ownerId"`
+	Name     string `json:"name"`
+	IdNumber string `json:"idNumber"`
+	Phone    string `json:"phone"`
+	Salt     string `json:"salt"`
+}
+
+// OwnerRecord is the public trace of a registered owner
+type OwnerRecord struct {
+	OwnerId   string    `json:"ownerId"`
+	Hash      string    `json:"hash"` // hex sha256 of the private OwnerDetails
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// CarView is a car as returned by queryCar, with the owner's details for callers allowed to read them
+type CarView struct {
+	*Car
+	OwnerDetails *OwnerDetails `json:"ownerDetails,omitempty"`
+}
+
+/*
+ * registerOwner records or replaces the personal details of the caller and updates the
+ * owner hash of the caller's cars. The transient field "owner" holds
+ * {"name":...,"idNumber":...,"phone":...,"salt":<random string>}
+ */
+func (s *SmartContract) registerOwner(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	ownerId, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	transient, err := APIstub.GetTransient()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	detailsAsBytes, ok := transient[ownerTransient]
+	if !ok {
+		return shim.Error("The owner details must be passed in the transient field " + ownerTransient)
+	}
+	details := &OwnerDetails{}
+	if err = json.Unmarshal(detailsAsBytes, details); err != nil {
+		return shim.Error("Failed to unmarshal owner details: " + err.Error())
+	}
+	for _, field := range []struct{ name, value string }{
+		{"name", details.Name}, {"ID number", details.IdNumber}, {"salt", details.Salt},
+	} {
+		if field.value == "" {
+			return shim.Error("The " + field.name + " must not be empty")
+		}
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	details.OwnerId = ownerId
+	key, err := APIstub.CreateCompositeKey(ownerRecordIndex, []string{ownerId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// The hash is taken over the exact private value, as the peers record it
+	detailsAsBytes, _ = json.Marshal(details)
+	err = APIstub.PutPrivateData(ownerCollection, key, detailsAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	sum := sha256.Sum256(detailsAsBytes)
+	record := &OwnerRecord{OwnerId: ownerId, Hash: hex.EncodeToString(sum[:]), UpdatedAt: now}
+	recordAsBytes, _ := json.Marshal(record)
+	err = APIstub.PutState(key, recordAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = updateOwnerHash(APIstub, ownerId, record.Hash)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(recordAsBytes)
+}
+
+/*
+ * getOwner returns the personal details of an owner to the owner and to the
+ * organizations allowed to read them. Args: owner id (mspId/id)
+ */
+func (s *SmartContract) getOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	allowed, err := canReadOwner(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !allowed {
+		return shim.Error("The caller may not read the details of " + args[0])
+	}
+	details, err := ownerDetails(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if details == nil {
+		return shim.Error("Owner " + args[0] + " has not registered details")
+	}
+
+	detailsAsBytes, _ := json.Marshal(details)
+	return shim.Success(detailsAsBytes)
+}
+
+// putOwnerReaders stores the MSP ids allowed to read all owner details, a JSON array
+func putOwnerReaders(APIstub shim.ChaincodeStubInterface, readers string) error {
+	mspIds := []string{}
+	if err := json.Unmarshal([]byte(readers), &mspIds); err != nil {
+		return fmt.Errorf("Expecting a JSON array of MSP ids: %s", err.Error())
+	}
+	key, err := APIstub.CreateCompositeKey(ownerReadersIndex, []string{})
+	if err != nil {
+		return err
+	}
+	readersAsBytes, _ := json.Marshal(mspIds)
+	return APIstub.PutState(key, readersAsBytes)
+}
+
+// canReadOwner tells whether the caller may read the details of ownerId
+func canReadOwner(APIstub shim.ChaincodeStubInterface, ownerId string) (bool, error) {
+	caller, err := callerId(APIstub)
+	if err != nil {
+		return false, err
+	}
+	if caller == ownerId {
+		return true, nil
+	}
+	mspId, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return false, err
+	}
+	key, err := APIstub.CreateCompositeKey(ownerReadersIndex, []string{})
+	if err != nil {
+		return false, err
+	}
+	readersAsBytes, err := APIstub.GetState(key)
+	if err != nil || readersAsBytes == nil {
+		return false, err
+	}
+	mspIds := []string{}
+	if err = json.Unmarshal(readersAsBytes, &mspIds); err != nil {
+		return false, fmt.Errorf("Failed to unmarshal owner readers")
+	}
+	for _, reader := range mspIds {
+		if reader == mspId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ownerDetails loads the private details of an owner, nil if they are not on this peer
+func ownerDetails(APIstub shim.ChaincodeStubInterface, ownerId string) (*OwnerDetails, error) {
+	key, err := APIstub.CreateCompositeKey(ownerRecordIndex, []string{ownerId})
+	if err != nil {
+		return nil, err
+	}
+	detailsAsBytes, err := APIstub.GetPrivateData(ownerCollection, key)
+	if err != nil || detailsAsBytes == nil {
+		return nil, err
+	}
+	details := &OwnerDetails{}
+	if err = json.Unmarshal(detailsAsBytes, details); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal details of %s", ownerId)
+	}
+	return details, nil
+}
+
+// joinOwner returns the details of the owner of car if the caller may read them
+func joinOwner(APIstub shim.ChaincodeStubInterface, car *Car) (*OwnerDetails, error) {
+	allowed, err := canReadOwner(APIstub, car.OwnerId)
+	if err != nil || !allowed {
+		return nil, err
+	}
+	return ownerDetails(APIstub, car.OwnerId)
+}
+
+// ownerHash is the hash of the registered details of an owner, empty if there are none
+func ownerHash(APIstub shim.ChaincodeStubInterface, ownerId string) (string, error) {
+	key, err := APIstub.CreateCompositeKey(ownerRecordIndex, []string{ownerId})
+	if err != nil {
+		return "", err
+	}
+	recordAsBytes, err := APIstub.GetState(key)
+	if err != nil || recordAsBytes == nil {
+		return "", err
+	}
+	record := &OwnerRecord{}
+	if err = json.Unmarshal(recordAsBytes, record); err != nil {
+		return "", fmt.Errorf("Failed to unmarshal owner record of %s", ownerId)
+	}
+	return record.Hash, nil
+}
+
+// updateOwnerHash writes hash on every car of an owner
+func updateOwnerHash(APIstub shim.ChaincodeStubInterface, ownerId string, hash string) error {
+	iter, err := APIstub.GetStateByPartialCompositeKey(ownerIndex, []string{ownerId})
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		if _, attrs, err := APIstub.SplitCompositeKey(res.Key); err == nil && len(attrs) == 2 {
+			keys = append(keys, attrs[1])
+		}
+	}
+	iter.Close()
+
+	for _, key := range keys {
+		car, err := getCar(APIstub, key)
+		if err != nil {
+			return err
+		}
+		if car.OwnerId != ownerId || car.OwnerHash == hash {
+			continue
+		}
+		old := *car
+		car.OwnerHash = hash
+		if err = putCar(APIstub, key, &old, car); err != nil {
+			return err
+		}
+	}
+	return nil
+}
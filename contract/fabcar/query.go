@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+ * Secondary indexes are composite keys of the form <index>~key with the indexed
+ * value and the car key as attributes, so that cars can be found by owner id, make
+ * or colour with a partial composite key query.
+ */
+const (
+	ownerIndex  = "owner~key"
+	makeIndex   = "make~key"
+	colourIndex = "colour~key"
+
+	// maxPageSize caps the number of cars returned by one queryCars call
+	maxPageSize = 100
+
+	// adminAttr allows seeding the ledger, rebuilding the indexes and assigning
+	// owners to older cars
+	adminAttr = "fabcar.admin"
+)
+
+// CarFilter selects cars by exact owner id, make and colour, empty fields match any car
+type CarFilter struct {
+	OwnerId string `json:"ownerId"`
+	Make    string `json:"make"`
+	Colour  string `json:"colour"`
+}
+
+// QueryResult is a car as returned by the query functions, OwnerDetails
+// is only set for callers allowed to read them
+type QueryResult struct {
+	Key          string        `json:"Key"`
+	Record       *Car          `json:"Record"`
+	OwnerDetails *OwnerDetails `json:"OwnerDetails,omitempty"`
+}
+
+// CarPage is a page of queryCars results, Bookmark is empty on the last page
+type CarPage struct {
+	Records  []*QueryResult `json:"records"`
+	Count    int            `json:"fetchedRecordsCount"`
+	Bookmark string         `json:"bookmark"`
+}
+
+func (f *CarFilter) matches(car *Car) bool {
+	return (f.OwnerId == "" || f.OwnerId == car.OwnerId) &&
+		(f.Make == "" || f.Make == car.Make) &&
+		(f.Colour == "" || f.Colour == car.Colour)
+}
+
+/*
+ * queryCars returns the cars matching a JSON filter, e.g. {"ownerId":"Org1MSP/x509::...","colour":"blue"}.
+ * The most selective index in the filter (owner id, then make, then colour) is scanned and the
+ * remaining fields are checked on each car. Pass the returned bookmark to get the next page.
+ * Args: filter, pageSize, bookmark
+ */
+func (s *SmartContract) queryCars(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting filter, pageSize and bookmark")
+	}
+
+	filter := &CarFilter{}
+	if args[0] != "" {
+		if err := json.Unmarshal([]byte(args[0]), filter); err != nil {
+			return shim.Error("Failed to unmarshal filter: " + err.Error())
+		}
+	}
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	page, err := findCars(APIstub, filter, pageSize, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, res := range page.Records {
+		if res.OwnerDetails, err = joinOwner(APIstub, res.Record); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	pageAsBytes, _ := json.Marshal(page)
+	return shim.Success(pageAsBytes)
+}
+
+func parsePageSize(arg string) (int, error) {
+	pageSize, err := strconv.Atoi(arg)
+	if err != nil || pageSize <= 0 || pageSize > maxPageSize {
+		return 0, fmt.Errorf("Page size must be between 1 and %d", maxPageSize)
+	}
+	return pageSize, nil
+}
+
+// findCars returns the page of cars matching filter that follows bookmark. The keys are read
+// with the paginated shim queries, fetching more until the page is full or the keys run out,
+// and the bookmark of the last fetch is returned.
+func findCars(APIstub shim.ChaincodeStubInterface, filter *CarFilter, pageSize int, bookmark string) (*CarPage, error) {
+	now, err := txTime(APIstub)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &CarPage{Records: []*QueryResult{}}
+	for {
+		var iter shim.StateQueryIteratorInterface
+		var meta *sc.QueryResponseMetadata
+		size := int32(pageSize - len(page.Records))
+		indexed := true
+		if filter.OwnerId != "" {
+			iter, meta, err = APIstub.GetStateByPartialCompositeKeyWithPagination(ownerIndex, []string{filter.OwnerId}, size, bookmark)
+		} else if filter.Make != "" {
+			iter, meta, err = APIstub.GetStateByPartialCompositeKeyWithPagination(makeIndex, []string{filter.Make}, size, bookmark)
+		} else if filter.Colour != "" {
+			iter, meta, err = APIstub.GetStateByPartialCompositeKeyWithPagination(colourIndex, []string{filter.Colour}, size, bookmark)
+		} else {
+			iter, meta, err = APIstub.GetStateByRangeWithPagination("", "", size, bookmark)
+			indexed = false
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for iter.HasNext() {
+			res, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+
+			key, carAsBytes := res.Key, res.Value
+			if indexed {
+				_, attrs, err := APIstub.SplitCompositeKey(res.Key)
+				if err != nil || len(attrs) != 2 {
+					continue
+				}
+				key = attrs[1]
+				if carAsBytes, err = APIstub.GetState(key); err != nil {
+					iter.Close()
+					return nil, err
+				}
+			}
+			car := toCar(key, carAsBytes)
+			if car == nil || !filter.matches(car) {
+				continue
+			}
+			car.expireLease(now)
+			page.Records = append(page.Records, &QueryResult{Key: key, Record: car})
+		}
+		iter.Close()
+
+		bookmark = meta.Bookmark
+		if bookmark == "" || len(page.Records) == pageSize {
+			break
+		}
+	}
+	page.Count = len(page.Records)
+	page.Bookmark = bookmark
+
+	return page, nil
+}
+
+/*
+ * richQueryCars runs a CouchDB selector query, e.g. {"selector":{"docType":"car","make":"Toyota"}}.
+ * The indexes under META-INF/statedb/couchdb/indexes cover docType with ownerId, make and colour.
+ * It requires CouchDB as the state database. Args: query
+ */
+func (s *SmartContract) richQueryCars(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	iter, err := APIstub.GetQueryResult(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer iter.Close()
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	results := []*QueryResult{}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		car := toCar(res.Key, res.Value)
+		if car == nil {
+			continue
+		}
+		car.expireLease(now)
+		details, err := joinOwner(APIstub, car)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		results = append(results, &QueryResult{Key: res.Key, Record: car, OwnerDetails: details})
+	}
+
+	resultsAsBytes, _ := json.Marshal(results)
+	return shim.Success(resultsAsBytes)
+}
+
+/*
+ * rebuildIndexes writes the index entries of every car, for ledgers created before
+ * cars were indexed, admins only. Cars written before owner ids only name their owner:
+ * the optional argument maps those names to owner ids (mspId/id) as a JSON object, and
+ * cars whose name is not mapped are left without an owner. Rewriting a car also drops
+ * the public owner name of older cars. Args: owner ids by name (optional)
+ */
+func (s *SmartContract) rebuildIndexes(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting owner ids by name or nothing")
+	}
+	if err := cid.AssertAttributeValue(APIstub, adminAttr, "true"); err != nil {
+		return shim.Error("Only admins with the " + adminAttr + " attribute can rebuild the indexes")
+	}
+	ownerIds := map[string]string{}
+	if len(args) == 1 && args[0] != "" {
+		if err := json.Unmarshal([]byte(args[0]), &ownerIds); err != nil {
+			return shim.Error("Expecting a JSON object of owner ids by name")
+		}
+	}
+
+	iter, err := APIstub.GetStateByRange("", "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer iter.Close()
+
+	count := 0
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		car := toCar(res.Key, res.Value)
+		if car == nil {
+			continue
+		}
+		if car.OwnerId == "" {
+			legacy := struct {
+				Owner string `json:"owner"`
+			}{}
+			if json.Unmarshal(res.Value, &legacy) == nil && ownerIds[legacy.Owner] != "" {
+				car.OwnerId = ownerIds[legacy.Owner]
+				// Drop the entry that indexed the car under no owner
+				unowned, err := APIstub.CreateCompositeKey(ownerIndex, []string{"", res.Key})
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				if err = APIstub.DelState(unowned); err != nil {
+					return shim.Error(err.Error())
+				}
+			}
+		}
+		if err = putCar(APIstub, res.Key, nil, car); err != nil {
+			return shim.Error(err.Error())
+		}
+		count++
+	}
+
+	return shim.Success([]byte(strconv.Itoa(count)))
+}
+
+// putCar writes car under key and moves its index entries from old, which is nil for a new car.
+// A new owner brings the hash of their registered details, the custody follows the lease.
+func putCar(APIstub shim.ChaincodeStubInterface, key string, old *Car, car *Car) error {
+	car.DocType = carDocType
+	now, err := txTime(APIstub)
+	if err != nil {
+		return err
+	}
+	car.expireLease(now)
+	if old == nil || old.OwnerId != car.OwnerId {
+		hash, err := ownerHash(APIstub, car.OwnerId)
+		if err != nil {
+			return err
+		}
+		car.OwnerHash = hash
+	}
+	carAsBytes, _ := json.Marshal(car)
+	if err := APIstub.PutState(key, carAsBytes); err != nil {
+		return err
+	}
+
+	entries := []struct{ index, old, value string }{
+		{ownerIndex, "", car.OwnerId},
+		{makeIndex, "", car.Make},
+		{colourIndex, "", car.Colour},
+	}
+	if old != nil {
+		entries[0].old, entries[1].old, entries[2].old = old.OwnerId, old.Make, old.Colour
+	}
+	for _, e := range entries {
+		if old != nil {
+			if e.old == e.value {
+				continue
+			}
+			oldKey, err := APIstub.CreateCompositeKey(e.index, []string{e.old, key})
+			if err != nil {
+				return err
+			}
+			if err = APIstub.DelState(oldKey); err != nil {
+				return err
+			}
+		}
+		indexKey, err := APIstub.CreateCompositeKey(e.index, []string{e.value, key})
+		if err != nil {
+			return err
+		}
+		// Only the key is needed, CouchDB does not accept a nil value
+		if err = APIstub.PutState(indexKey, []byte{0x00}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toCar decodes a car, returning nil for index entries and other documents
+func toCar(key string, carAsBytes []byte) *Car {
+	if key == "" || key[0] == 0x00 || carAsBytes == nil {
+		return nil
+	}
+	car := &Car{}
+	if err := json.Unmarshal(carAsBytes, car); err != nil {
+		return nil
+	}
+	if car.DocType != "" && car.DocType != carDocType {
+		return nil
+	}
+	// Cars written before the lifecycle was introduced count as registered
+	if car.Status == "" {
+		car.Status = statusRegistered
+	}
+	// and cars written before leasing are held by their owner
+	if car.Custodian == "" {
+		car.Custodian = car.OwnerId
+	}
+	return car
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"com.jerry/contract/keytime"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+ * Workshops append maintenance and accident records to a car. Records are
+ * composite keys record~vin with the transaction time and id as attributes,
+ * so that the log of a car reads back in the order it was written.
+ */
+const (
+	recordIndex = "record~vin"
+
+	// workshopAttr carries the name of the workshop allowed to add records
+	workshopAttr = "fabcar.workshop"
+
+	recordMaintenance = "maintenance"
+	recordAccident    = "accident"
+
+	// recordDateFormat dates records and the mileage of a car
+	recordDateFormat = "2006-01-02"
+)
+
+// CarRecord is one entry of the service history of a car
+type CarRecord struct {
+	TxId         string    `json:"txId"`
+	Type         string    `json:"type"` // maintenance or accident
+	Workshop     string    `json:"workshop"`
+	WorkshopId   string    `json:"workshopId"` // mspId/id of the workshop identity
+	Odometer     int       `json:"odometer"`
+	Date         string    `json:"date"` // YYYY-MM-DD
+	Description  string    `json:"description"`
+	DocumentHash string    `json:"documentHash"` // hex sha256 of the invoice or report
+	Rollback     bool      `json:"rollback"`     // odometer below an earlier reading
+	RecordedAt   time.Time `json:"recordedAt"`
+}
+
+/*
+ * addCarRecord appends a maintenance or accident record, workshops only. Records may be
+ * added late, so the reading is checked by date against the other records and the mileage
+ * of the car: a reading below one dated on or before it, or above one dated after it, is
+ * kept but flagged as an odometer rollback on the record and the car.
+ * Args: VIN, type, odometer, date (YYYY-MM-DD), description, document hash
+ */
+func (s *SmartContract) addCarRecord(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting VIN, type, odometer, date, description and document hash")
+	}
+
+	workshop, found, err := cid.GetAttributeValue(APIstub, workshopAttr)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found || workshop == "" {
+		return shim.Error("Only workshops with the " + workshopAttr + " attribute can add records")
+	}
+	workshopId, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.Status == statusScrapped {
+		return shim.Error("Car " + args[0] + " has been scrapped")
+	}
+	if args[1] != recordMaintenance && args[1] != recordAccident {
+		return shim.Error("Record type must be " + recordMaintenance + " or " + recordAccident)
+	}
+	odometer, err := strconv.Atoi(args[2])
+	if err != nil || odometer < 0 {
+		return shim.Error("Expecting non-negative integer value for odometer")
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	date, err := time.Parse(recordDateFormat, args[3])
+	if err != nil {
+		return shim.Error("Expecting YYYY-MM-DD for date")
+	}
+	if date.After(now) {
+		return shim.Error("Record date must not be in the future")
+	}
+	if args[4] == "" {
+		return shim.Error("Description must not be empty")
+	}
+	if hash, err := hex.DecodeString(args[5]); err != nil || len(hash) != 32 {
+		return shim.Error("Expecting hex encoded sha256 for document hash")
+	}
+	records, err := carRecords(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	record := &CarRecord{
+		TxId:         APIstub.GetTxID(),
+		Type:         args[1],
+		Workshop:     workshop,
+		WorkshopId:   workshopId,
+		Odometer:     odometer,
+		Date:         args[3],
+		Description:  args[4],
+		DocumentHash: args[5],
+		Rollback:     isRollback(records, car, args[3], odometer),
+		RecordedAt:   now,
+	}
+	key, err := APIstub.CreateCompositeKey(recordIndex, []string{args[0], keytime.Format(now), record.TxId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	recordAsBytes, _ := json.Marshal(record)
+	err = APIstub.PutState(key, recordAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// The mileage only goes up, a rollback marks the car for good
+	old := *car
+	if record.Rollback {
+		car.OdometerRollback = true
+	} else if odometer > car.Mileage {
+		car.Mileage, car.MileageDate = odometer, args[3]
+	}
+	err = putCar(APIstub, args[0], &old, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(recordAsBytes)
+}
+
+/*
+ * getCarRecords returns the maintenance and accident records of a car, oldest first. Args: VIN
+ */
+func (s *SmartContract) getCarRecords(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if _, err := getCar(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	records, err := carRecords(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recordsAsBytes, _ := json.Marshal(records)
+	return shim.Success(recordsAsBytes)
+}
+
+// carRecords loads the records of a car in the order they were written
+func carRecords(APIstub shim.ChaincodeStubInterface, vin string) ([]*CarRecord, error) {
+	iter, err := APIstub.GetStateByPartialCompositeKey(recordIndex, []string{vin})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	records := []*CarRecord{}
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		record := &CarRecord{}
+		if err = json.Unmarshal(res.Value, record); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal record %s", res.Key)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// isRollback tells whether a reading of odometer on date contradicts the other readings of
+// the car: its records, ignoring those already flagged, and its mileage on MileageDate. Older
+// cars have no mileage date, so their mileage bounds every record from below.
+func isRollback(records []*CarRecord, car *Car, date string, odometer int) bool {
+	readings := append([]*CarRecord{{Date: car.MileageDate, Odometer: car.Mileage}}, records...)
+	floor := 0
+	for _, r := range readings {
+		if r.Rollback {
+			continue
+		}
+		// YYYY-MM-DD dates compare as strings
+		if r.Date <= date {
+			if r.Odometer > floor {
+				floor = r.Odometer
+			}
+		} else if odometer > r.Odometer {
+			return true
+		}
+	}
+	return odometer < floor
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+ * Lifecycle of a car. A new car is registered, goes into service, and may be
+ * reported stolen and recovered any number of times until it is scrapped.
+ * Scrapped is final.
+ */
+const (
+	statusRegistered = "registered"
+	statusInService  = "in-service"
+	statusStolen     = "stolen"
+	statusScrapped   = "scrapped"
+)
+
+// carTransitions lists the statuses a car may move to from each status
+var carTransitions = map[string][]string{
+	statusRegistered: {statusInService, statusStolen, statusScrapped},
+	statusInService:  {statusStolen, statusScrapped},
+	statusStolen:     {statusInService, statusScrapped},
+	statusScrapped:   {},
+}
+
+// checkTransition fails if a car can not move from one status to another
+func checkTransition(from, to string) error {
+	next, ok := carTransitions[from]
+	if !ok {
+		return fmt.Errorf("Unknown car status %s", from)
+	}
+	if _, ok = carTransitions[to]; !ok {
+		return fmt.Errorf("Unknown car status %s", to)
+	}
+	for _, status := range next {
+		if status == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("A %s car can not become %s", from, to)
+}
+
+/*
+ * setCarStatus moves a car along its lifecycle, owners only. Args: VIN, status
+ */
+func (s *SmartContract) setCarStatus(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting VIN and status")
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != car.OwnerId {
+		return shim.Error("Only the owner of " + args[0] + " can change its status")
+	}
+	err = checkTransition(car.Status, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if args[1] == statusScrapped {
+		if err = checkNotLeased(args[0], car); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	old := *car
+	car.Status = args[1]
+	// A stolen or scrapped car can not change hands
+	car.Offer = nil
+	if args[1] == statusStolen || args[1] == statusScrapped {
+		if err = closeOpenListing(APIstub, args[0]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	err = putCar(APIstub, args[0], &old, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// TransferOffer is a pending change of owner, made by the current owner and
+// accepted or declined by the recipient before it expires
+type TransferOffer struct {
+	To        string    `json:"to"` // mspId/id of the recipient
+	Expires   time.Time `json:"expires"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Ownership is one owner of a car as recorded in the ledger history
+type Ownership struct {
+	TxId      string    `json:"txId"`
+	Timestamp time.Time `json:"timestamp"`
+	OwnerId   string    `json:"ownerId"`
+	OwnerHash string    `json:"ownerHash"`
+}
+
+/*
+ * offerTransfer lets the current owner offer a car to another client identity,
+ * replacing any pending offer. Args: car key, recipient mspId/id, expiry (RFC 3339)
+ */
+func (s *SmartContract) offerTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting car key, recipient and expiry")
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != car.OwnerId {
+		return shim.Error("Only the owner of " + args[0] + " can offer it")
+	}
+	if car.Status == statusStolen || car.Status == statusScrapped {
+		return shim.Error("A " + car.Status + " car can not change hands")
+	}
+	if err = checkNotLeased(args[0], car); err != nil {
+		return shim.Error(err.Error())
+	}
+	if listing, err := getListing(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	} else if listing != nil && listing.Status == listingOpen {
+		return shim.Error("Car " + args[0] + " is listed for sale")
+	}
+	if args[1] == "" || args[1] == caller {
+		return shim.Error("Recipient must be another identity")
+	}
+	expires, err := time.Parse(time.RFC3339, args[2])
+	if err != nil {
+		return shim.Error("Expecting RFC 3339 time for expiry")
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !expires.After(now) {
+		return shim.Error("Expiry must be in the future")
+	}
+
+	old := *car
+	car.Offer = &TransferOffer{To: args[1], Expires: expires, CreatedAt: now}
+	err = putCar(APIstub, args[0], &old, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * acceptTransfer makes the recipient of a pending offer the owner of the car. Args: car key
+ */
+func (s *SmartContract) acceptTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	car, offer, err := pendingOffer(APIstub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.After(offer.Expires) {
+		return shim.Error("The offer for " + args[0] + " has expired")
+	}
+	if err = checkNotLeased(args[0], car); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	old := *car
+	car.OwnerId, car.Offer = offer.To, nil
+	err = putCar(APIstub, args[0], &old, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * declineTransfer lets the recipient reject a pending offer, expired or not. Args: car key
+ */
+func (s *SmartContract) declineTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	car, _, err := pendingOffer(APIstub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	old := *car
+	car.Offer = nil
+	err = putCar(APIstub, args[0], &old, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * cancelTransfer lets the owner withdraw a pending offer, expired or not. Args: car key
+ */
+func (s *SmartContract) cancelTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerId(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != car.OwnerId {
+		return shim.Error("Only the owner of " + args[0] + " can cancel its offer")
+	}
+	if car.Offer == nil {
+		return shim.Error("No pending offer for " + args[0])
+	}
+
+	old := *car
+	car.Offer = nil
+	err = putCar(APIstub, args[0], &old, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * getCarHistory returns every owner of a car, oldest first, with the transaction
+ * that made them owner. Args: car key
+ */
+func (s *SmartContract) getCarHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	iter, err := APIstub.GetHistoryForKey(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer iter.Close()
+
+	owners := []*Ownership{}
+	for iter.HasNext() {
+		mod, err := iter.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if mod.IsDelete {
+			continue
+		}
+		car := toCar(args[0], mod.Value)
+		if car == nil {
+			continue
+		}
+		// Offers and other updates keep the owner, only changes are reported
+		if n := len(owners); n > 0 && owners[n-1].OwnerId == car.OwnerId {
+			continue
+		}
+		ts, _ := ptypes.Timestamp(mod.Timestamp)
+		owners = append(owners, &Ownership{TxId: mod.TxId, Timestamp: ts, OwnerId: car.OwnerId, OwnerHash: car.OwnerHash})
+	}
+
+	ownersAsBytes, _ := json.Marshal(owners)
+	return shim.Success(ownersAsBytes)
+}
+
+// pendingOffer loads the car of args[0] and its offer, which must be addressed to the caller
+func pendingOffer(APIstub shim.ChaincodeStubInterface, args []string) (*Car, *TransferOffer, error) {
+	if len(args) != 1 {
+		return nil, nil, fmt.Errorf("Incorrect number of arguments. Expecting 1")
+	}
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if car.Offer == nil {
+		return nil, nil, fmt.Errorf("No pending offer for %s", args[0])
+	}
+	caller, err := callerId(APIstub)
+	if err != nil {
+		return nil, nil, err
+	}
+	if caller != car.Offer.To {
+		return nil, nil, fmt.Errorf("The offer for %s is not addressed to the caller", args[0])
+	}
+	return car, car.Offer, nil
+}
+
+// getCar loads a car, failing if it does not exist
+func getCar(APIstub shim.ChaincodeStubInterface, key string) (*Car, error) {
+	carAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get car %s", key)
+	}
+	car := toCar(key, carAsBytes)
+	if car == nil {
+		return nil, fmt.Errorf("Car %s does not exist", key)
+	}
+	now, err := txTime(APIstub)
+	if err != nil {
+		return nil, err
+	}
+	car.expireLease(now)
+	return car, nil
+}
+
+// callerId names the client identity of the transaction as mspId/id
+func callerId(APIstub shim.ChaincodeStubInterface) (string, error) {
+	mspId, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return "", err
+	}
+	id, err := cid.GetID(APIstub)
+	if err != nil {
+		return "", err
+	}
+	return mspId + "/" + id, nil
+}
+
+func txTime(APIstub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return ptypes.Timestamp(ts)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+)
+
+/*
+ * Cars are keyed by their 17 character vehicle identification number (ISO 3779).
+ * Position 9 is the check digit: the letters and digits are transliterated to
+ * numbers, weighted by position and summed, and the sum modulo 11 is the check
+ * digit, with 10 written as X. I, O and Q never appear in a VIN.
+ */
+const vinLength = 17
+
+var vinWeights = [vinLength]int{8, 7, 6, 5, 4, 3, 2, 10, 0, 9, 8, 7, 6, 5, 4, 3, 2}
+
+// vinValue transliterates a VIN character, returning -1 for invalid ones
+func vinValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'A' && c <= 'H':
+		return int(c-'A') + 1
+	case c >= 'J' && c <= 'N':
+		return int(c-'J') + 1
+	case c == 'P':
+		return 7
+	case c == 'R':
+		return 9
+	case c >= 'S' && c <= 'Z':
+		return int(c-'S') + 2
+	}
+	return -1
+}
+
+// vinCheckDigit computes the check digit of a VIN of valid characters
+func vinCheckDigit(vin string) byte {
+	sum := 0
+	for i := 0; i < vinLength; i++ {
+		sum += vinValue(vin[i]) * vinWeights[i]
+	}
+	if sum%11 == 10 {
+		return 'X'
+	}
+	return byte('0' + sum%11)
+}
+
+// validateVIN checks the length, characters and check digit of a VIN
+func validateVIN(vin string) error {
+	if len(vin) != vinLength {
+		return fmt.Errorf("VIN %s must have %d characters", vin, vinLength)
+	}
+	for i := 0; i < vinLength; i++ {
+		if vinValue(vin[i]) < 0 {
+			return fmt.Errorf("VIN %s contains invalid character %q", vin, vin[i])
+		}
+	}
+	if check := vinCheckDigit(vin); vin[8] != check {
+		return fmt.Errorf("VIN %s has check digit %c, expected %c", vin, vin[8], check)
+	}
+	return nil
+}
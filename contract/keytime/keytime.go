@@ -0,0 +1,18 @@
+// Package keytime formats transaction times for use inside ledger keys.
+// The layout is fixed width UTC, so keys holding it sort in time order.
+package keytime
+
+import "time"
+
+// Layout is the time layout used inside keys
+const Layout = "20060102150405.000000000"
+
+// Format returns t in UTC laid out for a key.
+func Format(t time.Time) string {
+	return t.UTC().Format(Layout)
+}
+
+// Parse reads a time written by Format.
+func Parse(value string) (time.Time, error) {
+	return time.Parse(Layout, value)
+}
@@ -0,0 +1,316 @@
+// Package shimtest wraps shim.MockStub with caller identities so that chaincode
+// tests can exercise the cid based access control paths. Identities are
+// throwaway self-signed certificates carrying Fabric attributes and OUs,
+// serialized the same way a peer hands the creator to the chaincode.
+package shimtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// attrOID is the certificate extension in which the Fabric CA stores attributes
+var attrOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// Identity is a caller identity: an MSP ID and an X.509 certificate.
+type Identity struct {
+	MSPID   string
+	Cert    *x509.Certificate
+	Key     *ecdsa.PrivateKey // nil for identities loaded from PEM
+	PEM     []byte
+	Creator []byte // serialized msp.SerializedIdentity
+}
+
+// NewIdentity mints a certificate for mspID with the given Fabric attributes
+// and organizational units.
+func NewIdentity(mspID string, attrs map[string]string, ous ...string) (*Identity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         "user" + serial.String(),
+			Organization:       []string{mspID},
+			OrganizationalUnit: ous,
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(24 * time.Hour),
+		KeyUsage:  x509.KeyUsageDigitalSignature,
+	}
+	if attrs != nil {
+		attrJSON, err := json.Marshal(map[string]interface{}{"attrs": attrs})
+		if err != nil {
+			return nil, err
+		}
+		tmpl.ExtraExtensions = []pkix.Extension{{Id: attrOID, Value: attrJSON}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	id, err := IdentityFromPEM(mspID, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	if err != nil {
+		return nil, err
+	}
+	id.Key = key
+	return id, nil
+}
+
+// IdentityFromPEM builds an identity from an existing certificate, e.g. one
+// issued by a Fabric CA.
+func IdentityFromPEM(mspID, certPEM string) (*Identity, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: []byte(certPEM)})
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{MSPID: mspID, Cert: cert, PEM: []byte(certPEM), Creator: creator}, nil
+}
+
+// ID returns the identifier cid.GetID reports for the identity.
+func (id *Identity) ID() (string, error) {
+	return cid.GetID(&shim.MockStub{Creator: id.Creator})
+}
+
+// Stub is a MockStub that invokes the chaincode as a chosen identity. Its
+// clock can be moved forward to test expiry without sleeping.
+type Stub struct {
+	*shim.MockStub
+	cc     shim.Chaincode
+	seq    int
+	offset time.Duration
+}
+
+// NewStub returns a stub for cc without a caller identity.
+func NewStub(name string, cc shim.Chaincode) *Stub {
+	return &Stub{MockStub: shim.NewMockStub(name, cc), cc: cc}
+}
+
+// As makes id the creator of the following transactions; nil clears it.
+func (s *Stub) As(id *Identity) *Stub {
+	if id == nil {
+		s.Creator = nil
+	} else {
+		s.Creator = id.Creator
+	}
+	return s
+}
+
+// Advance moves the timestamp of the following transactions forward by d.
+// It applies to Invoke, Call and InvokeTransient.
+func (s *Stub) Advance(d time.Duration) *Stub {
+	s.offset += d
+	return s
+}
+
+// Now returns the current time on the clock of the stub.
+func (s *Stub) Now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+// Init calls the chaincode Init with args in a new transaction.
+func (s *Stub) Init(args ...string) pb.Response {
+	return s.MockInit(s.nextTxID(), toBytes("init", args))
+}
+
+// Invoke calls fn with args in a new transaction.
+func (s *Stub) Invoke(fn string, args ...string) pb.Response {
+	return s.InvokeTransient(nil, fn, args...)
+}
+
+// InvokeVia calls fn with args as if the transaction proposal had been sent
+// to chaincode, which then invoked this one.
+func (s *Stub) InvokeVia(chaincode, fn string, args ...string) pb.Response {
+	sp, err := SignedProposal(chaincode)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return s.MockInvokeWithSignedProposal(s.nextTxID(), toBytes(fn, args), sp)
+}
+
+// InvokeTransient calls fn with args in a new transaction whose proposal
+// carries the transient map, which MockStub does not pass to the chaincode.
+func (s *Stub) InvokeTransient(transient map[string][]byte, fn string, args ...string) pb.Response {
+	ts, err := ptypes.TimestampProto(s.Now())
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txid := s.nextTxID()
+	s.MockTransactionStart(txid)
+	s.TxTimestamp = ts
+	res := s.cc.Invoke(&txStub{MockStub: s.MockStub, args: toBytes(fn, args), transient: transient})
+	s.MockTransactionEnd(txid)
+	return res
+}
+
+// txStub is the MockStub of one transaction with its own arguments and
+// transient map. It also deletes private data and runs paginated queries,
+// which MockStub does not implement.
+type txStub struct {
+	*shim.MockStub
+	args      [][]byte
+	transient map[string][]byte
+}
+
+func (t *txStub) GetArgs() [][]byte { return t.args }
+
+func (t *txStub) GetStringArgs() []string {
+	strargs := make([]string, 0, len(t.args))
+	for _, arg := range t.args {
+		strargs = append(strargs, string(arg))
+	}
+	return strargs
+}
+
+func (t *txStub) GetFunctionAndParameters() (string, []string) {
+	allargs := t.GetStringArgs()
+	if len(allargs) == 0 {
+		return "", []string{}
+	}
+	return allargs[0], allargs[1:]
+}
+
+func (t *txStub) GetTransient() (map[string][]byte, error) { return t.transient, nil }
+
+func (t *txStub) DelPrivateData(collection, key string) error {
+	delete(t.PvtState[collection], key)
+	return nil
+}
+
+// GetStateByRangeWithPagination reads up to pageSize keys from bookmark, or
+// from startKey on the first page. The bookmark returned is the next key, or
+// empty when the range is exhausted.
+func (t *txStub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iter, err := t.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return paginate(iter, pageSize, bookmark)
+}
+
+// GetStateByPartialCompositeKeyWithPagination pages through a partial
+// composite key query the same way as GetStateByRangeWithPagination.
+func (t *txStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iter, err := t.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return paginate(iter, pageSize, bookmark)
+}
+
+func paginate(iter shim.StateQueryIteratorInterface, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	defer iter.Close()
+	page := &pageIterator{}
+	meta := &pb.QueryResponseMetadata{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if kv.Key < bookmark {
+			continue
+		}
+		if int32(len(page.kvs)) == pageSize {
+			meta.Bookmark = kv.Key
+			break
+		}
+		page.kvs = append(page.kvs, kv)
+	}
+	meta.FetchedRecordsCount = int32(len(page.kvs))
+	return page, meta, nil
+}
+
+// pageIterator iterates over the key values of one page.
+type pageIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (p *pageIterator) HasNext() bool { return len(p.kvs) > 0 }
+
+func (p *pageIterator) Next() (*queryresult.KV, error) {
+	if len(p.kvs) == 0 {
+		return nil, errors.New("no more results")
+	}
+	kv := p.kvs[0]
+	p.kvs = p.kvs[1:]
+	return kv, nil
+}
+
+func (p *pageIterator) Close() error { return nil }
+
+// SignedProposal returns an unsigned proposal addressed to chaincode.
+func SignedProposal(chaincode string) (*pb.SignedProposal, error) {
+	ext, err := proto.Marshal(&pb.ChaincodeHeaderExtension{ChaincodeId: &pb.ChaincodeID{Name: chaincode}})
+	if err != nil {
+		return nil, err
+	}
+	chdr, err := proto.Marshal(&common.ChannelHeader{Extension: ext})
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := proto.Marshal(&common.Header{ChannelHeader: chdr})
+	if err != nil {
+		return nil, err
+	}
+	prop, err := proto.Marshal(&pb.Proposal{Header: hdr})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SignedProposal{ProposalBytes: prop}, nil
+}
+
+// Call invokes fn and returns its payload, turning an error status into an
+// error.
+func (s *Stub) Call(fn string, args ...string) ([]byte, error) {
+	res := s.Invoke(fn, args...)
+	if res.Status != shim.OK {
+		return nil, fmt.Errorf("%s failed: %s", fn, res.Message)
+	}
+	return res.Payload, nil
+}
+
+func (s *Stub) nextTxID() string {
+	s.seq++
+	return s.Name + "-tx" + strconv.Itoa(s.seq)
+}
+
+func toBytes(fn string, args []string) [][]byte {
+	b := [][]byte{[]byte(fn)}
+	for _, arg := range args {
+		b = append(b, []byte(arg))
+	}
+	return b
+}
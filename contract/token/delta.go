@@ -0,0 +1,159 @@
+// Delta storage writes each transfer as a signed delta per account under
+// its own key instead of rewriting the balance. Receivers are never read, so
+// transfers into one account do not conflict. Senders are: the overdraft
+// check reads the snapshot and range-scans the sender's deltas, and every
+// credit into that account adds a key to the scanned range. A spend therefore
+// still conflicts with concurrent spends from, and credits into, the same
+// account; deltas help hot receivers, not hot senders.
+
+package token
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	deltaObjectType = "Delta"
+
+	// StorageDelta is the storage mode that writes transfers as delta records
+	StorageDelta = "delta"
+)
+
+// UseDeltas switches the ledger to delta storage. The balance
+// key becomes a snapshot that Compact brings up to date.
+func UseDeltas(stub shim.ChaincodeStubInterface) error {
+	return putMeta(stub, "storage", StorageDelta)
+}
+
+// Deltas reports whether the ledger uses delta storage.
+func Deltas(stub shim.ChaincodeStubInterface) (bool, error) {
+	storage, err := getMeta(stub, "storage")
+	if err != nil {
+		return false, err
+	}
+	return storage == StorageDelta, nil
+}
+
+// MoveDelta transfers amount by writing a debit delta for from and a credit
+// delta for to. The caller must own the sender. Only the sender's snapshot
+// and deltas are read, to check its funds; the receiver's keys are not read,
+// so transfers into one account do not collide with each other.
+func MoveDelta(stub shim.ChaincodeStubInterface, from, to, amount string) error {
+	if err := AssertOwner(stub, from); err != nil {
+		return err
+	}
+	if from == to {
+		return errors.New("Sender and receiver must differ")
+	}
+	if err := checkAccount(from); err != nil {
+		return err
+	}
+	if err := checkAccount(to); err != nil {
+		return err
+	}
+	v, err := parsePositive(stub, amount)
+	if err != nil {
+		return err
+	}
+	fromBalance, _, err := sumDeltas(stub, from)
+	if err != nil {
+		return err
+	}
+	if fromBalance.Cmp(v) < 0 {
+		return fmt.Errorf("Insufficient balance in %s", from)
+	}
+	if err = putDelta(stub, from, new(big.Int).Neg(v)); err != nil {
+		return err
+	}
+	if err = putDelta(stub, to, v); err != nil {
+		return err
+	}
+	if err = record(stub, from, to, "out", v, fromBalance.Sub(fromBalance, v)); err != nil {
+		return err
+	}
+	// The receiver's balance is not read, its record leaves it empty
+	if err = record(stub, to, from, "in", v, nil); err != nil {
+		return err
+	}
+	return emit(stub, TransferEvent, &Transfer{From: from, To: to, Value: amount})
+}
+
+// Balance returns the snapshot of account plus its pending deltas. It
+// returns ErrAccountNotFound if the account has neither.
+func Balance(stub shim.ChaincodeStubInterface, account string) (*big.Int, error) {
+	balance, _, err := sumDeltas(stub, account)
+	return balance, err
+}
+
+// Compact folds the pending deltas of account into its snapshot and
+// deletes them. Run it periodically, not on the transfer path: it reads
+// every delta of the account and so conflicts with concurrent transfers.
+func Compact(stub shim.ChaincodeStubInterface, account string) (*big.Int, error) {
+	balance, keys, err := sumDeltas(stub, account)
+	if err != nil || len(keys) == 0 {
+		return balance, err
+	}
+	if balance.Sign() < 0 {
+		return nil, fmt.Errorf("Account %s is overdrawn by %s", account, new(big.Int).Neg(balance))
+	}
+	if err = putBalance(stub, account, balance); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if err = stub.DelState(key); err != nil {
+			return nil, errors.New("Failed to delete state")
+		}
+	}
+	return balance, nil
+}
+
+// sumDeltas adds the deltas of account to its snapshot and returns the
+// delta keys it read
+func sumDeltas(stub shim.ChaincodeStubInterface, account string) (*big.Int, []string, error) {
+	balance, err := BalanceOf(stub, account)
+	found := err == nil
+	if err == ErrAccountNotFound {
+		balance, err = new(big.Int), nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(deltaObjectType, []string{account})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iter.Close()
+
+	var keys []string
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		delta, ok := new(big.Int).SetString(string(res.Value), 10)
+		if !ok {
+			return nil, nil, fmt.Errorf("Corrupted delta stored for %s", account)
+		}
+		balance.Add(balance, delta)
+		keys = append(keys, res.Key)
+	}
+	if !found && len(keys) == 0 {
+		return nil, nil, ErrAccountNotFound
+	}
+	return balance, keys, nil
+}
+
+// putDelta writes the change of account in the current transaction, the
+// transaction ID keeps concurrent deltas on separate keys
+func putDelta(stub shim.ChaincodeStubInterface, account string, delta *big.Int) error {
+	key, err := stub.CreateCompositeKey(deltaObjectType, []string{account, stub.GetTxID()})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte(delta.String()))
+}
@@ -0,0 +1,127 @@
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"com.jerry/contract/keytime"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	recordObjectType = "TransferRecord"
+
+	// MaxPageSize caps the number of records returned by one History call
+	MaxPageSize = 100
+)
+
+// Record is one side of a balance change as seen from Account. Counterparty
+// is empty for mints and burns. Balance is the account balance right after
+// the change, empty for the receiver of a delta transfer.
+type Record struct {
+	TxId         string    `json:"txId"`
+	Timestamp    time.Time `json:"timestamp"`
+	Account      string    `json:"account"`
+	Counterparty string    `json:"counterparty"`
+	Direction    string    `json:"direction"` // in or out
+	Amount       string    `json:"amount"`
+	Balance      string    `json:"balance"`
+}
+
+// Page is a page of History results. Bookmark is empty on the last page.
+type Page struct {
+	Records  []*Record `json:"records"`
+	Bookmark string    `json:"bookmark"`
+}
+
+// History returns the records of account whose timestamps fall within
+// [from, to], oldest first. Zero times leave the range open. Pass the
+// bookmark of the previous page to continue. It only reads world state, so
+// it works without the peer history database.
+func History(stub shim.ChaincodeStubInterface, account string, from, to time.Time, pageSize int, bookmark string) (*Page, error) {
+	if pageSize <= 0 || pageSize > MaxPageSize {
+		return nil, fmt.Errorf("Page size must be between 1 and %d", MaxPageSize)
+	}
+	iter, err := stub.GetStateByPartialCompositeKey(recordObjectType, []string{account})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	page := &Page{Records: []*Record{}}
+	lastKey := ""
+	for iter.HasNext() {
+		res, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if bookmark != "" && res.Key <= bookmark {
+			continue
+		}
+		_, attrs, err := stub.SplitCompositeKey(res.Key)
+		if err != nil || len(attrs) < 2 {
+			continue
+		}
+		ts, err := keytime.Parse(attrs[1])
+		if err != nil {
+			continue
+		}
+		if !from.IsZero() && ts.Before(from) {
+			continue
+		}
+		if !to.IsZero() && ts.After(to) {
+			break
+		}
+		if len(page.Records) == pageSize {
+			page.Bookmark = lastKey
+			break
+		}
+		var r Record
+		if err = json.Unmarshal(res.Value, &r); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal transfer record %s", res.Key)
+		}
+		page.Records = append(page.Records, &r)
+		lastKey = res.Key
+	}
+	return page, nil
+}
+
+// record writes the history entry of account for the current transaction,
+// balance is nil when it is not known
+func record(stub shim.ChaincodeStubInterface, account, counterparty, direction string, amount, balance *big.Int) error {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	txTime, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return err
+	}
+	decimals, err := Decimals(stub)
+	if err != nil {
+		return err
+	}
+	r := &Record{
+		TxId:         stub.GetTxID(),
+		Timestamp:    txTime,
+		Account:      account,
+		Counterparty: counterparty,
+		Direction:    direction,
+		Amount:       FormatAmount(amount, decimals),
+	}
+	if balance != nil {
+		r.Balance = FormatAmount(balance, decimals)
+	}
+	key, err := stub.CreateCompositeKey(recordObjectType, []string{account, keytime.Format(txTime), r.TxId, direction})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, data)
+}
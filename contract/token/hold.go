@@ -0,0 +1,97 @@
+package token
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const holdObjectType = "Hold"
+
+// Hold moves amount out of account into the named hold, e.g. an escrow.
+// Held funds stay part of the total supply but cannot be moved by transfers
+// until they are released.
+func Hold(stub shim.ChaincodeStubInterface, account, hold, amount string) error {
+	v, err := parsePositive(stub, amount)
+	if err != nil {
+		return err
+	}
+	balance, err := BalanceOf(stub, account)
+	if err != nil {
+		return err
+	}
+	if balance.Cmp(v) < 0 {
+		return fmt.Errorf("Insufficient balance in %s", account)
+	}
+	held, err := Held(stub, hold)
+	if err != nil {
+		return err
+	}
+	if err = putBalance(stub, account, balance.Sub(balance, v)); err != nil {
+		return err
+	}
+	if err = putHeld(stub, hold, held.Add(held, v)); err != nil {
+		return err
+	}
+	return record(stub, account, hold, "out", v, balance)
+}
+
+// Release pays amount from the named hold to account.
+func Release(stub shim.ChaincodeStubInterface, hold, account, amount string) error {
+	if err := checkAccount(account); err != nil {
+		return err
+	}
+	v, err := parsePositive(stub, amount)
+	if err != nil {
+		return err
+	}
+	held, err := Held(stub, hold)
+	if err != nil {
+		return err
+	}
+	if held.Cmp(v) < 0 {
+		return fmt.Errorf("Insufficient funds held by %s", hold)
+	}
+	balance, err := BalanceOf(stub, account)
+	if err == ErrAccountNotFound {
+		balance, err = new(big.Int), nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = putHeld(stub, hold, held.Sub(held, v)); err != nil {
+		return err
+	}
+	if err = putBalance(stub, account, balance.Add(balance, v)); err != nil {
+		return err
+	}
+	if err = record(stub, account, hold, "in", v, balance); err != nil {
+		return err
+	}
+	return emit(stub, TransferEvent, &Transfer{From: hold, To: account, Value: amount})
+}
+
+// Held returns the base units currently in the named hold.
+func Held(stub shim.ChaincodeStubInterface, hold string) (*big.Int, error) {
+	key, err := stub.CreateCompositeKey(holdObjectType, []string{hold})
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get state")
+	}
+	return parseStored(hold, value)
+}
+
+func putHeld(stub shim.ChaincodeStubInterface, hold string, v *big.Int) error {
+	key, err := stub.CreateCompositeKey(holdObjectType, []string{hold})
+	if err != nil {
+		return err
+	}
+	if v.Sign() == 0 {
+		return stub.DelState(key)
+	}
+	return stub.PutState(key, []byte(v.String()))
+}
@@ -0,0 +1,484 @@
+// Package token implements a fungible token ledger on top of the world state.
+// Balances are stored under the plain account name as an integer number of
+// base units, so the account keys stay compatible with the original
+// asset-transfer examples. Amounts passed in and returned are decimal strings
+// with at most Decimals fractional digits.
+package token
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+)
+
+const (
+	// IssuerAttr is the certificate attribute that allows mint and burn
+	IssuerAttr = "token.issuer"
+	// AccountAttr is the certificate attribute naming the caller's account
+	// for transfers, approve and transferFrom
+	AccountAttr = "token.account"
+
+	// TransferEvent is emitted for transfers, mints (empty From) and burns (empty To)
+	TransferEvent = "Transfer"
+	// ApprovalEvent is emitted when an allowance is set
+	ApprovalEvent = "Approval"
+
+	// MaxDecimals limits the precision chosen at genesis
+	MaxDecimals = 18
+
+	metaObjectType      = "Token"
+	allowanceObjectType = "Allowance"
+)
+
+// ErrAccountNotFound is returned when an account has no balance on the ledger
+var ErrAccountNotFound = errors.New("Entity not found")
+
+// Transfer is the payload of TransferEvent
+type Transfer struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Value string `json:"value"`
+}
+
+// Approval is the payload of ApprovalEvent
+type Approval struct {
+	Owner   string `json:"owner"`
+	Spender string `json:"spender"`
+	Value   string `json:"value"`
+}
+
+// Allocation is a genesis balance
+type Allocation struct {
+	Account string
+	Amount  string
+}
+
+// Genesis sets the precision and writes the initial balances and supply.
+// Each account may be allocated once.
+func Genesis(stub shim.ChaincodeStubInterface, decimals int, allocations ...Allocation) error {
+	if decimals < 0 || decimals > MaxDecimals {
+		return fmt.Errorf("decimals must be between 0 and %d", MaxDecimals)
+	}
+	if err := putMeta(stub, "decimals", strconv.Itoa(decimals)); err != nil {
+		return err
+	}
+	supply := new(big.Int)
+	seen := map[string]bool{}
+	for _, a := range allocations {
+		if err := checkAccount(a.Account); err != nil {
+			return err
+		}
+		// A repeated account would be counted twice in the supply
+		if seen[a.Account] {
+			return fmt.Errorf("Account %s is allocated more than once", a.Account)
+		}
+		seen[a.Account] = true
+		v, err := ParseAmount(a.Amount, decimals)
+		if err != nil {
+			return err
+		}
+		if err = putBalance(stub, a.Account, v); err != nil {
+			return err
+		}
+		supply.Add(supply, v)
+	}
+	return putMeta(stub, "supply", supply.String())
+}
+
+// Decimals returns the precision set at genesis, 0 if none was set.
+func Decimals(stub shim.ChaincodeStubInterface) (int, error) {
+	value, err := getMeta(stub, "decimals")
+	if err != nil || value == "" {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// TotalSupply returns the number of base units in circulation.
+func TotalSupply(stub shim.ChaincodeStubInterface) (*big.Int, error) {
+	value, err := getMeta(stub, "supply")
+	if err != nil {
+		return nil, err
+	}
+	return parseStored("total supply", []byte(value))
+}
+
+// BalanceOf returns the balance of account in base units.
+func BalanceOf(stub shim.ChaincodeStubInterface, account string) (*big.Int, error) {
+	value, err := stub.GetState(account)
+	if err != nil {
+		return nil, errors.New("Failed to get state")
+	}
+	if value == nil {
+		return nil, ErrAccountNotFound
+	}
+	return parseStored(account, value)
+}
+
+// Move transfers amount from one account to another. The caller must own
+// the sender, which must exist and hold enough funds; the receiver is
+// created if necessary.
+func Move(stub shim.ChaincodeStubInterface, from, to, amount string) error {
+	if err := AssertOwner(stub, from); err != nil {
+		return err
+	}
+	v, err := parsePositive(stub, amount)
+	if err != nil {
+		return err
+	}
+	if err = move(stub, from, to, v); err != nil {
+		return err
+	}
+	return emit(stub, TransferEvent, &Transfer{From: from, To: to, Value: amount})
+}
+
+// Mint creates amount new tokens in account, issuers only.
+func Mint(stub shim.ChaincodeStubInterface, account, amount string) error {
+	if err := cid.AssertAttributeValue(stub, IssuerAttr, "true"); err != nil {
+		return err
+	}
+	return Credit(stub, account, amount)
+}
+
+// Burn destroys amount tokens held by account, issuers only.
+func Burn(stub shim.ChaincodeStubInterface, account, amount string) error {
+	if err := cid.AssertAttributeValue(stub, IssuerAttr, "true"); err != nil {
+		return err
+	}
+	return Debit(stub, account, amount)
+}
+
+// Credit adds amount to account and to the supply without checking the
+// caller. It is meant for callers that authorize the change themselves,
+// such as a bridge receiving funds from another ledger.
+func Credit(stub shim.ChaincodeStubInterface, account, amount string) error {
+	if err := checkAccount(account); err != nil {
+		return err
+	}
+	v, err := parsePositive(stub, amount)
+	if err != nil {
+		return err
+	}
+	balance, err := BalanceOf(stub, account)
+	if err == ErrAccountNotFound {
+		balance, err = new(big.Int), nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = putBalance(stub, account, balance.Add(balance, v)); err != nil {
+		return err
+	}
+	if err = record(stub, account, "", "in", v, balance); err != nil {
+		return err
+	}
+	if err = addSupply(stub, v); err != nil {
+		return err
+	}
+	return emit(stub, TransferEvent, &Transfer{To: account, Value: amount})
+}
+
+// Debit takes amount out of account and the supply without checking the
+// caller, see Credit.
+func Debit(stub shim.ChaincodeStubInterface, account, amount string) error {
+	v, err := parsePositive(stub, amount)
+	if err != nil {
+		return err
+	}
+	balance, err := BalanceOf(stub, account)
+	if err != nil {
+		return err
+	}
+	if balance.Cmp(v) < 0 {
+		return fmt.Errorf("Insufficient balance in %s", account)
+	}
+	if err = putBalance(stub, account, balance.Sub(balance, v)); err != nil {
+		return err
+	}
+	if err = record(stub, account, "", "out", v, balance); err != nil {
+		return err
+	}
+	if err = addSupply(stub, new(big.Int).Neg(v)); err != nil {
+		return err
+	}
+	return emit(stub, TransferEvent, &Transfer{From: account, Value: amount})
+}
+
+// Remove deletes account and takes its balance out of the supply, issuers only.
+func Remove(stub shim.ChaincodeStubInterface, account string) error {
+	if err := cid.AssertAttributeValue(stub, IssuerAttr, "true"); err != nil {
+		return err
+	}
+	balance, err := BalanceOf(stub, account)
+	if err == ErrAccountNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = stub.DelState(account); err != nil {
+		return errors.New("Failed to delete state")
+	}
+	return addSupply(stub, balance.Neg(balance))
+}
+
+// Approve lets spender move up to amount from the caller's account.
+func Approve(stub shim.ChaincodeStubInterface, spender, amount string) error {
+	owner, err := CallerAccount(stub)
+	if err != nil {
+		return err
+	}
+	if err = checkAccount(spender); err != nil {
+		return err
+	}
+	decimals, err := Decimals(stub)
+	if err != nil {
+		return err
+	}
+	v, err := ParseAmount(amount, decimals)
+	if err != nil {
+		return err
+	}
+	key, err := stub.CreateCompositeKey(allowanceObjectType, []string{owner, spender})
+	if err != nil {
+		return err
+	}
+	if err = stub.PutState(key, []byte(v.String())); err != nil {
+		return err
+	}
+	return emit(stub, ApprovalEvent, &Approval{Owner: owner, Spender: spender, Value: amount})
+}
+
+// Allowance returns how many base units spender may still move from owner.
+func Allowance(stub shim.ChaincodeStubInterface, owner, spender string) (*big.Int, error) {
+	key, err := stub.CreateCompositeKey(allowanceObjectType, []string{owner, spender})
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get state")
+	}
+	if value == nil {
+		return new(big.Int), nil
+	}
+	return parseStored("allowance", value)
+}
+
+// TransferFrom moves amount from owner to another account on behalf of the
+// caller, consuming the caller's allowance.
+func TransferFrom(stub shim.ChaincodeStubInterface, owner, to, amount string) error {
+	spender, err := CallerAccount(stub)
+	if err != nil {
+		return err
+	}
+	v, err := parsePositive(stub, amount)
+	if err != nil {
+		return err
+	}
+	allowance, err := Allowance(stub, owner, spender)
+	if err != nil {
+		return err
+	}
+	if allowance.Cmp(v) < 0 {
+		return fmt.Errorf("Allowance of %s for %s is insufficient", spender, owner)
+	}
+	key, err := stub.CreateCompositeKey(allowanceObjectType, []string{owner, spender})
+	if err != nil {
+		return err
+	}
+	if err = stub.PutState(key, []byte(allowance.Sub(allowance, v).String())); err != nil {
+		return err
+	}
+	if err = move(stub, owner, to, v); err != nil {
+		return err
+	}
+	return emit(stub, TransferEvent, &Transfer{From: owner, To: to, Value: amount})
+}
+
+// CallerAccount returns the account named by the caller's AccountAttr attribute.
+func CallerAccount(stub shim.ChaincodeStubInterface) (string, error) {
+	account, found, err := cid.GetAttributeValue(stub, AccountAttr)
+	if err != nil {
+		return "", err
+	}
+	if !found || account == "" {
+		return "", fmt.Errorf("Caller has no %s attribute", AccountAttr)
+	}
+	return account, nil
+}
+
+// AssertOwner checks that the caller's AccountAttr attribute names account.
+func AssertOwner(stub shim.ChaincodeStubInterface, account string) error {
+	caller, err := CallerAccount(stub)
+	if err != nil {
+		return err
+	}
+	if caller != account {
+		return fmt.Errorf("Caller does not own account %s", account)
+	}
+	return nil
+}
+
+// Format renders base units of stub's token as a decimal string.
+func Format(stub shim.ChaincodeStubInterface, v *big.Int) (string, error) {
+	decimals, err := Decimals(stub)
+	if err != nil {
+		return "", err
+	}
+	return FormatAmount(v, decimals), nil
+}
+
+// ParseAmount converts a non-negative decimal string into base units.
+func ParseAmount(s string, decimals int) (*big.Int, error) {
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+		if frac == "" {
+			return nil, fmt.Errorf("Invalid amount %s", s)
+		}
+	}
+	if whole == "" || len(frac) > decimals || !isDigits(whole) || !isDigits(frac) {
+		return nil, fmt.Errorf("Invalid amount %s, expecting a non-negative number with at most %d decimals", s, decimals)
+	}
+	v, _ := new(big.Int).SetString(whole+frac+strings.Repeat("0", decimals-len(frac)), 10)
+	return v, nil
+}
+
+// FormatAmount renders base units as a decimal string with the given precision.
+func FormatAmount(v *big.Int, decimals int) string {
+	if decimals == 0 {
+		return v.String()
+	}
+	s := new(big.Int).Abs(v).String()
+	if len(s) <= decimals {
+		s = strings.Repeat("0", decimals-len(s)+1) + s
+	}
+	s = s[:len(s)-decimals] + "." + s[len(s)-decimals:]
+	if v.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+func move(stub shim.ChaincodeStubInterface, from, to string, v *big.Int) error {
+	if from == to {
+		return errors.New("Sender and receiver must differ")
+	}
+	if err := checkAccount(to); err != nil {
+		return err
+	}
+	fromBalance, err := BalanceOf(stub, from)
+	if err != nil {
+		return err
+	}
+	if fromBalance.Cmp(v) < 0 {
+		return fmt.Errorf("Insufficient balance in %s", from)
+	}
+	toBalance, err := BalanceOf(stub, to)
+	if err == ErrAccountNotFound {
+		toBalance, err = new(big.Int), nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = putBalance(stub, from, fromBalance.Sub(fromBalance, v)); err != nil {
+		return err
+	}
+	if err = putBalance(stub, to, toBalance.Add(toBalance, v)); err != nil {
+		return err
+	}
+	if err = record(stub, from, to, "out", v, fromBalance); err != nil {
+		return err
+	}
+	return record(stub, to, from, "in", v, toBalance)
+}
+
+func parsePositive(stub shim.ChaincodeStubInterface, amount string) (*big.Int, error) {
+	decimals, err := Decimals(stub)
+	if err != nil {
+		return nil, err
+	}
+	v, err := ParseAmount(amount, decimals)
+	if err != nil {
+		return nil, err
+	}
+	if v.Sign() == 0 {
+		return nil, errors.New("Amount must be positive")
+	}
+	return v, nil
+}
+
+func parseStored(name string, value []byte) (*big.Int, error) {
+	if len(value) == 0 {
+		return new(big.Int), nil
+	}
+	v, ok := new(big.Int).SetString(string(value), 10)
+	if !ok || v.Sign() < 0 {
+		return nil, fmt.Errorf("Corrupted value stored for %s", name)
+	}
+	return v, nil
+}
+
+func putBalance(stub shim.ChaincodeStubInterface, account string, v *big.Int) error {
+	return stub.PutState(account, []byte(v.String()))
+}
+
+func addSupply(stub shim.ChaincodeStubInterface, delta *big.Int) error {
+	supply, err := TotalSupply(stub)
+	if err != nil {
+		return err
+	}
+	return putMeta(stub, "supply", supply.Add(supply, delta).String())
+}
+
+func getMeta(stub shim.ChaincodeStubInterface, name string) (string, error) {
+	key, err := stub.CreateCompositeKey(metaObjectType, []string{name})
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return "", errors.New("Failed to get state")
+	}
+	return string(value), nil
+}
+
+func putMeta(stub shim.ChaincodeStubInterface, name, value string) error {
+	key, err := stub.CreateCompositeKey(metaObjectType, []string{name})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte(value))
+}
+
+func emit(stub shim.ChaincodeStubInterface, name string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(name, data)
+}
+
+// checkAccount keeps account names out of the composite key namespace
+func checkAccount(account string) error {
+	if account == "" || account[0] == 0x00 {
+		return fmt.Errorf("Invalid account name %q", account)
+	}
+	return nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,298 @@
+package token
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+
+	"com.jerry/contract/shimtest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// noopChaincode lets the tests drive the token functions inside mock transactions
+type noopChaincode struct{}
+
+func (noopChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response   { return shim.Success(nil) }
+func (noopChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response { return shim.Success(nil) }
+
+func inTx(stub *shim.MockStub, fn func() error) error {
+	stub.MockTransactionStart("tx")
+	defer stub.MockTransactionEnd("tx")
+	return fn()
+}
+
+// as makes the owner of account the creator of the following transactions
+func as(t *testing.T, stub *shim.MockStub, account string) *shim.MockStub {
+	id, err := shimtest.NewIdentity("Org1MSP", map[string]string{AccountAttr: account})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.Creator = id.Creator
+	return stub
+}
+
+func balance(t *testing.T, stub *shim.MockStub, account string) string {
+	v, err := BalanceOf(stub, account)
+	if err != nil {
+		t.Fatal(account, err)
+	}
+	return v.String()
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in       string
+		decimals int
+		want     string
+	}{
+		{"123", 0, "123"},
+		{"1.5", 2, "150"},
+		{"0.01", 2, "1"},
+		{"10", 2, "1000"},
+		{"-1", 0, ""},
+		{"1.234", 2, ""},
+		{"1.", 2, ""},
+		{".5", 2, ""},
+		{"1e3", 0, ""},
+		{"", 0, ""},
+	}
+	for _, test := range tests {
+		v, err := ParseAmount(test.in, test.decimals)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q should be rejected", test.in)
+			}
+			continue
+		}
+		if err != nil || v.String() != test.want {
+			t.Errorf("%q: expected %s, got %v %v", test.in, test.want, v, err)
+		}
+	}
+
+	for _, test := range []struct {
+		v        int64
+		decimals int
+		want     string
+	}{{150, 2, "1.50"}, {1, 2, "0.01"}, {0, 2, "0.00"}, {123, 0, "123"}} {
+		if got := FormatAmount(big.NewInt(test.v), test.decimals); got != test.want {
+			t.Errorf("FormatAmount(%d, %d) = %s, expected %s", test.v, test.decimals, got, test.want)
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	stub := shim.NewMockStub("token", noopChaincode{})
+	err := inTx(stub, func() error {
+		return Genesis(stub, 2, Allocation{"A", "10"}, Allocation{"B", "0.5"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance(t, stub, "A") != "1000" || balance(t, stub, "B") != "50" {
+		t.Fatal("unexpected genesis balances")
+	}
+	dup := shim.NewMockStub("token", noopChaincode{})
+	if err = inTx(dup, func() error { return Genesis(dup, 0, Allocation{"A", "10"}, Allocation{"A", "5"}) }); err == nil {
+		t.Fatal("genesis should reject an account allocated twice")
+	}
+
+	if err = inTx(stub, func() error { return Move(as(t, stub, "B"), "A", "C", "2.25") }); err == nil {
+		t.Fatal("only the owner of A may transfer from it")
+	}
+	if err = inTx(stub, func() error { return Move(as(t, stub, "A"), "A", "C", "2.25") }); err != nil {
+		t.Fatal(err)
+	}
+	event := <-stub.ChaincodeEventsChannel
+	var transfer Transfer
+	if event.EventName != TransferEvent || json.Unmarshal(event.Payload, &transfer) != nil || transfer.To != "C" {
+		t.Fatal("unexpected transfer event", event)
+	}
+	if balance(t, stub, "A") != "775" || balance(t, stub, "C") != "225" {
+		t.Fatal("unexpected balances after transfer")
+	}
+
+	for _, bad := range [][3]string{
+		{"A", "B", "-1"},
+		{"A", "B", "0"},
+		{"A", "B", "7.76"},
+		{"A", "A", "1"},
+		{"X", "B", "1"},
+	} {
+		if err = inTx(stub, func() error { return Move(as(t, stub, bad[0]), bad[0], bad[1], bad[2]) }); err == nil {
+			t.Error("transfer should fail", bad)
+		}
+	}
+
+	stub.State["B"] = []byte("garbage")
+	if err = inTx(stub, func() error { return Move(as(t, stub, "A"), "A", "B", "1") }); err == nil {
+		t.Error("transfer to a corrupted balance should fail")
+	}
+	stub.State["B"] = []byte("50")
+
+	if err = inTx(stub, func() error { return Remove(stub, "C") }); err == nil {
+		t.Fatal("remove without the issuer attribute should fail")
+	}
+	issuer, err := shimtest.NewIdentity("Org1MSP", map[string]string{IssuerAttr: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.Creator = issuer.Creator
+	if err = inTx(stub, func() error { return Remove(stub, "C") }); err != nil {
+		t.Fatal(err)
+	}
+	supply, err := TotalSupply(stub)
+	if err != nil || supply.String() != "825" {
+		t.Fatal("supply should drop with removed balance", supply, err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	stub := shim.NewMockStub("token", noopChaincode{})
+	if err := inTx(stub, func() error { return Genesis(stub, 0, Allocation{"A", "100"}, Allocation{"B", "0"}) }); err != nil {
+		t.Fatal(err)
+	}
+	for _, move := range [][3]string{{"A", "B", "10"}, {"B", "A", "3"}, {"A", "C", "20"}} {
+		if err := inTx(stub, func() error { return Move(as(t, stub, move[0]), move[0], move[1], move[2]) }); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var records []*Record
+	bookmark := ""
+	for {
+		page, err := History(stub, "A", time.Time{}, time.Time{}, 2, bookmark)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, page.Records...)
+		if page.Bookmark == "" {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+	if len(records) != 3 {
+		t.Fatal("expecting 3 records for A, got", len(records))
+	}
+	want := []struct{ counterparty, direction, balance string }{{"B", "out", "90"}, {"B", "in", "93"}, {"C", "out", "73"}}
+	for i, w := range want {
+		r := records[i]
+		if r.Counterparty != w.counterparty || r.Direction != w.direction || r.Balance != w.balance || r.TxId == "" {
+			t.Errorf("record %d: unexpected %+v", i, r)
+		}
+	}
+
+	page, err := History(stub, "A", records[1].Timestamp, records[1].Timestamp, 10, "")
+	if err != nil || len(page.Records) != 1 || page.Records[0].Balance != "93" {
+		t.Fatal("time range should select the second transfer", page, err)
+	}
+	page, err = History(stub, "C", time.Time{}, time.Time{}, 10, "")
+	if err != nil || len(page.Records) != 1 || page.Records[0].Direction != "in" || page.Bookmark != "" {
+		t.Fatal("unexpected history of C", page, err)
+	}
+	if _, err = History(stub, "A", time.Time{}, time.Time{}, 0, ""); err == nil {
+		t.Fatal("page size 0 should fail")
+	}
+}
+
+func TestHold(t *testing.T) {
+	stub := shim.NewMockStub("token", noopChaincode{})
+	if err := inTx(stub, func() error { return Genesis(stub, 0, Allocation{"A", "100"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := inTx(stub, func() error { return Hold(stub, "A", "escrow:1", "101") }); err == nil {
+		t.Fatal("holding more than the balance should fail")
+	}
+	if err := inTx(stub, func() error { return Hold(stub, "A", "escrow:1", "60") }); err != nil {
+		t.Fatal(err)
+	}
+	if balance(t, stub, "A") != "40" {
+		t.Fatal("held funds should leave the balance")
+	}
+	if err := inTx(stub, func() error { return Move(as(t, stub, "escrow:1"), "escrow:1", "B", "1") }); err == nil {
+		t.Fatal("held funds must not be transferable")
+	}
+	if err := inTx(stub, func() error { return Release(stub, "escrow:1", "B", "61") }); err == nil {
+		t.Fatal("releasing more than held should fail")
+	}
+	if err := inTx(stub, func() error { return Release(stub, "escrow:1", "B", "60") }); err != nil {
+		t.Fatal(err)
+	}
+	held, err := Held(stub, "escrow:1")
+	if err != nil || held.Sign() != 0 || balance(t, stub, "B") != "60" {
+		t.Fatal("hold should be fully released to B", held, err)
+	}
+	supply, err := TotalSupply(stub)
+	if err != nil || supply.String() != "100" {
+		t.Fatal("holds must not change the supply", supply, err)
+	}
+}
+
+func TestDeltas(t *testing.T) {
+	stub := shim.NewMockStub("token", noopChaincode{})
+	if err := inTx(stub, func() error { return Genesis(stub, 0, Allocation{"A", "100"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := inTx(stub, func() error { return UseDeltas(stub) }); err != nil {
+		t.Fatal(err)
+	}
+	for i, move := range [][3]string{{"A", "B", "30"}, {"A", "B", "20"}, {"B", "C", "5"}} {
+		txID := "delta" + strconv.Itoa(i)
+		stub.MockTransactionStart(txID)
+		err := MoveDelta(as(t, stub, move[0]), move[0], move[1], move[2])
+		stub.MockTransactionEnd(txID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if balance(t, stub, "A") != "100" {
+		t.Fatal("delta transfers must not touch the snapshot")
+	}
+	for account, want := range map[string]string{"A": "50", "B": "45", "C": "5"} {
+		v, err := Balance(stub, account)
+		if err != nil || v.String() != want {
+			t.Errorf("balance of %s: expected %s, got %v %v", account, want, v, err)
+		}
+	}
+	if _, err := Balance(stub, "X"); err != ErrAccountNotFound {
+		t.Fatal("unknown account should not be found", err)
+	}
+
+	if err := inTx(stub, func() error { _, err := Compact(stub, "B"); return err }); err != nil {
+		t.Fatal(err)
+	}
+	if balance(t, stub, "B") != "45" {
+		t.Fatal("compact should fold the deltas into the snapshot")
+	}
+	if v, err := Balance(stub, "B"); err != nil || v.String() != "45" {
+		t.Fatal("balance should not change after compact", v, err)
+	}
+
+	if err := inTx(stub, func() error { return MoveDelta(as(t, stub, "A"), "C", "A", "1") }); err == nil {
+		t.Fatal("only the owner of C may transfer from it")
+	}
+	// The sender's deltas count towards its funds, C holds 5
+	if err := inTx(stub, func() error { return MoveDelta(as(t, stub, "C"), "C", "A", "6") }); err == nil {
+		t.Fatal("a delta transfer must not overdraw the sender")
+	}
+	if err := inTx(stub, func() error { return MoveDelta(as(t, stub, "X"), "X", "A", "1") }); err != ErrAccountNotFound {
+		t.Fatal("an unknown sender should not be found", err)
+	}
+	if v, err := Balance(stub, "C"); err != nil || v.String() != "5" {
+		t.Fatal("a rejected transfer should leave the balance", v, err)
+	}
+
+	page, err := History(stub, "B", time.Time{}, time.Time{}, 10, "")
+	if err != nil || len(page.Records) != 3 {
+		t.Fatal("delta transfers should be recorded", page, err)
+	}
+	if r := page.Records[2]; r.Direction != "out" || r.Balance != "45" || r.Counterparty != "C" {
+		t.Fatal("the sender's record should carry its balance", r)
+	}
+	if r := page.Records[0]; r.Direction != "in" || r.Balance != "" {
+		t.Fatal("the receiver's balance is not read", r)
+	}
+}